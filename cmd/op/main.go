@@ -3,19 +3,26 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	log "github.com/charmbracelet/log"
+	"github.com/dustin/go-humanize"
 	_ "github.com/lib/pq"
 	"github.com/vinimdocarmo/quackfs/internal/storage"
 	objectstore "github.com/vinimdocarmo/quackfs/internal/storage/object"
+	"github.com/vinimdocarmo/quackfs/internal/storage/wal"
 	"github.com/vinimdocarmo/quackfs/pkg/logger"
 )
 
@@ -68,7 +75,10 @@ func main() {
 	objectStore := objectstore.NewS3(s3Client, s3BucketName)
 
 	// Create a storage manager
-	sm := storage.NewManager(db, objectStore, log)
+	sm, err := storage.NewManager(db, objectStore, log)
+	if err != nil {
+		log.Fatal("Failed to create storage manager", "error", err)
+	}
 
 	// Execute the appropriate command
 	switch command {
@@ -76,6 +86,26 @@ func main() {
 		executeWriteCommand(sm, log)
 	case "read":
 		executeReadCommand(sm, log)
+	case "clone":
+		executeCloneCommand(sm, log)
+	case "compact":
+		executeCompactCommand(sm, log)
+	case "gc":
+		executeGCCommand(sm, log)
+	case "retention":
+		executeRetentionCommand(sm, log)
+	case "tag":
+		executeTagCommand(sm, log)
+	case "restore":
+		executeRestoreCommand(sm, log)
+	case "versions":
+		executeVersionsCommand(sm, log)
+	case "diff":
+		executeDiffCommand(sm, log)
+	case "branch":
+		executeBranchCommand(sm, log)
+	case "promote":
+		executePromoteCommand(sm, log)
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
@@ -89,14 +119,47 @@ func printUsage() {
 	fmt.Println("Commands:")
 	fmt.Println("  write      - Write data to a file")
 	fmt.Println("  read       - Read and print file content to standard output")
+	fmt.Println("  clone      - Create a zero-copy clone of a file at a version")
+	fmt.Println("  compact    - Merge a run of snapshot layers of a file into one")
+	fmt.Println("  gc         - Delete layer objects no longer referenced by any file")
+	fmt.Println("  retention  - Show, set or apply the version retention policy of a file")
+	fmt.Println("  tag        - Name the latest committed version of a file")
+	fmt.Println("  restore    - Make an earlier version the new head of a file")
+	fmt.Println("  versions   - List the versions of a file")
+	fmt.Println("  diff       - Show the byte ranges that changed between two versions")
+	fmt.Println("  branch     - Create, list or delete the branches of a file")
+	fmt.Println("  promote    - Move the versions of a clone or branch back onto its source")
 	fmt.Println("")
 	fmt.Println("For detailed command usage:")
 	fmt.Println("  op write -h")
 	fmt.Println("  op read -h")
+	fmt.Println("  op clone -h")
+	fmt.Println("  op compact -h")
+	fmt.Println("  op gc -h")
+	fmt.Println("  op retention show|set|apply -h")
+	fmt.Println("  op tag -h")
+	fmt.Println("  op restore -h")
+	fmt.Println("  op versions -h")
+	fmt.Println("  op diff -h")
+	fmt.Println("  op branch create|list|delete -h")
+	fmt.Println("  op promote -h")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  op read -file myfile.txt")
 	fmt.Println("  op read -file myfile.txt -version v1.0")
+	fmt.Println("  op read -file myfile.txt -at 2026-10-01T12:00:00Z")
+	fmt.Println("  op clone -from db.duckdb -version v1.0 -to copy.duckdb")
+	fmt.Println("  op compact -file db.duckdb -to v2.0")
+	fmt.Println("  op gc -grace 24h -dry-run")
+	fmt.Println("  op retention set -file db.duckdb -keep-last 10 -keep-daily 7")
+	fmt.Println("  op retention apply -file db.duckdb -dry-run")
+	fmt.Println("  op tag -file db.duckdb -name before-migration")
+	fmt.Println("  op restore -file db.duckdb -version before-migration")
+	fmt.Println("  op versions -file db.duckdb -json")
+	fmt.Println("  op diff -file db.duckdb -from v1.0 -to v2.0 -blocks")
+	fmt.Println("  op branch create -file db.duckdb -name feature-x -version v1.0")
+	fmt.Println("  op branch list -file db.duckdb")
+	fmt.Println("  op promote -from copy.duckdb -to db.duckdb")
 }
 
 // executeWriteCommand handles the "write" subcommand
@@ -148,6 +211,7 @@ func executeReadCommand(sm *storage.Manager, log *log.Logger) {
 	offset := readCmd.Uint64("offset", 0, "Offset in the file to start reading from (default: 0)")
 	size := readCmd.Uint64("size", 0, "Number of bytes to read (default: entire file)")
 	version := readCmd.String("version", "", "Version tag to read from (default: latest)")
+	at := readCmd.String("at", "", "Read the newest version at or before this RFC 3339 timestamp (default: latest)")
 
 	// Parse the flags
 	readCmd.Parse(os.Args[1:])
@@ -155,14 +219,23 @@ func executeReadCommand(sm *storage.Manager, log *log.Logger) {
 	// Validate required flags
 	if *fileName == "" {
 		log.Error("Missing required flag: -file")
-		fmt.Println("Usage: op read -file <filename> [-offset <offset>] [-size <size>] [-version <tag>]")
+		fmt.Println("Usage: op read -file <filename> [-offset <offset>] [-size <size>] [-version <tag> | -at <timestamp>]")
 		os.Exit(1)
 	}
 
+	var timestamp time.Time
+	if *at != "" {
+		var err error
+		timestamp, err = time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatal("Invalid -at timestamp, expected RFC 3339 (e.g. 2026-10-01T12:00:00Z)", "at", *at, "error", err)
+		}
+	}
+
 	ctx := context.Background()
 
 	// Get file size to determine how much to read if size is not specified
-	fileSize, err := sm.SizeOf(ctx, *fileName)
+	fileSize, err := sm.SizeOf(ctx, *fileName, storage.WithVersion(*version), storage.WithTimestamp(timestamp))
 	if err != nil {
 		log.Fatal("Failed to get file size", "error", err)
 	}
@@ -175,19 +248,20 @@ func executeReadCommand(sm *storage.Manager, log *log.Logger) {
 
 	var data []byte
 
-	data, err = sm.ReadFile(ctx, *fileName, *offset, readSize, storage.WithVersion(*version))
+	data, err = sm.ReadFile(ctx, *fileName, *offset, readSize, storage.WithVersion(*version), storage.WithTimestamp(timestamp))
 	if err != nil {
 		log.Fatal("Failed to read data", "error", err)
 	}
 
 	// Print file information
-	if *version != "" {
+	if *version != "" || *at != "" {
 		log.Info("Read file content with version",
 			"fileName", *fileName,
 			"offset", *offset,
 			"size", readSize,
 			"bytesRead", len(data),
-			"version", *version)
+			"version", *version,
+			"at", *at)
 	} else {
 		log.Info("Read file content",
 			"fileName", *fileName,
@@ -207,7 +281,468 @@ func executeReadCommand(sm *storage.Manager, log *log.Logger) {
 	log.Info("Read operation completed", "fileName", *fileName, "bytesRead", len(data))
 }
 
+// executeCloneCommand handles the "clone" subcommand
+func executeCloneCommand(sm *storage.Manager, log *log.Logger) {
+	cloneCmd := flag.NewFlagSet("clone", flag.ExitOnError)
+	from := cloneCmd.String("from", "", "Source file to clone")
+	version := cloneCmd.String("version", "", "Version tag of the source to clone (default: latest committed version)")
+	to := cloneCmd.String("to", "", "Name of the new file")
+
+	cloneCmd.Parse(os.Args[1:])
+
+	if *from == "" || *to == "" {
+		log.Error("Missing required flags: -from and -to")
+		fmt.Println("Usage: op clone -from <filename> [-version <tag>] -to <filename>")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	fileID, err := sm.CloneFile(ctx, *from, *to, *version)
+	if err != nil {
+		log.Fatal("Failed to clone file", "error", err)
+	}
+
+	log.Info("File cloned successfully", "from", *from, "to", *to, "version", *version, "fileID", fileID)
+
+	fmt.Printf("Successfully cloned %s into %s\n", *from, *to)
+}
+
+// executeCompactCommand handles the "compact" subcommand
+func executeCompactCommand(sm *storage.Manager, log *log.Logger) {
+	compactCmd := flag.NewFlagSet("compact", flag.ExitOnError)
+	fileName := compactCmd.String("file", "", "File whose layers to compact")
+	from := compactCmd.String("from", "", "Version tag of the first layer to compact (default: oldest layer)")
+	to := compactCmd.String("to", "", "Version tag of the last layer to compact (default: newest layer)")
+
+	compactCmd.Parse(os.Args[1:])
+
+	if *fileName == "" {
+		log.Error("Missing required flag: -file")
+		fmt.Println("Usage: op compact -file <filename> [-from <tag>] [-to <tag>]")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	result, err := sm.Compact(ctx, *fileName, *from, *to)
+	if err != nil {
+		log.Fatal("Failed to compact file", "error", err)
+	}
+
+	if result.LayersMerged < 2 {
+		fmt.Printf("Nothing to compact in %s\n", *fileName)
+		return
+	}
+
+	fmt.Printf("Compacted %d layers of %s: %d chunks → %d, %s → %s\n",
+		result.LayersMerged, *fileName,
+		result.ChunksBefore, result.ChunksAfter,
+		humanize.Bytes(result.BytesBefore), humanize.Bytes(result.BytesAfter))
+}
+
+// executeGCCommand handles the "gc" subcommand
+func executeGCCommand(sm *storage.Manager, log *log.Logger) {
+	gcCmd := flag.NewFlagSet("gc", flag.ExitOnError)
+	grace := gcCmd.Duration("grace", time.Hour, "Keep unreferenced objects younger than this")
+	dryRun := gcCmd.Bool("dry-run", false, "Report what would be deleted without deleting anything")
+
+	gcCmd.Parse(os.Args[1:])
+
+	ctx := context.Background()
+
+	result, err := sm.GarbageCollect(ctx, storage.GCOptions{
+		GracePeriod: *grace,
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		log.Fatal("Failed to collect garbage", "error", err)
+	}
+
+	for _, key := range result.Deleted {
+		fmt.Println(key)
+	}
+
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+
+	fmt.Printf("%s %d of %d objects, reclaiming %s (%d kept within the %s grace period)\n",
+		verb, len(result.Deleted), result.Scanned, humanize.Bytes(result.BytesReclaimed), result.Young, *grace)
+}
+
+// executeRetentionCommand handles the "retention" subcommand
+func executeRetentionCommand(sm *storage.Manager, log *log.Logger) {
+	usage := "Usage: op retention show|set|apply -file <filename> [options]"
+
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	action := os.Args[1]
+
+	retentionCmd := flag.NewFlagSet("retention "+action, flag.ExitOnError)
+	fileName := retentionCmd.String("file", "", "File whose retention policy to use")
+
+	var policy storage.RetentionPolicy
+	var dryRun *bool
+
+	switch action {
+	case "show":
+	case "set":
+		retentionCmd.IntVar(&policy.KeepLast, "keep-last", 0, "Keep the n newest versions")
+		retentionCmd.DurationVar(&policy.KeepWithin, "keep-within", 0, "Keep versions newer than this duration")
+		retentionCmd.IntVar(&policy.KeepHourly, "keep-hourly", 0, "Keep one version for each of the last n hours")
+		retentionCmd.IntVar(&policy.KeepDaily, "keep-daily", 0, "Keep one version for each of the last n days")
+		retentionCmd.IntVar(&policy.KeepWeekly, "keep-weekly", 0, "Keep one version for each of the last n weeks")
+	case "apply":
+		dryRun = retentionCmd.Bool("dry-run", false, "Show which versions would be dropped without dropping them")
+	default:
+		log.Error("Unknown retention action", "action", action)
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	retentionCmd.Parse(os.Args[2:])
+
+	if *fileName == "" {
+		log.Error("Missing required flag: -file")
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	switch action {
+	case "set":
+		if err := sm.SetRetentionPolicy(ctx, *fileName, policy); err != nil {
+			log.Fatal("Failed to set retention policy", "error", err)
+		}
+		fmt.Printf("Retention policy of %s: %s\n", *fileName, policy)
+	case "show":
+		result, err := sm.ApplyRetention(ctx, *fileName, true)
+		if err != nil {
+			log.Fatal("Failed to evaluate retention policy", "error", err)
+		}
+		printRetention(*fileName, result)
+	case "apply":
+		result, err := sm.ApplyRetention(ctx, *fileName, *dryRun)
+		if err != nil {
+			log.Fatal("Failed to apply retention policy", "error", err)
+		}
+		printRetention(*fileName, result)
+		if *dryRun {
+			fmt.Printf("Would drop %d versions\n", result.Expired)
+		} else {
+			fmt.Printf("Dropped %d versions\n", result.Expired)
+		}
+	}
+}
+
+// printRetention prints the retention policy of a file and what it does to each version
+func printRetention(fileName string, result *storage.RetentionResult) {
+	fmt.Printf("Retention policy of %s: %s\n", fileName, result.Policy)
+	for _, d := range result.Decisions {
+		status := "drop"
+		if d.Keep {
+			status = "keep (" + d.Reason + ")"
+		}
+		fmt.Printf("  %-45s %s  %s\n", d.Layer.Tag, d.Layer.CreatedAt.Format(time.RFC3339), status)
+	}
+}
+
+// executeTagCommand handles the "tag" subcommand
+func executeTagCommand(sm *storage.Manager, log *log.Logger) {
+	tagCmd := flag.NewFlagSet("tag", flag.ExitOnError)
+	fileName := tagCmd.String("file", "", "File whose latest committed version to tag")
+	name := tagCmd.String("name", "", "Tag to give to the version")
+
+	tagCmd.Parse(os.Args[1:])
+
+	if *fileName == "" || *name == "" {
+		log.Error("Missing required flags: -file and -name")
+		fmt.Println("Usage: op tag -file <filename> -name <tag>")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	layer, err := sm.TagVersion(ctx, *fileName, *name)
+	if err != nil {
+		log.Fatal("Failed to tag version", "error", err)
+	}
+
+	fmt.Printf("Tagged version of %s committed at %s as %s\n", *fileName, layer.CreatedAt.Format(time.RFC3339), layer.Tag)
+}
+
+// executeRestoreCommand handles the "restore" subcommand
+func executeRestoreCommand(sm *storage.Manager, log *log.Logger) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal("Failed to get home directory", "error", err)
+	}
+
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	fileName := restoreCmd.String("file", "", "File to restore")
+	version := restoreCmd.String("version", "", "Version tag to restore")
+	walPath := restoreCmd.String("wal-path", homeDir, "Path where the running quackfs stores WAL files")
+	force := restoreCmd.Bool("force", false, "Restore even if the file has a WAL, discarding the transactions in it")
+
+	restoreCmd.Parse(os.Args[1:])
+
+	if *fileName == "" || *version == "" {
+		log.Error("Missing required flags: -file and -version")
+		fmt.Println("Usage: op restore -file <filename> -version <tag> [-wal-path <path>] [-force]")
+		os.Exit(1)
+	}
+
+	// A WAL holds transactions DuckDB has not checkpointed yet; they would be
+	// replayed on top of the restored file
+	wm := wal.NewWALManager(*walPath, sm, log)
+	walFile := *fileName + ".wal"
+	exists, err := wm.Exists(walFile)
+	if err != nil {
+		log.Fatal("Failed to check for a WAL file", "error", err)
+	}
+	if exists && !*force {
+		log.Fatal("Refusing to restore while the file has a WAL, close the database first or use -force", "wal", wm.GetFilePath(walFile))
+	}
+
+	ctx := context.Background()
+
+	// A mount writing to the file would not notice the restore, and would commit
+	// its own writes on top of it
+	lock, err := sm.LockOffline(ctx)
+	if errors.Is(err, storage.ErrMounted) {
+		log.Fatal("Refusing to restore while the files are mounted for writing, unmount them first")
+	}
+	if err != nil {
+		log.Fatal("Failed to lock files", "error", err)
+	}
+	defer lock.Release(ctx)
+
+	tag, err := sm.Restore(ctx, *fileName, *version)
+	if err != nil {
+		log.Fatal("Failed to restore file", "error", err)
+	}
+
+	fmt.Printf("Restored %s to version %s, committed as %s\n", *fileName, *version, tag)
+}
+
+// executeVersionsCommand handles the "versions" subcommand
+func executeVersionsCommand(sm *storage.Manager, log *log.Logger) {
+	versionsCmd := flag.NewFlagSet("versions", flag.ExitOnError)
+	fileName := versionsCmd.String("file", "", "File whose versions to list")
+	asJSON := versionsCmd.Bool("json", false, "Print the versions as JSON")
+
+	versionsCmd.Parse(os.Args[1:])
+
+	if *fileName == "" {
+		log.Error("Missing required flag: -file")
+		fmt.Println("Usage: op versions -file <filename> [-json]")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	history, err := sm.History(ctx, *fileName)
+	if err != nil {
+		log.Fatal("Failed to get history", "error", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(history); err != nil {
+			log.Fatal("Failed to encode history", "error", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tVERSION\tCREATED\tCHUNKS\tBYTES\tVISIBLE\tOBJECT")
+	for _, v := range history {
+		object := v.ObjectKey
+		if v.CompactedInto != 0 {
+			object = fmt.Sprintf("(compacted into layer %d)", v.CompactedInto)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%s\t%s\n",
+			v.Tag, v.VersionID, v.CreatedAt.Format(time.RFC3339), v.Chunks,
+			humanize.Bytes(v.Bytes), humanize.Bytes(v.VisibleBytes), object)
+	}
+	w.Flush()
+}
+
+// executeDiffCommand handles the "diff" subcommand
+func executeDiffCommand(sm *storage.Manager, log *log.Logger) {
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	fileName := diffCmd.String("file", "", "File to diff")
+	from := diffCmd.String("from", "", "Version tag to diff from")
+	to := diffCmd.String("to", "", "Version tag to diff to (default: latest committed version)")
+	blocks := diffCmd.Bool("blocks", false, "Also print the DuckDB blocks that changed")
+
+	diffCmd.Parse(os.Args[1:])
+
+	if *fileName == "" || *from == "" {
+		log.Error("Missing required flags: -file and -from")
+		fmt.Println("Usage: op diff -file <filename> -from <tag> [-to <tag>] [-blocks]")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	diff, err := sm.Diff(ctx, *fileName, *from, *to)
+	if err != nil {
+		log.Fatal("Failed to diff versions", "error", err)
+	}
+
+	for _, r := range diff.Ranges {
+		fmt.Printf("[%d, %d)\t%s\n", r[0], r[1], humanize.Bytes(r[1]-r[0]))
+	}
+
+	fmt.Printf("%d ranges changed, %s in total\n", len(diff.Ranges), humanize.Bytes(diff.Bytes))
+
+	if *blocks {
+		header, changed := diff.Blocks()
+		if header {
+			fmt.Println("File headers changed")
+		}
+		fmt.Printf("%d blocks of %s changed: %v\n", len(changed), humanize.IBytes(storage.DuckDBBlockSize), changed)
+	}
+}
+
 // newDB creates a new database connection
+// executeBranchCommand handles the "branch" subcommand
+func executeBranchCommand(sm *storage.Manager, log *log.Logger) {
+	usage := "Usage: op branch create|list|delete -file <filename> [options]"
+
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	action := os.Args[1]
+
+	branchCmd := flag.NewFlagSet("branch "+action, flag.ExitOnError)
+	fileName := branchCmd.String("file", "", "File whose branches to manage")
+
+	var name, version *string
+
+	switch action {
+	case "list":
+	case "create":
+		name = branchCmd.String("name", "", "Name of the branch")
+		version = branchCmd.String("version", "", "Version tag to branch from (default: latest committed version)")
+	case "delete":
+		name = branchCmd.String("name", "", "Name of the branch")
+	default:
+		log.Error("Unknown branch action", "action", action)
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	branchCmd.Parse(os.Args[2:])
+
+	if *fileName == "" || (name != nil && *name == "") {
+		log.Error("Missing required flags: -file and -name")
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+
+	switch action {
+	case "create":
+		branch, err := sm.CreateBranch(ctx, *fileName, *name, *version)
+		if err != nil {
+			log.Fatal("Failed to create branch", "error", err)
+		}
+		fmt.Printf("Created branch %s of %s from version %s as %s\n", branch.Name, branch.Parent, branch.BaseTag, branch.FileName)
+	case "list":
+		branches, err := sm.ListBranches(ctx, *fileName)
+		if err != nil {
+			log.Fatal("Failed to list branches", "error", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BRANCH\tFILE\tFROM VERSION\tCREATED")
+		for _, b := range branches {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.Name, b.FileName, b.BaseTag, b.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+	case "delete":
+		if err := sm.DeleteBranch(ctx, *fileName, *name); err != nil {
+			log.Fatal("Failed to delete branch", "error", err)
+		}
+		fmt.Printf("Deleted branch %s of %s\n", *name, *fileName)
+	}
+}
+
+// executePromoteCommand handles the "promote" subcommand
+func executePromoteCommand(sm *storage.Manager, log *log.Logger) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal("Failed to get home directory", "error", err)
+	}
+
+	promoteCmd := flag.NewFlagSet("promote", flag.ExitOnError)
+	from := promoteCmd.String("from", "", "Clone or branch whose versions to promote")
+	to := promoteCmd.String("to", "", "File the clone or branch was created from")
+	walPath := promoteCmd.String("wal-path", homeDir, "Path where the running quackfs stores WAL files")
+	force := promoteCmd.Bool("force", false, "Promote even if one of the files has a WAL")
+
+	promoteCmd.Parse(os.Args[1:])
+
+	if *from == "" || *to == "" {
+		log.Error("Missing required flags: -from and -to")
+		fmt.Println("Usage: op promote -from <filename> -to <filename> [-wal-path <path>] [-force]")
+		os.Exit(1)
+	}
+
+	// A WAL holds transactions DuckDB has not checkpointed yet, they belong to
+	// the history that is being replaced or moved
+	wm := wal.NewWALManager(*walPath, sm, log)
+	for _, fileName := range []string{*from, *to} {
+		walFile := fileName + ".wal"
+		exists, err := wm.Exists(walFile)
+		if err != nil {
+			log.Fatal("Failed to check for a WAL file", "error", err)
+		}
+		if exists && !*force {
+			log.Fatal("Refusing to promote while a file has a WAL, close the database first or use -force", "wal", wm.GetFilePath(walFile))
+		}
+	}
+
+	ctx := context.Background()
+
+	// A mount writing to either file would not notice the promotion, and would
+	// commit its own writes on top of a history that moved or was replaced. The
+	// offline lock covers every file, both of these included.
+	lock, err := sm.LockOffline(ctx)
+	if errors.Is(err, storage.ErrMounted) {
+		log.Fatal("Refusing to promote while the files are mounted for writing, unmount them first")
+	}
+	if err != nil {
+		log.Fatal("Failed to lock files", "error", err)
+	}
+	defer lock.Release(ctx)
+
+	result, err := sm.Promote(ctx, *from, *to)
+	if err != nil {
+		var conflict *storage.PromoteConflictError
+		if errors.As(err, &conflict) {
+			fmt.Printf("%s changed since %s diverged from it, versions: %s\n", conflict.Dst, conflict.Src, strings.Join(conflict.Versions, ", "))
+			for _, r := range conflict.Overlaps {
+				fmt.Printf("  written to both: [%d, %d)\t%s\n", r[0], r[1], humanize.Bytes(r[1]-r[0]))
+			}
+		}
+		log.Fatal("Failed to promote file", "error", err)
+	}
+
+	fmt.Printf("Promoted %d versions of %s onto %s: %s\n", result.Layers, *from, *to, strings.Join(result.Versions, ", "))
+}
+
 func newDB(log *log.Logger) *sql.DB {
 	host := getEnvOrDefault("POSTGRES_HOST", "localhost")
 	port := getEnvOrDefault("POSTGRES_PORT", "5432")
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -13,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dustin/go-humanize"
 	_ "github.com/lib/pq"
 	"github.com/vinimdocarmo/quackfs/internal/fsx"
 	"github.com/vinimdocarmo/quackfs/internal/storage"
@@ -24,22 +28,43 @@ func main() {
 	// Initialize logger first thing
 	log := logger.New(os.Stderr)
 
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal("Failed to get home directory", "error", err)
+	}
+
 	mountpoint := flag.String("mount", "", "Mount point for the FUSE filesystem")
+	walPath := flag.String("wal-path", homeDir, "Path to the WAL file")
+	version := flag.String("version", "", "Mount the database files read-only as of this version tag (default: latest, writable)")
+	at := flag.String("at", "", "Mount the database files read-only as of this RFC 3339 timestamp (default: latest, writable)")
+	compactMaxLayers := flag.Int("compact-max-layers", 0, "Compact a file in the background once it has more than this many layers (default: 0, disabled)")
+	compactInterval := flag.Duration("compact-interval", 5*time.Minute, "How often files are checked for background compaction")
+	spillDir := flag.String("spill-dir", os.TempDir(), "Directory of the spill files of large uncheckpointed writes")
+	spillThreshold := flag.Uint64("spill-threshold", 64<<20, "Move uncheckpointed writes of a file to a spill file once they exceed this many bytes (0 keeps them in memory)")
+	journalDir := flag.String("journal-dir", filepath.Join(homeDir, ".quackfs", "journal"), "Directory of the journals that let writes that were not checkpointed survive a crash, one subdirectory per database and bucket (empty disables them)")
+	checkpointMaxBytes := flag.Uint64("checkpoint-max-bytes", 0, "Checkpoint a file on its own once its uncheckpointed writes exceed this many bytes (default: 0, disabled)")
+	checkpointMaxAge := flag.Duration("checkpoint-max-age", 0, "Checkpoint a file on its own once its oldest uncheckpointed write is older than this (default: 0, disabled)")
+	checkpointInterval := flag.Duration("checkpoint-interval", 10*time.Second, "How often files are checked for automatic checkpoints")
+	cacheDir := flag.String("cache-dir", filepath.Join(homeDir, ".quackfs", "cache"), "Directory of the local cache of the blocks read from the object store (empty disables it)")
+	cacheSize := flag.Uint64("cache-size", 1<<30, "Evict the least recently used blocks once the local cache exceeds this many bytes")
+	cacheBlockSize := flag.Uint64("cache-block-size", 1<<20, "Size of the aligned blocks of the objects the local cache reads and keeps")
+	fetchGap := flag.Uint64("fetch-gap", 64<<10, "Fetch ranges of the same layer that are at most this many bytes apart with a single request")
+	fetchConcurrency := flag.Int("fetch-concurrency", 8, "Range requests a read makes to the object store at the same time")
+	readAheadTrigger := flag.Int("readahead-trigger", 2, "Start prefetching once a file handle made this many sequential reads in a row")
+	readAheadMin := flag.Int("readahead-min", 4, "Reads prefetched ahead of a sequential scan when read-ahead starts")
+	readAheadMax := flag.Int("readahead-max", 64, "Reads prefetched ahead of a sequential scan at most, the window doubling as the scan keeps up (0 disables read-ahead)")
+	durability := flag.String("durability", "", "What an fsync of a database file guarantees: none, local (flush the journal) or remote (commit the writes to the object store) (default: local, none if the journal is disabled)")
 	flag.Parse()
 
 	if *mountpoint == "" {
-		log.Info("Usage: ./quackfs -mount <mountpoint>")
+		log.Info("Usage: ./quackfs -mount <mountpoint> [-wal-path <path>] [-version <tag> | -at <timestamp>]")
 		os.Exit(1)
 	}
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatal("Failed to get home directory", "error", err)
+	if *version != "" && *at != "" {
+		log.Fatal("Only one of -version and -at can be specified")
 	}
 
-	walPath := flag.String("wal-path", homeDir, "Path to the WAL file")
-	flag.Parse()
-
 	fmt.Println(`
   __
 >(o )___
@@ -95,26 +120,150 @@ Differential Storage System for DuckDB
 		o.DisableLogOutputChecksumValidationSkipped = true
 	})
 
-	objectStore := objectstore.NewS3(s3Client, s3BucketName)
+	var objectStore objectstore.Store = objectstore.NewS3(s3Client, s3BucketName)
+
+	// Layer objects never change, so the blocks read from them can be cached
+	// across restarts
+	var cache *objectstore.DiskCache
+	if *cacheDir != "" && *cacheSize > 0 {
+		cache, err = objectstore.NewDiskCache(objectStore, *cacheDir, *cacheSize, *cacheBlockSize)
+		if err != nil {
+			log.Fatal("Failed to open local cache", "dir", *cacheDir, "error", err)
+		}
+		objectStore = cache
+
+		stats := cache.Stats()
+		log.Info("Using local cache", "dir", *cacheDir, "size", humanize.Bytes(stats.Bytes), "limit", humanize.Bytes(*cacheSize))
+	}
+
+	managerOptions := []storage.Option{
+		storage.WithSpill(*spillDir, *spillThreshold),
+		storage.WithRangeFetch(*fetchGap, *fetchConcurrency),
+	}
+
+	// Prefetched data is only kept by the cache
+	if cache != nil {
+		managerOptions = append(managerOptions, storage.WithReadAhead(storage.ReadAheadPolicy{
+			Trigger:   *readAheadTrigger,
+			MinWindow: *readAheadMin,
+			MaxWindow: *readAheadMax,
+		}))
+	} else if *readAheadMax > 0 {
+		log.Warn("Read-ahead disabled since the local cache is disabled")
+	}
+
+	// Read-only mounts never write, so they leave the journal to writable mounts
+	if *version == "" && *at == "" {
+		if *durability != "" {
+			d, err := storage.ParseDurability(*durability)
+			if err != nil {
+				log.Fatal("Invalid -durability", "error", err)
+			}
+			if d == storage.DurabilityLocal && *journalDir == "" {
+				log.Fatal("-durability local flushes the journal, which -journal-dir \"\" disables; set a -journal-dir or another -durability")
+			}
+			managerOptions = append(managerOptions, storage.WithDurability(d))
+		}
+
+		if *journalDir != "" {
+			dir := filepath.Join(*journalDir, journalNamespace(host, port, dbname, s3BucketName))
+			managerOptions = append(managerOptions, storage.WithJournal(dir))
+			log.Info("Journaling writes in", "path", dir)
+		}
+	}
+
+	sm, err := storage.NewManager(db, objectStore, log, managerOptions...)
+	if err != nil {
+		log.Fatal("Failed to create storage manager", "error", err)
+	}
+
+	// Offline operations like op restore refuse to run while a writable mount
+	// holds this lock, and a mount waits for them to finish
+	if *version == "" && *at == "" {
+		lock, err := sm.LockMounted(context.Background())
+		if err != nil {
+			log.Fatal("Failed to lock files for writing", "error", err)
+		}
+		defer lock.Release(context.Background())
+	}
+
+	if *compactMaxLayers > 0 && *version == "" && *at == "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go sm.RunCompaction(ctx, storage.CompactionPolicy{
+			MaxLayers: *compactMaxLayers,
+			Interval:  *compactInterval,
+		})
+	}
+
+	if (*checkpointMaxBytes > 0 || *checkpointMaxAge > 0) && *version == "" && *at == "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go sm.RunAutoCheckpoint(ctx, storage.AutoCheckpointPolicy{
+			MaxBytes: *checkpointMaxBytes,
+			MaxAge:   *checkpointMaxAge,
+			Interval: *checkpointInterval,
+		})
+	}
+
+	mountOptions := []fuse.MountOption{fuse.FSName("quackfs")}
+	fsOptions := []fsx.Option{}
+
+	if *version != "" {
+		mountOptions = append(mountOptions, fuse.ReadOnly())
+		fsOptions = append(fsOptions, fsx.WithVersion(*version))
+	}
 
-	sm := storage.NewManager(db, objectStore, log)
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			log.Fatal("Invalid -at timestamp, expected RFC 3339 (e.g. 2026-10-01T12:00:00Z)", "at", *at, "error", err)
+		}
+		mountOptions = append(mountOptions, fuse.ReadOnly())
+		fsOptions = append(fsOptions, fsx.WithTimestamp(t))
+	}
 
 	// Mount the FUSE filesystem.
-	c, err := fuse.Mount(*mountpoint, fuse.FSName("quackfs"))
+	c, err := fuse.Mount(*mountpoint, mountOptions...)
 	if err != nil {
 		log.Fatal("Failed to mount FUSE", "error", err)
 	}
 	defer c.Close()
 
 	log.Info("FUSE filesystem mounted", "mountpoint", *mountpoint)
+	if *version != "" {
+		log.Info("Serving read-only version", "version", *version)
+	}
+	if *at != "" {
+		log.Info("Serving read-only point in time", "at", *at)
+	}
+	if *version == "" && *at == "" {
+		log.Info("Fsync durability", "mode", sm.Durability())
+	}
 	log.Info("Storing WAL file in", "path", *walPath)
 	log.Info("Using PostgreSQL for metadata", "host", os.Getenv("POSTGRES_HOST"))
 	log.Info("Using S3 for data storage", "endpoint", s3Endpoint, "bucket", s3BucketName, "region", s3Region)
 
 	// Serve the filesystem. fs.Serve blocks until the filesystem is unmounted.
-	if err := fs.Serve(c, fsx.NewFS(sm, log, *walPath)); err != nil {
+	if err := fs.Serve(c, fsx.NewFS(sm, log, *walPath, fsOptions...)); err != nil {
 		log.Fatal("Failed to serve FUSE FS", "error", err)
 	}
+
+	if cache != nil {
+		stats := cache.Stats()
+		log.Info("Local cache stats", "hits", stats.Hits, "misses", stats.Misses, "evictions", stats.Evictions,
+			"entries", stats.Entries, "size", humanize.Bytes(stats.Bytes))
+	}
+}
+
+// journalNamespace names the journal directory of a metadata database and a
+// bucket. Journals are named after file IDs, which only identify a file within
+// the database they come from.
+func journalNamespace(host, port, dbname, bucket string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s/%s/%s", host, port, dbname, bucket)))
+	return fmt.Sprintf("%s-%x", dbname, sum[:6])
 }
 
 // getEnvOrDefault returns the environment variable value or a default if not set
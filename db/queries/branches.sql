@@ -0,0 +1,54 @@
+-- name: InsertBranch :exec
+INSERT INTO 
+    branches (file_id, name, parent_file_id, base_layer_id)
+VALUES 
+    ($1, $2, $3, $4);
+
+-- name: GetBranchesByParent :many
+SELECT 
+    branches.file_id, 
+    files.name AS file_name, 
+    branches.name, 
+    branches.base_layer_id, 
+    versions.tag AS base_tag, 
+    branches.created_at
+FROM 
+    branches
+INNER JOIN 
+    files ON files.id = branches.file_id
+INNER JOIN 
+    snapshot_layers ON snapshot_layers.id = branches.base_layer_id
+LEFT JOIN 
+    versions ON versions.id = snapshot_layers.version_id
+WHERE 
+    branches.parent_file_id = $1
+ORDER BY 
+    branches.name ASC;
+
+-- name: GetBranchPoints :many
+SELECT DISTINCT 
+    base_layer_id
+FROM 
+    branches
+WHERE 
+    parent_file_id = $1
+ORDER BY 
+    base_layer_id ASC;
+
+-- name: DeleteBranch :exec
+DELETE FROM 
+    branches
+WHERE 
+    file_id = $1;
+
+-- name: GetBranchByFileID :one
+SELECT 
+    file_id, 
+    name, 
+    parent_file_id, 
+    base_layer_id, 
+    created_at
+FROM 
+    branches
+WHERE 
+    file_id = $1;
@@ -1,26 +1,49 @@
 -- name: CalcFileSize :one
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = sqlc.arg('fileID')
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
 SELECT 
     UPPER(e.file_range)::BIGINT as file_size
 FROM 
     chunks e
 INNER JOIN 
     snapshot_layers l ON e.snapshot_layer_id = l.id
+INNER JOIN 
+    ancestry a ON l.file_id = a.file_id
 WHERE 
-    l.file_id = $1
+    (a.base_layer_id IS NULL OR l.id <= a.base_layer_id) AND
+    -- if versionedLayerID is 0, then we don't filter by layer ID
+    (sqlc.arg('versionedLayerID') = 0 OR l.id <= sqlc.arg('versionedLayerID'))
 ORDER BY 
     UPPER(e.file_range) DESC
 LIMIT 1;
 
 -- name: InsertChunk :exec
 INSERT INTO 
-    chunks (snapshot_layer_id, layer_range, file_range) 
+    chunks (snapshot_layer_id, layer_range, file_range, object_key, zero) 
 VALUES 
-    ($1, $2, $3);
+    ($1, $2, $3, $4, $5);
 
 -- name: GetLayerChunks :many
 SELECT 
     layer_range, 
-    file_range
+    file_range,
+    object_key,
+    zero
 FROM 
     chunks
 WHERE 
@@ -29,17 +52,78 @@ ORDER BY
     id ASC;
 
 -- name: GetOverlappingChunksWithVersion :many
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = sqlc.arg('fileID')
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
 SELECT 
     c.snapshot_layer_id, 
     c.layer_range, 
-    c.file_range
+    c.file_range,
+    c.object_key,
+    c.zero,
+    l.object_key AS layer_object_key
 FROM 
     chunks c
 INNER JOIN 
     snapshot_layers l ON c.snapshot_layer_id = l.id
+INNER JOIN 
+    ancestry a ON l.file_id = a.file_id
 WHERE
+    (a.base_layer_id IS NULL OR l.id <= a.base_layer_id) AND
     -- if versionedLayerID is 0, then we don't filter by layer ID
     (sqlc.arg('versionedLayerID') = 0 OR l.id <= sqlc.arg('versionedLayerID')) AND
-    l.file_id = sqlc.arg('fileID') AND c.file_range && sqlc.arg('range')::INT8RANGE
+    c.file_range && sqlc.arg('range')::INT8RANGE
 ORDER BY 
-    l.id ASC, c.id ASC; 
\ No newline at end of file
+    l.id ASC, c.id ASC;
+
+-- name: CopyLayerChunks :exec
+INSERT INTO 
+    chunks (snapshot_layer_id, layer_range, file_range, object_key, zero)
+SELECT 
+    sqlc.arg('dstLayerID')::BIGINT, layer_range, file_range, object_key, zero
+FROM 
+    chunks
+WHERE 
+    snapshot_layer_id = sqlc.arg('srcLayerID')
+ORDER BY 
+    id ASC;
+
+-- name: DeleteChunksOfLayers :exec
+DELETE FROM 
+    chunks
+WHERE 
+    snapshot_layer_id IN (
+        SELECT 
+            id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = sqlc.arg('fileID') AND id >= sqlc.arg('fromLayerID')::BIGINT AND id <= sqlc.arg('toLayerID')::BIGINT
+    );
+
+-- name: DeleteChunksOfFile :exec
+DELETE FROM 
+    chunks
+WHERE 
+    snapshot_layer_id IN (
+        SELECT 
+            id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = $1
+    );
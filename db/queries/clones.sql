@@ -0,0 +1,33 @@
+-- name: InsertClone :exec
+INSERT INTO 
+    clones (file_id, source_file_id, source_layer_id, base_layer_id)
+VALUES 
+    ($1, $2, $3, $4);
+
+-- name: GetCloneByFileID :one
+SELECT 
+    file_id, 
+    source_file_id, 
+    source_layer_id, 
+    base_layer_id, 
+    created_at
+FROM 
+    clones
+WHERE 
+    file_id = $1;
+
+-- name: DeleteClone :exec
+DELETE FROM 
+    clones
+WHERE 
+    file_id = $1;
+
+-- name: GetClonePoints :many
+SELECT DISTINCT 
+    source_layer_id
+FROM 
+    clones
+WHERE 
+    source_file_id = $1
+ORDER BY 
+    source_layer_id ASC;
@@ -1,8 +1,44 @@
 -- name: GetFileIDByName :one
 SELECT id FROM files WHERE name = $1;
 
+-- name: FileExists :one
+SELECT EXISTS (SELECT 1 FROM files WHERE id = $1);
+
 -- name: InsertFile :one
 INSERT INTO files (name) VALUES ($1) RETURNING id;
 
 -- name: GetAllFiles :many
-SELECT id, name FROM files; 
\ No newline at end of file
+SELECT id, name, generation FROM files; 
+
+-- name: GetFileGeneration :one
+-- The generation of a branch includes those of the files it was branched from,
+-- whose layers it reads too. It is -1 for a file that doesn't exist.
+WITH RECURSIVE ancestry (file_id) AS (
+    SELECT 
+        files.id
+    FROM 
+        files
+    WHERE 
+        files.id = sqlc.arg('fileID')
+    UNION ALL
+    SELECT 
+        branches.parent_file_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
+SELECT 
+    COALESCE(SUM(files.generation), -1)::BIGINT AS generation
+FROM 
+    files
+INNER JOIN 
+    ancestry a ON files.id = a.file_id;
+
+-- name: DeleteFile :exec
+DELETE FROM files WHERE id = $1;
+
+-- name: LockFile :exec
+-- Every change to the layers of a file updates its row, so locking the row
+-- keeps them from changing until the end of the transaction.
+SELECT id FROM files WHERE id = $1 FOR UPDATE;
@@ -0,0 +1,30 @@
+-- name: GetRetentionPolicy :one
+SELECT 
+    file_id, 
+    keep_last, 
+    keep_within_seconds, 
+    keep_hourly, 
+    keep_daily, 
+    keep_weekly
+FROM 
+    retention_policies
+WHERE 
+    file_id = $1;
+
+-- name: UpsertRetentionPolicy :exec
+INSERT INTO 
+    retention_policies (file_id, keep_last, keep_within_seconds, keep_hourly, keep_daily, keep_weekly)
+VALUES 
+    ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (file_id) DO UPDATE SET
+    keep_last = EXCLUDED.keep_last,
+    keep_within_seconds = EXCLUDED.keep_within_seconds,
+    keep_hourly = EXCLUDED.keep_hourly,
+    keep_daily = EXCLUDED.keep_daily,
+    keep_weekly = EXCLUDED.keep_weekly;
+
+-- name: DeleteRetentionPolicy :exec
+DELETE FROM 
+    retention_policies
+WHERE 
+    file_id = $1;
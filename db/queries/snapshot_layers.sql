@@ -4,7 +4,9 @@ SELECT
     snapshot_layers.file_id, 
     snapshot_layers.version_id, 
     versions.tag, 
-    snapshot_layers.object_key
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into,
+    snapshot_layers.created_at
 FROM 
     snapshot_layers
 LEFT JOIN 
@@ -35,10 +37,120 @@ SELECT
     snapshot_layers.file_id, 
     snapshot_layers.version_id, 
     versions.tag, 
-    snapshot_layers.object_key
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into
 FROM 
     snapshot_layers
 INNER JOIN 
     versions ON versions.id = snapshot_layers.version_id
 WHERE 
-    snapshot_layers.file_id = $1 AND versions.tag = $2; 
\ No newline at end of file
+    snapshot_layers.file_id = $1 AND versions.tag = $2;
+
+-- name: GetLayerByTimestamp :one
+SELECT 
+    snapshot_layers.id, 
+    snapshot_layers.file_id, 
+    snapshot_layers.version_id, 
+    versions.tag, 
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into
+FROM 
+    snapshot_layers
+INNER JOIN 
+    versions ON versions.id = snapshot_layers.version_id
+WHERE 
+    snapshot_layers.file_id = sqlc.arg('fileID') AND snapshot_layers.created_at <= sqlc.arg('at')::TIMESTAMPTZ
+ORDER BY 
+    snapshot_layers.created_at DESC, snapshot_layers.id DESC
+LIMIT 1;
+
+-- name: UpdateLayerObjectKey :exec
+UPDATE 
+    snapshot_layers
+SET 
+    object_key = $2
+WHERE 
+    id = $1;
+
+-- name: MarkLayersCompacted :exec
+UPDATE 
+    snapshot_layers
+SET 
+    compacted_into = sqlc.arg('intoLayerID')::BIGINT,
+    object_key = ''
+WHERE 
+    file_id = sqlc.arg('fileID') AND (
+        (id >= sqlc.arg('fromLayerID')::BIGINT AND id < sqlc.arg('intoLayerID')::BIGINT) OR
+        (compacted_into >= sqlc.arg('fromLayerID')::BIGINT AND compacted_into < sqlc.arg('intoLayerID')::BIGINT)
+    );
+-- name: GetReferencedObjectKeys :many
+SELECT 
+    object_key
+FROM 
+    snapshot_layers
+WHERE 
+    object_key <> ''
+UNION
+SELECT 
+    object_key
+FROM 
+    chunks
+WHERE 
+    object_key <> '';
+
+-- name: DeleteLayer :exec
+DELETE FROM 
+    snapshot_layers
+WHERE 
+    id = $1;
+
+-- name: GetLayersWithAncestry :many
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = sqlc.arg('fileID')
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
+SELECT 
+    snapshot_layers.id, 
+    snapshot_layers.file_id, 
+    snapshot_layers.version_id, 
+    versions.tag, 
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into,
+    snapshot_layers.created_at
+FROM 
+    snapshot_layers
+INNER JOIN 
+    ancestry ON snapshot_layers.file_id = ancestry.file_id
+LEFT JOIN 
+    versions ON snapshot_layers.version_id = versions.id
+WHERE 
+    ancestry.base_layer_id IS NULL OR snapshot_layers.id <= ancestry.base_layer_id
+ORDER BY 
+    snapshot_layers.id ASC;
+
+-- name: DeleteLayersOfFile :exec
+DELETE FROM 
+    snapshot_layers
+WHERE 
+    file_id = $1;
+
+-- name: MoveLayers :exec
+UPDATE 
+    snapshot_layers
+SET 
+    file_id = sqlc.arg('dstFileID')
+WHERE 
+    file_id = sqlc.arg('srcFileID') AND id >= sqlc.arg('fromLayerID')::BIGINT;
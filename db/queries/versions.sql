@@ -1,2 +1,26 @@
 -- name: InsertVersion :one
-INSERT INTO versions (tag) VALUES ($1) RETURNING id; 
\ No newline at end of file
+INSERT INTO versions (file_id, tag) VALUES ($1, $2) RETURNING id; 
+
+-- name: UpdateVersionTag :exec
+UPDATE versions SET tag = $2 WHERE id = $1;
+
+-- name: DeleteVersion :exec
+DELETE FROM versions WHERE id = $1;
+
+-- name: DeleteVersionsOfFile :exec
+DELETE FROM versions WHERE file_id = $1;
+
+-- name: MoveVersionsOfLayers :exec
+UPDATE 
+    versions
+SET 
+    file_id = sqlc.arg('dstFileID')
+WHERE 
+    id IN (
+        SELECT 
+            version_id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = sqlc.arg('srcFileID') AND id >= sqlc.arg('fromLayerID')::BIGINT
+    );
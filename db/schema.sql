@@ -3,14 +3,17 @@ CREATE EXTENSION btree_gist;
 -- Create files table
 CREATE TABLE IF NOT EXISTS files (
     id BIGSERIAL PRIMARY KEY,
-    name TEXT UNIQUE NOT NULL
+    name TEXT UNIQUE NOT NULL,
+    generation BIGINT NOT NULL DEFAULT 0 -- bumped whenever a layer of the file is added, changed or removed
 );
 
 -- Create versions table
 CREATE TABLE IF NOT EXISTS versions (
     id BIGSERIAL PRIMARY KEY,
+    file_id BIGINT NOT NULL REFERENCES files(id),
     tag TEXT NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (file_id, tag) -- tags only have to be unique within a file
 );
 
 -- Create snapshot_layers table
@@ -21,22 +24,129 @@ CREATE TABLE IF NOT EXISTS snapshot_layers (
     active INTEGER DEFAULT 0,
     version_id INTEGER DEFAULT NULL REFERENCES versions(id),
     object_key VARCHAR(255) NOT NULL,
+    compacted_into BIGINT DEFAULT NULL REFERENCES snapshot_layers(id), -- set when the layer was folded into a newer layer by compaction
     CHECK ((active = 1 AND version_id IS NULL) OR (active = 0 AND version_id IS NOT NULL)), -- version_id is NULL for the active snapshot layer
     UNIQUE (file_id, version_id)
 );
 
+-- Create branches table, a branch is a file whose history continues the history
+-- of its parent file as of base_layer_id
+CREATE TABLE IF NOT EXISTS branches (
+    file_id BIGINT PRIMARY KEY REFERENCES files(id), -- file holding the layers written on the branch
+    name TEXT NOT NULL,
+    parent_file_id BIGINT NOT NULL REFERENCES files(id),
+    base_layer_id BIGINT NOT NULL REFERENCES snapshot_layers(id), -- newest layer of the parent visible on the branch
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (parent_file_id, name)
+);
+
+-- Create clones table, a clone is a file whose history starts with a copy of the
+-- history of its source file up to source_layer_id
+CREATE TABLE IF NOT EXISTS clones (
+    file_id BIGINT PRIMARY KEY REFERENCES files(id), -- the clone
+    source_file_id BIGINT NOT NULL, -- file the clone was copied from, which may have been deleted since
+    source_layer_id BIGINT NOT NULL, -- newest layer of the source copied into the clone, 0 if there was none
+    base_layer_id BIGINT NOT NULL, -- newest layer of the clone holding a copy, 0 if there is none
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create retention_policies table, a file without a row keeps all of its versions
+CREATE TABLE IF NOT EXISTS retention_policies (
+    file_id BIGINT PRIMARY KEY REFERENCES files(id),
+    keep_last INTEGER NOT NULL DEFAULT 0,
+    keep_within_seconds BIGINT NOT NULL DEFAULT 0,
+    keep_hourly INTEGER NOT NULL DEFAULT 0,
+    keep_daily INTEGER NOT NULL DEFAULT 0,
+    keep_weekly INTEGER NOT NULL DEFAULT 0
+);
+
 -- Create chunks table with proper index creation and range columns
 CREATE TABLE IF NOT EXISTS chunks (
     id BIGSERIAL PRIMARY KEY,
     snapshot_layer_id INTEGER REFERENCES snapshot_layers(id),
     layer_range INT8RANGE NOT NULL,
     file_range INT8RANGE NOT NULL,
+    object_key VARCHAR(255) NOT NULL DEFAULT '', -- object holding the bytes of the chunk, empty for the object of its layer
+    zero BOOLEAN NOT NULL DEFAULT false, -- whether the chunk is a hole, which reads as zeros and has no bytes
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     -- for any given snapshot_layer_id, there should be no overlapping layer_ranges
-    EXCLUDE USING GIST (snapshot_layer_id WITH =, layer_range WITH &&)
+    -- among the chunks stored in the object of the layer
+    CONSTRAINT chunks_layer_range_excl EXCLUDE USING GIST (snapshot_layer_id WITH =, layer_range WITH &&) WHERE (object_key = '')
 ); 
 
 CREATE INDEX IF NOT EXISTS idx_files_name ON files(name);
 CREATE INDEX IF NOT EXISTS idx_versions_tag ON versions(tag);
 CREATE INDEX IF NOT EXISTS idx_snapshot_layers_file_version ON snapshot_layers(file_id, version_id);
-CREATE INDEX IF NOT EXISTS idx_chunks_layer_range ON chunks USING GIST(snapshot_layer_id, file_range);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_snapshot_layers_file_created_at ON snapshot_layers(file_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_branches_parent_file ON branches(parent_file_id);
+CREATE INDEX IF NOT EXISTS idx_clones_source_file ON clones(source_file_id);
+CREATE INDEX IF NOT EXISTS idx_chunks_layer_range ON chunks USING GIST(snapshot_layer_id, file_range);
+
+-- Processes cache the metadata of files and check the generation of a file
+-- before trusting it, so it is bumped by the database itself whatever process
+-- changes the layers
+CREATE OR REPLACE FUNCTION bump_file_generation() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        UPDATE files SET generation = generation + 1 WHERE id = OLD.file_id;
+    ELSE
+        UPDATE files SET generation = generation + 1 WHERE id = NEW.file_id;
+    END IF;
+    -- A layer moved to another file, like by a promotion, changes both files
+    IF TG_OP = 'UPDATE' AND OLD.file_id <> NEW.file_id THEN
+        UPDATE files SET generation = generation + 1 WHERE id = OLD.file_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+BEGIN
+    CREATE TRIGGER snapshot_layers_bump_file_generation
+        AFTER INSERT OR UPDATE OR DELETE ON snapshot_layers
+        FOR EACH ROW EXECUTE FUNCTION bump_file_generation();
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Migrations of databases created by earlier versions of the schema above
+
+-- Layers folded into a newer layer by compaction
+ALTER TABLE snapshot_layers ADD COLUMN IF NOT EXISTS compacted_into BIGINT DEFAULT NULL REFERENCES snapshot_layers(id);
+
+-- Tags unique within a file rather than across all files. Versions belong to the
+-- file of their layer; a version without a layer can't be read and is dropped.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'versions' AND column_name = 'file_id') THEN
+        ALTER TABLE versions ADD COLUMN file_id BIGINT REFERENCES files(id);
+        UPDATE versions SET file_id = snapshot_layers.file_id FROM snapshot_layers WHERE snapshot_layers.version_id = versions.id;
+        DELETE FROM versions WHERE file_id IS NULL;
+        ALTER TABLE versions ALTER COLUMN file_id SET NOT NULL;
+        ALTER TABLE versions DROP CONSTRAINT IF EXISTS versions_tag_key;
+        ALTER TABLE versions ADD CONSTRAINT versions_file_id_tag_key UNIQUE (file_id, tag);
+    END IF;
+END $$;
+
+-- Generations of files, for the caches of their metadata
+ALTER TABLE files ADD COLUMN IF NOT EXISTS generation BIGINT NOT NULL DEFAULT 0;
+
+-- Chunks referencing the bytes of another object, for restored versions
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS object_key VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE chunks DROP CONSTRAINT IF EXISTS chunks_snapshot_layer_id_layer_range_excl;
+DO $$
+BEGIN
+    ALTER TABLE chunks ADD CONSTRAINT chunks_layer_range_excl EXCLUDE USING GIST (snapshot_layer_id WITH =, layer_range WITH &&) WHERE (object_key = '');
+EXCEPTION
+    WHEN duplicate_table OR duplicate_object THEN NULL;
+END $$;
+
+-- Holes as an explicit kind of chunk, rather than chunks with an empty layer
+-- range covering a non-empty file range
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'chunks' AND column_name = 'zero') THEN
+        ALTER TABLE chunks ADD COLUMN zero BOOLEAN NOT NULL DEFAULT false;
+        UPDATE chunks SET zero = true WHERE isempty(layer_range) AND NOT isempty(file_range);
+    END IF;
+END $$;
@@ -12,30 +12,125 @@ import (
 )
 
 const calcFileSize = `-- name: CalcFileSize :one
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = $1
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
 SELECT 
     UPPER(e.file_range)::BIGINT as file_size
 FROM 
     chunks e
 INNER JOIN 
     snapshot_layers l ON e.snapshot_layer_id = l.id
+INNER JOIN 
+    ancestry a ON l.file_id = a.file_id
 WHERE 
-    l.file_id = $1
+    (a.base_layer_id IS NULL OR l.id <= a.base_layer_id) AND
+    -- if versionedLayerID is 0, then we don't filter by layer ID
+    ($2 = 0 OR l.id <= $2)
 ORDER BY 
     UPPER(e.file_range) DESC
 LIMIT 1
 `
 
-func (q *Queries) CalcFileSize(ctx context.Context, fileID uint64) (int64, error) {
-	row := q.queryRow(ctx, q.calcFileSizeStmt, calcFileSize, fileID)
+type CalcFileSizeParams struct {
+	FileID           uint64      `json:"fileID"`
+	VersionedLayerID interface{} `json:"versionedLayerID"`
+}
+
+func (q *Queries) CalcFileSize(ctx context.Context, arg CalcFileSizeParams) (int64, error) {
+	row := q.queryRow(ctx, q.calcFileSizeStmt, calcFileSize, arg.FileID, arg.VersionedLayerID)
 	var file_size int64
 	err := row.Scan(&file_size)
 	return file_size, err
 }
 
+const copyLayerChunks = `-- name: CopyLayerChunks :exec
+INSERT INTO 
+    chunks (snapshot_layer_id, layer_range, file_range, object_key, zero)
+SELECT 
+    $1::BIGINT, layer_range, file_range, object_key, zero
+FROM 
+    chunks
+WHERE 
+    snapshot_layer_id = $2
+ORDER BY 
+    id ASC
+`
+
+type CopyLayerChunksParams struct {
+	DstLayerID int64  `json:"dstLayerID"`
+	SrcLayerID uint64 `json:"srcLayerID"`
+}
+
+func (q *Queries) CopyLayerChunks(ctx context.Context, arg CopyLayerChunksParams) error {
+	_, err := q.exec(ctx, q.copyLayerChunksStmt, copyLayerChunks, arg.DstLayerID, arg.SrcLayerID)
+	return err
+}
+
+const deleteChunksOfFile = `-- name: DeleteChunksOfFile :exec
+DELETE FROM 
+    chunks
+WHERE 
+    snapshot_layer_id IN (
+        SELECT 
+            id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = $1
+    )
+`
+
+func (q *Queries) DeleteChunksOfFile(ctx context.Context, fileID uint64) error {
+	_, err := q.exec(ctx, q.deleteChunksOfFileStmt, deleteChunksOfFile, fileID)
+	return err
+}
+
+const deleteChunksOfLayers = `-- name: DeleteChunksOfLayers :exec
+DELETE FROM 
+    chunks
+WHERE 
+    snapshot_layer_id IN (
+        SELECT 
+            id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = $1 AND id >= $2::BIGINT AND id <= $3::BIGINT
+    )
+`
+
+type DeleteChunksOfLayersParams struct {
+	FileID      uint64 `json:"fileID"`
+	FromLayerID int64  `json:"fromLayerID"`
+	ToLayerID   int64  `json:"toLayerID"`
+}
+
+func (q *Queries) DeleteChunksOfLayers(ctx context.Context, arg DeleteChunksOfLayersParams) error {
+	_, err := q.exec(ctx, q.deleteChunksOfLayersStmt, deleteChunksOfLayers, arg.FileID, arg.FromLayerID, arg.ToLayerID)
+	return err
+}
+
 const getLayerChunks = `-- name: GetLayerChunks :many
 SELECT 
     layer_range, 
-    file_range
+    file_range,
+    object_key,
+    zero
 FROM 
     chunks
 WHERE 
@@ -47,6 +142,8 @@ ORDER BY
 type GetLayerChunksRow struct {
 	LayerRange types.Range `json:"layerRange"`
 	FileRange  types.Range `json:"fileRange"`
+	ObjectKey  string      `json:"objectKey"`
+	Zero       bool        `json:"zero"`
 }
 
 func (q *Queries) GetLayerChunks(ctx context.Context, snapshotLayerID uint64) ([]GetLayerChunksRow, error) {
@@ -58,7 +155,12 @@ func (q *Queries) GetLayerChunks(ctx context.Context, snapshotLayerID uint64) ([
 	items := []GetLayerChunksRow{}
 	for rows.Next() {
 		var i GetLayerChunksRow
-		if err := rows.Scan(&i.LayerRange, &i.FileRange); err != nil {
+		if err := rows.Scan(
+			&i.LayerRange,
+			&i.FileRange,
+			&i.ObjectKey,
+			&i.Zero,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -73,25 +175,48 @@ func (q *Queries) GetLayerChunks(ctx context.Context, snapshotLayerID uint64) ([
 }
 
 const getOverlappingChunksWithVersion = `-- name: GetOverlappingChunksWithVersion :many
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = $1
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
 SELECT 
     c.snapshot_layer_id, 
     c.layer_range, 
-    c.file_range
+    c.file_range,
+    c.object_key,
+    c.zero,
+    l.object_key AS layer_object_key
 FROM 
     chunks c
 INNER JOIN 
     snapshot_layers l ON c.snapshot_layer_id = l.id
+INNER JOIN 
+    ancestry a ON l.file_id = a.file_id
 WHERE
+    (a.base_layer_id IS NULL OR l.id <= a.base_layer_id) AND
     -- if versionedLayerID is 0, then we don't filter by layer ID
-    ($1 = 0 OR l.id <= $1) AND
-    l.file_id = $2 AND c.file_range && $3::INT8RANGE
+    ($2 = 0 OR l.id <= $2) AND
+    c.file_range && $3::INT8RANGE
 ORDER BY 
     l.id ASC, c.id ASC
 `
 
 type GetOverlappingChunksWithVersionParams struct {
-	VersionedLayerID interface{} `json:"versionedLayerID"`
 	FileID           uint64      `json:"fileID"`
+	VersionedLayerID interface{} `json:"versionedLayerID"`
 	Range            types.Range `json:"range"`
 }
 
@@ -99,10 +224,13 @@ type GetOverlappingChunksWithVersionRow struct {
 	SnapshotLayerID uint64      `json:"snapshotLayerId"`
 	LayerRange      types.Range `json:"layerRange"`
 	FileRange       types.Range `json:"fileRange"`
+	ObjectKey       string      `json:"objectKey"`
+	Zero            bool        `json:"zero"`
+	LayerObjectKey  string      `json:"layerObjectKey"`
 }
 
 func (q *Queries) GetOverlappingChunksWithVersion(ctx context.Context, arg GetOverlappingChunksWithVersionParams) ([]GetOverlappingChunksWithVersionRow, error) {
-	rows, err := q.query(ctx, q.getOverlappingChunksWithVersionStmt, getOverlappingChunksWithVersion, arg.VersionedLayerID, arg.FileID, arg.Range)
+	rows, err := q.query(ctx, q.getOverlappingChunksWithVersionStmt, getOverlappingChunksWithVersion, arg.FileID, arg.VersionedLayerID, arg.Range)
 	if err != nil {
 		return nil, err
 	}
@@ -110,7 +238,14 @@ func (q *Queries) GetOverlappingChunksWithVersion(ctx context.Context, arg GetOv
 	items := []GetOverlappingChunksWithVersionRow{}
 	for rows.Next() {
 		var i GetOverlappingChunksWithVersionRow
-		if err := rows.Scan(&i.SnapshotLayerID, &i.LayerRange, &i.FileRange); err != nil {
+		if err := rows.Scan(
+			&i.SnapshotLayerID,
+			&i.LayerRange,
+			&i.FileRange,
+			&i.ObjectKey,
+			&i.Zero,
+			&i.LayerObjectKey,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -126,18 +261,20 @@ func (q *Queries) GetOverlappingChunksWithVersion(ctx context.Context, arg GetOv
 
 const insertChunk = `-- name: InsertChunk :exec
 INSERT INTO 
-    chunks (snapshot_layer_id, layer_range, file_range) 
+    chunks (snapshot_layer_id, layer_range, file_range, object_key, zero) 
 VALUES 
-    ($1, $2, $3)
+    ($1, $2, $3, $4, $5)
 `
 
 type InsertChunkParams struct {
 	SnapshotLayerID uint64      `json:"snapshotLayerId"`
 	LayerRange      types.Range `json:"layerRange"`
 	FileRange       types.Range `json:"fileRange"`
+	ObjectKey       string      `json:"objectKey"`
+	Zero            bool        `json:"zero"`
 }
 
 func (q *Queries) InsertChunk(ctx context.Context, arg InsertChunkParams) error {
-	_, err := q.exec(ctx, q.insertChunkStmt, insertChunk, arg.SnapshotLayerID, arg.LayerRange, arg.FileRange)
+	_, err := q.exec(ctx, q.insertChunkStmt, insertChunk, arg.SnapshotLayerID, arg.LayerRange, arg.FileRange, arg.ObjectKey, arg.Zero)
 	return err
 }
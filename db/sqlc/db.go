@@ -27,12 +27,69 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.calcFileSizeStmt, err = db.PrepareContext(ctx, calcFileSize); err != nil {
 		return nil, fmt.Errorf("error preparing query CalcFileSize: %w", err)
 	}
+	if q.copyLayerChunksStmt, err = db.PrepareContext(ctx, copyLayerChunks); err != nil {
+		return nil, fmt.Errorf("error preparing query CopyLayerChunks: %w", err)
+	}
+	if q.deleteBranchStmt, err = db.PrepareContext(ctx, deleteBranch); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteBranch: %w", err)
+	}
+	if q.deleteChunksOfFileStmt, err = db.PrepareContext(ctx, deleteChunksOfFile); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteChunksOfFile: %w", err)
+	}
+	if q.deleteChunksOfLayersStmt, err = db.PrepareContext(ctx, deleteChunksOfLayers); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteChunksOfLayers: %w", err)
+	}
+	if q.deleteCloneStmt, err = db.PrepareContext(ctx, deleteClone); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteClone: %w", err)
+	}
+	if q.deleteFileStmt, err = db.PrepareContext(ctx, deleteFile); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteFile: %w", err)
+	}
+	if q.deleteLayerStmt, err = db.PrepareContext(ctx, deleteLayer); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteLayer: %w", err)
+	}
+	if q.deleteLayersOfFileStmt, err = db.PrepareContext(ctx, deleteLayersOfFile); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteLayersOfFile: %w", err)
+	}
+	if q.deleteRetentionPolicyStmt, err = db.PrepareContext(ctx, deleteRetentionPolicy); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteRetentionPolicy: %w", err)
+	}
+	if q.deleteVersionStmt, err = db.PrepareContext(ctx, deleteVersion); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteVersion: %w", err)
+	}
+	if q.deleteVersionsOfFileStmt, err = db.PrepareContext(ctx, deleteVersionsOfFile); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteVersionsOfFile: %w", err)
+	}
+	if q.fileExistsStmt, err = db.PrepareContext(ctx, fileExists); err != nil {
+		return nil, fmt.Errorf("error preparing query FileExists: %w", err)
+	}
 	if q.getAllFilesStmt, err = db.PrepareContext(ctx, getAllFiles); err != nil {
 		return nil, fmt.Errorf("error preparing query GetAllFiles: %w", err)
 	}
+	if q.getBranchByFileIDStmt, err = db.PrepareContext(ctx, getBranchByFileID); err != nil {
+		return nil, fmt.Errorf("error preparing query GetBranchByFileID: %w", err)
+	}
+	if q.getBranchPointsStmt, err = db.PrepareContext(ctx, getBranchPoints); err != nil {
+		return nil, fmt.Errorf("error preparing query GetBranchPoints: %w", err)
+	}
+	if q.getBranchesByParentStmt, err = db.PrepareContext(ctx, getBranchesByParent); err != nil {
+		return nil, fmt.Errorf("error preparing query GetBranchesByParent: %w", err)
+	}
+	if q.getFileGenerationStmt, err = db.PrepareContext(ctx, getFileGeneration); err != nil {
+		return nil, fmt.Errorf("error preparing query GetFileGeneration: %w", err)
+	}
+	if q.getCloneByFileIDStmt, err = db.PrepareContext(ctx, getCloneByFileID); err != nil {
+		return nil, fmt.Errorf("error preparing query GetCloneByFileID: %w", err)
+	}
+	if q.getClonePointsStmt, err = db.PrepareContext(ctx, getClonePoints); err != nil {
+		return nil, fmt.Errorf("error preparing query GetClonePoints: %w", err)
+	}
 	if q.getFileIDByNameStmt, err = db.PrepareContext(ctx, getFileIDByName); err != nil {
 		return nil, fmt.Errorf("error preparing query GetFileIDByName: %w", err)
 	}
+	if q.getLayerByTimestampStmt, err = db.PrepareContext(ctx, getLayerByTimestamp); err != nil {
+		return nil, fmt.Errorf("error preparing query GetLayerByTimestamp: %w", err)
+	}
 	if q.getLayerByVersionStmt, err = db.PrepareContext(ctx, getLayerByVersion); err != nil {
 		return nil, fmt.Errorf("error preparing query GetLayerByVersion: %w", err)
 	}
@@ -42,15 +99,30 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.getLayersByFileIDStmt, err = db.PrepareContext(ctx, getLayersByFileID); err != nil {
 		return nil, fmt.Errorf("error preparing query GetLayersByFileID: %w", err)
 	}
+	if q.getLayersWithAncestryStmt, err = db.PrepareContext(ctx, getLayersWithAncestry); err != nil {
+		return nil, fmt.Errorf("error preparing query GetLayersWithAncestry: %w", err)
+	}
 	if q.getObjectKeyStmt, err = db.PrepareContext(ctx, getObjectKey); err != nil {
 		return nil, fmt.Errorf("error preparing query GetObjectKey: %w", err)
 	}
 	if q.getOverlappingChunksWithVersionStmt, err = db.PrepareContext(ctx, getOverlappingChunksWithVersion); err != nil {
 		return nil, fmt.Errorf("error preparing query GetOverlappingChunksWithVersion: %w", err)
 	}
+	if q.getReferencedObjectKeysStmt, err = db.PrepareContext(ctx, getReferencedObjectKeys); err != nil {
+		return nil, fmt.Errorf("error preparing query GetReferencedObjectKeys: %w", err)
+	}
+	if q.getRetentionPolicyStmt, err = db.PrepareContext(ctx, getRetentionPolicy); err != nil {
+		return nil, fmt.Errorf("error preparing query GetRetentionPolicy: %w", err)
+	}
+	if q.insertBranchStmt, err = db.PrepareContext(ctx, insertBranch); err != nil {
+		return nil, fmt.Errorf("error preparing query InsertBranch: %w", err)
+	}
 	if q.insertChunkStmt, err = db.PrepareContext(ctx, insertChunk); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertChunk: %w", err)
 	}
+	if q.insertCloneStmt, err = db.PrepareContext(ctx, insertClone); err != nil {
+		return nil, fmt.Errorf("error preparing query InsertClone: %w", err)
+	}
 	if q.insertFileStmt, err = db.PrepareContext(ctx, insertFile); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertFile: %w", err)
 	}
@@ -60,6 +132,27 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.insertVersionStmt, err = db.PrepareContext(ctx, insertVersion); err != nil {
 		return nil, fmt.Errorf("error preparing query InsertVersion: %w", err)
 	}
+	if q.lockFileStmt, err = db.PrepareContext(ctx, lockFile); err != nil {
+		return nil, fmt.Errorf("error preparing query LockFile: %w", err)
+	}
+	if q.markLayersCompactedStmt, err = db.PrepareContext(ctx, markLayersCompacted); err != nil {
+		return nil, fmt.Errorf("error preparing query MarkLayersCompacted: %w", err)
+	}
+	if q.moveLayersStmt, err = db.PrepareContext(ctx, moveLayers); err != nil {
+		return nil, fmt.Errorf("error preparing query MoveLayers: %w", err)
+	}
+	if q.moveVersionsOfLayersStmt, err = db.PrepareContext(ctx, moveVersionsOfLayers); err != nil {
+		return nil, fmt.Errorf("error preparing query MoveVersionsOfLayers: %w", err)
+	}
+	if q.updateLayerObjectKeyStmt, err = db.PrepareContext(ctx, updateLayerObjectKey); err != nil {
+		return nil, fmt.Errorf("error preparing query UpdateLayerObjectKey: %w", err)
+	}
+	if q.updateVersionTagStmt, err = db.PrepareContext(ctx, updateVersionTag); err != nil {
+		return nil, fmt.Errorf("error preparing query UpdateVersionTag: %w", err)
+	}
+	if q.upsertRetentionPolicyStmt, err = db.PrepareContext(ctx, upsertRetentionPolicy); err != nil {
+		return nil, fmt.Errorf("error preparing query UpsertRetentionPolicy: %w", err)
+	}
 	return &q, nil
 }
 
@@ -70,16 +163,111 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing calcFileSizeStmt: %w", cerr)
 		}
 	}
+	if q.copyLayerChunksStmt != nil {
+		if cerr := q.copyLayerChunksStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing copyLayerChunksStmt: %w", cerr)
+		}
+	}
+	if q.deleteBranchStmt != nil {
+		if cerr := q.deleteBranchStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteBranchStmt: %w", cerr)
+		}
+	}
+	if q.deleteChunksOfFileStmt != nil {
+		if cerr := q.deleteChunksOfFileStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteChunksOfFileStmt: %w", cerr)
+		}
+	}
+	if q.deleteChunksOfLayersStmt != nil {
+		if cerr := q.deleteChunksOfLayersStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteChunksOfLayersStmt: %w", cerr)
+		}
+	}
+	if q.deleteCloneStmt != nil {
+		if cerr := q.deleteCloneStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteCloneStmt: %w", cerr)
+		}
+	}
+	if q.deleteFileStmt != nil {
+		if cerr := q.deleteFileStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteFileStmt: %w", cerr)
+		}
+	}
+	if q.deleteLayerStmt != nil {
+		if cerr := q.deleteLayerStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteLayerStmt: %w", cerr)
+		}
+	}
+	if q.deleteLayersOfFileStmt != nil {
+		if cerr := q.deleteLayersOfFileStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteLayersOfFileStmt: %w", cerr)
+		}
+	}
+	if q.deleteRetentionPolicyStmt != nil {
+		if cerr := q.deleteRetentionPolicyStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteRetentionPolicyStmt: %w", cerr)
+		}
+	}
+	if q.deleteVersionStmt != nil {
+		if cerr := q.deleteVersionStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteVersionStmt: %w", cerr)
+		}
+	}
+	if q.deleteVersionsOfFileStmt != nil {
+		if cerr := q.deleteVersionsOfFileStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteVersionsOfFileStmt: %w", cerr)
+		}
+	}
+	if q.fileExistsStmt != nil {
+		if cerr := q.fileExistsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing fileExistsStmt: %w", cerr)
+		}
+	}
 	if q.getAllFilesStmt != nil {
 		if cerr := q.getAllFilesStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getAllFilesStmt: %w", cerr)
 		}
 	}
+	if q.getBranchByFileIDStmt != nil {
+		if cerr := q.getBranchByFileIDStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getBranchByFileIDStmt: %w", cerr)
+		}
+	}
+	if q.getBranchPointsStmt != nil {
+		if cerr := q.getBranchPointsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getBranchPointsStmt: %w", cerr)
+		}
+	}
+	if q.getBranchesByParentStmt != nil {
+		if cerr := q.getBranchesByParentStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getBranchesByParentStmt: %w", cerr)
+		}
+	}
+	if q.getFileGenerationStmt != nil {
+		if cerr := q.getFileGenerationStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getFileGenerationStmt: %w", cerr)
+		}
+	}
+	if q.getCloneByFileIDStmt != nil {
+		if cerr := q.getCloneByFileIDStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getCloneByFileIDStmt: %w", cerr)
+		}
+	}
+	if q.getClonePointsStmt != nil {
+		if cerr := q.getClonePointsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getClonePointsStmt: %w", cerr)
+		}
+	}
 	if q.getFileIDByNameStmt != nil {
 		if cerr := q.getFileIDByNameStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getFileIDByNameStmt: %w", cerr)
 		}
 	}
+	if q.getLayerByTimestampStmt != nil {
+		if cerr := q.getLayerByTimestampStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getLayerByTimestampStmt: %w", cerr)
+		}
+	}
 	if q.getLayerByVersionStmt != nil {
 		if cerr := q.getLayerByVersionStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getLayerByVersionStmt: %w", cerr)
@@ -95,6 +283,11 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing getLayersByFileIDStmt: %w", cerr)
 		}
 	}
+	if q.getLayersWithAncestryStmt != nil {
+		if cerr := q.getLayersWithAncestryStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getLayersWithAncestryStmt: %w", cerr)
+		}
+	}
 	if q.getObjectKeyStmt != nil {
 		if cerr := q.getObjectKeyStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getObjectKeyStmt: %w", cerr)
@@ -105,11 +298,31 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing getOverlappingChunksWithVersionStmt: %w", cerr)
 		}
 	}
+	if q.getReferencedObjectKeysStmt != nil {
+		if cerr := q.getReferencedObjectKeysStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getReferencedObjectKeysStmt: %w", cerr)
+		}
+	}
+	if q.getRetentionPolicyStmt != nil {
+		if cerr := q.getRetentionPolicyStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getRetentionPolicyStmt: %w", cerr)
+		}
+	}
+	if q.insertBranchStmt != nil {
+		if cerr := q.insertBranchStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing insertBranchStmt: %w", cerr)
+		}
+	}
 	if q.insertChunkStmt != nil {
 		if cerr := q.insertChunkStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing insertChunkStmt: %w", cerr)
 		}
 	}
+	if q.insertCloneStmt != nil {
+		if cerr := q.insertCloneStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing insertCloneStmt: %w", cerr)
+		}
+	}
 	if q.insertFileStmt != nil {
 		if cerr := q.insertFileStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing insertFileStmt: %w", cerr)
@@ -125,6 +338,41 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing insertVersionStmt: %w", cerr)
 		}
 	}
+	if q.lockFileStmt != nil {
+		if cerr := q.lockFileStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing lockFileStmt: %w", cerr)
+		}
+	}
+	if q.markLayersCompactedStmt != nil {
+		if cerr := q.markLayersCompactedStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing markLayersCompactedStmt: %w", cerr)
+		}
+	}
+	if q.moveLayersStmt != nil {
+		if cerr := q.moveLayersStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing moveLayersStmt: %w", cerr)
+		}
+	}
+	if q.moveVersionsOfLayersStmt != nil {
+		if cerr := q.moveVersionsOfLayersStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing moveVersionsOfLayersStmt: %w", cerr)
+		}
+	}
+	if q.updateLayerObjectKeyStmt != nil {
+		if cerr := q.updateLayerObjectKeyStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing updateLayerObjectKeyStmt: %w", cerr)
+		}
+	}
+	if q.updateVersionTagStmt != nil {
+		if cerr := q.updateVersionTagStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing updateVersionTagStmt: %w", cerr)
+		}
+	}
+	if q.upsertRetentionPolicyStmt != nil {
+		if cerr := q.upsertRetentionPolicyStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing upsertRetentionPolicyStmt: %w", cerr)
+		}
+	}
 	return err
 }
 
@@ -165,17 +413,48 @@ type Queries struct {
 	db                                  DBTX
 	tx                                  *sql.Tx
 	calcFileSizeStmt                    *sql.Stmt
+	copyLayerChunksStmt                 *sql.Stmt
+	deleteBranchStmt                    *sql.Stmt
+	deleteChunksOfFileStmt              *sql.Stmt
+	deleteChunksOfLayersStmt            *sql.Stmt
+	deleteCloneStmt                     *sql.Stmt
+	deleteFileStmt                      *sql.Stmt
+	deleteLayerStmt                     *sql.Stmt
+	deleteLayersOfFileStmt              *sql.Stmt
+	deleteRetentionPolicyStmt           *sql.Stmt
+	deleteVersionStmt                   *sql.Stmt
+	deleteVersionsOfFileStmt            *sql.Stmt
+	fileExistsStmt                      *sql.Stmt
 	getAllFilesStmt                     *sql.Stmt
+	getBranchByFileIDStmt               *sql.Stmt
+	getBranchPointsStmt                 *sql.Stmt
+	getBranchesByParentStmt             *sql.Stmt
+	getFileGenerationStmt               *sql.Stmt
+	getCloneByFileIDStmt                *sql.Stmt
+	getClonePointsStmt                  *sql.Stmt
 	getFileIDByNameStmt                 *sql.Stmt
+	getLayerByTimestampStmt             *sql.Stmt
 	getLayerByVersionStmt               *sql.Stmt
 	getLayerChunksStmt                  *sql.Stmt
 	getLayersByFileIDStmt               *sql.Stmt
+	getLayersWithAncestryStmt           *sql.Stmt
 	getObjectKeyStmt                    *sql.Stmt
 	getOverlappingChunksWithVersionStmt *sql.Stmt
+	getReferencedObjectKeysStmt         *sql.Stmt
+	getRetentionPolicyStmt              *sql.Stmt
+	insertBranchStmt                    *sql.Stmt
 	insertChunkStmt                     *sql.Stmt
+	insertCloneStmt                     *sql.Stmt
 	insertFileStmt                      *sql.Stmt
 	insertLayerStmt                     *sql.Stmt
 	insertVersionStmt                   *sql.Stmt
+	lockFileStmt                        *sql.Stmt
+	markLayersCompactedStmt             *sql.Stmt
+	moveLayersStmt                      *sql.Stmt
+	moveVersionsOfLayersStmt            *sql.Stmt
+	updateLayerObjectKeyStmt            *sql.Stmt
+	updateVersionTagStmt                *sql.Stmt
+	upsertRetentionPolicyStmt           *sql.Stmt
 }
 
 func (q *Queries) WithTx(tx *sql.Tx) *Queries {
@@ -183,16 +462,47 @@ func (q *Queries) WithTx(tx *sql.Tx) *Queries {
 		db:                                  tx,
 		tx:                                  tx,
 		calcFileSizeStmt:                    q.calcFileSizeStmt,
+		copyLayerChunksStmt:                 q.copyLayerChunksStmt,
+		deleteBranchStmt:                    q.deleteBranchStmt,
+		deleteChunksOfFileStmt:              q.deleteChunksOfFileStmt,
+		deleteChunksOfLayersStmt:            q.deleteChunksOfLayersStmt,
+		deleteCloneStmt:                     q.deleteCloneStmt,
+		deleteFileStmt:                      q.deleteFileStmt,
+		deleteLayerStmt:                     q.deleteLayerStmt,
+		deleteLayersOfFileStmt:              q.deleteLayersOfFileStmt,
+		deleteRetentionPolicyStmt:           q.deleteRetentionPolicyStmt,
+		deleteVersionStmt:                   q.deleteVersionStmt,
+		deleteVersionsOfFileStmt:            q.deleteVersionsOfFileStmt,
+		fileExistsStmt:                      q.fileExistsStmt,
 		getAllFilesStmt:                     q.getAllFilesStmt,
+		getBranchByFileIDStmt:               q.getBranchByFileIDStmt,
+		getBranchPointsStmt:                 q.getBranchPointsStmt,
+		getBranchesByParentStmt:             q.getBranchesByParentStmt,
+		getFileGenerationStmt:               q.getFileGenerationStmt,
+		getCloneByFileIDStmt:                q.getCloneByFileIDStmt,
+		getClonePointsStmt:                  q.getClonePointsStmt,
 		getFileIDByNameStmt:                 q.getFileIDByNameStmt,
+		getLayerByTimestampStmt:             q.getLayerByTimestampStmt,
 		getLayerByVersionStmt:               q.getLayerByVersionStmt,
 		getLayerChunksStmt:                  q.getLayerChunksStmt,
 		getLayersByFileIDStmt:               q.getLayersByFileIDStmt,
+		getLayersWithAncestryStmt:           q.getLayersWithAncestryStmt,
 		getObjectKeyStmt:                    q.getObjectKeyStmt,
 		getOverlappingChunksWithVersionStmt: q.getOverlappingChunksWithVersionStmt,
+		getReferencedObjectKeysStmt:         q.getReferencedObjectKeysStmt,
+		getRetentionPolicyStmt:              q.getRetentionPolicyStmt,
+		insertBranchStmt:                    q.insertBranchStmt,
 		insertChunkStmt:                     q.insertChunkStmt,
+		insertCloneStmt:                     q.insertCloneStmt,
 		insertFileStmt:                      q.insertFileStmt,
 		insertLayerStmt:                     q.insertLayerStmt,
 		insertVersionStmt:                   q.insertVersionStmt,
+		lockFileStmt:                        q.lockFileStmt,
+		markLayersCompactedStmt:             q.markLayersCompactedStmt,
+		moveLayersStmt:                      q.moveLayersStmt,
+		moveVersionsOfLayersStmt:            q.moveVersionsOfLayersStmt,
+		updateLayerObjectKeyStmt:            q.updateLayerObjectKeyStmt,
+		updateVersionTagStmt:                q.updateVersionTagStmt,
+		upsertRetentionPolicyStmt:           q.upsertRetentionPolicyStmt,
 	}
 }
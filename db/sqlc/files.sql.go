@@ -9,8 +9,28 @@ import (
 	"context"
 )
 
+const deleteFile = `-- name: DeleteFile :exec
+DELETE FROM files WHERE id = $1
+`
+
+func (q *Queries) DeleteFile(ctx context.Context, id uint64) error {
+	_, err := q.exec(ctx, q.deleteFileStmt, deleteFile, id)
+	return err
+}
+
+const fileExists = `-- name: FileExists :one
+SELECT EXISTS (SELECT 1 FROM files WHERE id = $1)
+`
+
+func (q *Queries) FileExists(ctx context.Context, id uint64) (bool, error) {
+	row := q.queryRow(ctx, q.fileExistsStmt, fileExists, id)
+	var exists bool
+	err := row.Scan(&exists)
+	return exists, err
+}
+
 const getAllFiles = `-- name: GetAllFiles :many
-SELECT id, name FROM files
+SELECT id, name, generation FROM files
 `
 
 func (q *Queries) GetAllFiles(ctx context.Context) ([]File, error) {
@@ -22,7 +42,7 @@ func (q *Queries) GetAllFiles(ctx context.Context) ([]File, error) {
 	items := []File{}
 	for rows.Next() {
 		var i File
-		if err := rows.Scan(&i.ID, &i.Name); err != nil {
+		if err := rows.Scan(&i.ID, &i.Name, &i.Generation); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -36,6 +56,39 @@ func (q *Queries) GetAllFiles(ctx context.Context) ([]File, error) {
 	return items, nil
 }
 
+const getFileGeneration = `-- name: GetFileGeneration :one
+WITH RECURSIVE ancestry (file_id) AS (
+    SELECT 
+        files.id
+    FROM 
+        files
+    WHERE 
+        files.id = $1
+    UNION ALL
+    SELECT 
+        branches.parent_file_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
+SELECT 
+    COALESCE(SUM(files.generation), -1)::BIGINT AS generation
+FROM 
+    files
+INNER JOIN 
+    ancestry a ON files.id = a.file_id
+`
+
+// The generation of a branch includes those of the files it was branched from,
+// whose layers it reads too. It is -1 for a file that doesn't exist.
+func (q *Queries) GetFileGeneration(ctx context.Context, fileID uint64) (int64, error) {
+	row := q.queryRow(ctx, q.getFileGenerationStmt, getFileGeneration, fileID)
+	var generation int64
+	err := row.Scan(&generation)
+	return generation, err
+}
+
 const getFileIDByName = `-- name: GetFileIDByName :one
 SELECT id FROM files WHERE name = $1
 `
@@ -57,3 +110,14 @@ func (q *Queries) InsertFile(ctx context.Context, name string) (uint64, error) {
 	err := row.Scan(&id)
 	return id, err
 }
+
+const lockFile = `-- name: LockFile :exec
+SELECT id FROM files WHERE id = $1 FOR UPDATE
+`
+
+// Every change to the layers of a file updates its row, so locking the row
+// keeps them from changing until the end of the transaction.
+func (q *Queries) LockFile(ctx context.Context, id uint64) error {
+	_, err := q.exec(ctx, q.lockFileStmt, lockFile, id)
+	return err
+}
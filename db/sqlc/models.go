@@ -10,30 +10,60 @@ import (
 	"github.com/vinimdocarmo/quackfs/db/types"
 )
 
+type Branch struct {
+	FileID       uint64       `json:"fileId"`
+	Name         string       `json:"name"`
+	ParentFileID uint64       `json:"parentFileId"`
+	BaseLayerID  uint64       `json:"baseLayerId"`
+	CreatedAt    sql.NullTime `json:"createdAt"`
+}
+
 type Chunk struct {
 	ID              int64        `json:"id"`
 	SnapshotLayerID uint64       `json:"snapshotLayerId"`
 	LayerRange      types.Range  `json:"layerRange"`
 	FileRange       types.Range  `json:"fileRange"`
+	ObjectKey       string       `json:"objectKey"`
+	Zero            bool         `json:"zero"`
 	CreatedAt       sql.NullTime `json:"createdAt"`
 }
 
+type Clone struct {
+	FileID        uint64       `json:"fileId"`
+	SourceFileID  uint64       `json:"sourceFileId"`
+	SourceLayerID uint64       `json:"sourceLayerId"`
+	BaseLayerID   uint64       `json:"baseLayerId"`
+	CreatedAt     sql.NullTime `json:"createdAt"`
+}
+
 type File struct {
-	ID   uint64 `json:"id"`
-	Name string `json:"name"`
+	ID         uint64 `json:"id"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+}
+
+type RetentionPolicy struct {
+	FileID            uint64 `json:"fileId"`
+	KeepLast          int32  `json:"keepLast"`
+	KeepWithinSeconds int64  `json:"keepWithinSeconds"`
+	KeepHourly        int32  `json:"keepHourly"`
+	KeepDaily         int32  `json:"keepDaily"`
+	KeepWeekly        int32  `json:"keepWeekly"`
 }
 
 type SnapshotLayer struct {
-	ID        uint64        `json:"id"`
-	FileID    uint64        `json:"fileId"`
-	CreatedAt sql.NullTime  `json:"createdAt"`
-	Active    sql.NullInt32 `json:"active"`
-	VersionID sql.NullInt64 `json:"versionId"`
-	ObjectKey string        `json:"objectKey"`
+	ID            uint64        `json:"id"`
+	FileID        uint64        `json:"fileId"`
+	CreatedAt     sql.NullTime  `json:"createdAt"`
+	Active        sql.NullInt32 `json:"active"`
+	VersionID     sql.NullInt64 `json:"versionId"`
+	ObjectKey     string        `json:"objectKey"`
+	CompactedInto sql.NullInt64 `json:"compactedInto"`
 }
 
 type Version struct {
 	ID        uint64       `json:"id"`
+	FileID    uint64       `json:"fileId"`
 	Tag       string       `json:"tag"`
 	CreatedAt sql.NullTime `json:"createdAt"`
 }
@@ -9,18 +9,53 @@ import (
 )
 
 type Querier interface {
-	CalcFileSize(ctx context.Context, fileID uint64) (int64, error)
+	CalcFileSize(ctx context.Context, arg CalcFileSizeParams) (int64, error)
+	CopyLayerChunks(ctx context.Context, arg CopyLayerChunksParams) error
+	DeleteBranch(ctx context.Context, fileID uint64) error
+	DeleteChunksOfFile(ctx context.Context, fileID uint64) error
+	DeleteChunksOfLayers(ctx context.Context, arg DeleteChunksOfLayersParams) error
+	DeleteClone(ctx context.Context, fileID uint64) error
+	DeleteFile(ctx context.Context, id uint64) error
+	DeleteLayer(ctx context.Context, id uint64) error
+	DeleteLayersOfFile(ctx context.Context, fileID uint64) error
+	DeleteRetentionPolicy(ctx context.Context, fileID uint64) error
+	DeleteVersion(ctx context.Context, id uint64) error
+	DeleteVersionsOfFile(ctx context.Context, fileID uint64) error
+	FileExists(ctx context.Context, id uint64) (bool, error)
 	GetAllFiles(ctx context.Context) ([]File, error)
+	GetBranchByFileID(ctx context.Context, fileID uint64) (Branch, error)
+	GetBranchPoints(ctx context.Context, parentFileID uint64) ([]uint64, error)
+	GetBranchesByParent(ctx context.Context, parentFileID uint64) ([]GetBranchesByParentRow, error)
+	GetCloneByFileID(ctx context.Context, fileID uint64) (Clone, error)
+	GetClonePoints(ctx context.Context, sourceFileID uint64) ([]uint64, error)
+	// The generation of a branch includes those of the files it was branched from,
+	// whose layers it reads too. It is -1 for a file that doesn't exist.
+	GetFileGeneration(ctx context.Context, fileID uint64) (int64, error)
 	GetFileIDByName(ctx context.Context, name string) (uint64, error)
+	GetLayerByTimestamp(ctx context.Context, arg GetLayerByTimestampParams) (GetLayerByTimestampRow, error)
 	GetLayerByVersion(ctx context.Context, arg GetLayerByVersionParams) (GetLayerByVersionRow, error)
 	GetLayerChunks(ctx context.Context, snapshotLayerID uint64) ([]GetLayerChunksRow, error)
 	GetLayersByFileID(ctx context.Context, fileID uint64) ([]GetLayersByFileIDRow, error)
+	GetLayersWithAncestry(ctx context.Context, fileID uint64) ([]GetLayersWithAncestryRow, error)
 	GetObjectKey(ctx context.Context, id uint64) (string, error)
 	GetOverlappingChunksWithVersion(ctx context.Context, arg GetOverlappingChunksWithVersionParams) ([]GetOverlappingChunksWithVersionRow, error)
+	GetReferencedObjectKeys(ctx context.Context) ([]string, error)
+	GetRetentionPolicy(ctx context.Context, fileID uint64) (RetentionPolicy, error)
+	InsertBranch(ctx context.Context, arg InsertBranchParams) error
 	InsertChunk(ctx context.Context, arg InsertChunkParams) error
+	InsertClone(ctx context.Context, arg InsertCloneParams) error
 	InsertFile(ctx context.Context, name string) (uint64, error)
 	InsertLayer(ctx context.Context, arg InsertLayerParams) (uint64, error)
-	InsertVersion(ctx context.Context, tag string) (uint64, error)
+	InsertVersion(ctx context.Context, arg InsertVersionParams) (uint64, error)
+	// Every change to the layers of a file updates its row, so locking the row
+	// keeps them from changing until the end of the transaction.
+	LockFile(ctx context.Context, id uint64) error
+	MarkLayersCompacted(ctx context.Context, arg MarkLayersCompactedParams) error
+	MoveLayers(ctx context.Context, arg MoveLayersParams) error
+	MoveVersionsOfLayers(ctx context.Context, arg MoveVersionsOfLayersParams) error
+	UpdateLayerObjectKey(ctx context.Context, arg UpdateLayerObjectKeyParams) error
+	UpdateVersionTag(ctx context.Context, arg UpdateVersionTagParams) error
+	UpsertRetentionPolicy(ctx context.Context, arg UpsertRetentionPolicyParams) error
 }
 
 var _ Querier = (*Queries)(nil)
@@ -8,15 +8,88 @@ package sqlc
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
+const deleteLayer = `-- name: DeleteLayer :exec
+DELETE FROM 
+    snapshot_layers
+WHERE 
+    id = $1
+`
+
+func (q *Queries) DeleteLayer(ctx context.Context, id uint64) error {
+	_, err := q.exec(ctx, q.deleteLayerStmt, deleteLayer, id)
+	return err
+}
+
+const deleteLayersOfFile = `-- name: DeleteLayersOfFile :exec
+DELETE FROM 
+    snapshot_layers
+WHERE 
+    file_id = $1
+`
+
+func (q *Queries) DeleteLayersOfFile(ctx context.Context, fileID uint64) error {
+	_, err := q.exec(ctx, q.deleteLayersOfFileStmt, deleteLayersOfFile, fileID)
+	return err
+}
+
+const getLayerByTimestamp = `-- name: GetLayerByTimestamp :one
+SELECT 
+    snapshot_layers.id, 
+    snapshot_layers.file_id, 
+    snapshot_layers.version_id, 
+    versions.tag, 
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into
+FROM 
+    snapshot_layers
+INNER JOIN 
+    versions ON versions.id = snapshot_layers.version_id
+WHERE 
+    snapshot_layers.file_id = $1 AND snapshot_layers.created_at <= $2::TIMESTAMPTZ
+ORDER BY 
+    snapshot_layers.created_at DESC, snapshot_layers.id DESC
+LIMIT 1
+`
+
+type GetLayerByTimestampParams struct {
+	FileID uint64    `json:"fileID"`
+	At     time.Time `json:"at"`
+}
+
+type GetLayerByTimestampRow struct {
+	ID            uint64        `json:"id"`
+	FileID        uint64        `json:"fileId"`
+	VersionID     sql.NullInt64 `json:"versionId"`
+	Tag           string        `json:"tag"`
+	ObjectKey     string        `json:"objectKey"`
+	CompactedInto sql.NullInt64 `json:"compactedInto"`
+}
+
+func (q *Queries) GetLayerByTimestamp(ctx context.Context, arg GetLayerByTimestampParams) (GetLayerByTimestampRow, error) {
+	row := q.queryRow(ctx, q.getLayerByTimestampStmt, getLayerByTimestamp, arg.FileID, arg.At)
+	var i GetLayerByTimestampRow
+	err := row.Scan(
+		&i.ID,
+		&i.FileID,
+		&i.VersionID,
+		&i.Tag,
+		&i.ObjectKey,
+		&i.CompactedInto,
+	)
+	return i, err
+}
+
 const getLayerByVersion = `-- name: GetLayerByVersion :one
 SELECT 
     snapshot_layers.id, 
     snapshot_layers.file_id, 
     snapshot_layers.version_id, 
     versions.tag, 
-    snapshot_layers.object_key
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into
 FROM 
     snapshot_layers
 INNER JOIN 
@@ -31,11 +104,12 @@ type GetLayerByVersionParams struct {
 }
 
 type GetLayerByVersionRow struct {
-	ID        uint64        `json:"id"`
-	FileID    uint64        `json:"fileId"`
-	VersionID sql.NullInt64 `json:"versionId"`
-	Tag       string        `json:"tag"`
-	ObjectKey string        `json:"objectKey"`
+	ID            uint64        `json:"id"`
+	FileID        uint64        `json:"fileId"`
+	VersionID     sql.NullInt64 `json:"versionId"`
+	Tag           string        `json:"tag"`
+	ObjectKey     string        `json:"objectKey"`
+	CompactedInto sql.NullInt64 `json:"compactedInto"`
 }
 
 func (q *Queries) GetLayerByVersion(ctx context.Context, arg GetLayerByVersionParams) (GetLayerByVersionRow, error) {
@@ -47,6 +121,7 @@ func (q *Queries) GetLayerByVersion(ctx context.Context, arg GetLayerByVersionPa
 		&i.VersionID,
 		&i.Tag,
 		&i.ObjectKey,
+		&i.CompactedInto,
 	)
 	return i, err
 }
@@ -57,7 +132,9 @@ SELECT
     snapshot_layers.file_id, 
     snapshot_layers.version_id, 
     versions.tag, 
-    snapshot_layers.object_key
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into,
+    snapshot_layers.created_at
 FROM 
     snapshot_layers
 LEFT JOIN 
@@ -69,11 +146,13 @@ ORDER BY
 `
 
 type GetLayersByFileIDRow struct {
-	ID        uint64         `json:"id"`
-	FileID    uint64         `json:"fileId"`
-	VersionID sql.NullInt64  `json:"versionId"`
-	Tag       sql.NullString `json:"tag"`
-	ObjectKey string         `json:"objectKey"`
+	ID            uint64         `json:"id"`
+	FileID        uint64         `json:"fileId"`
+	VersionID     sql.NullInt64  `json:"versionId"`
+	Tag           sql.NullString `json:"tag"`
+	ObjectKey     string         `json:"objectKey"`
+	CompactedInto sql.NullInt64  `json:"compactedInto"`
+	CreatedAt     sql.NullTime   `json:"createdAt"`
 }
 
 func (q *Queries) GetLayersByFileID(ctx context.Context, fileID uint64) ([]GetLayersByFileIDRow, error) {
@@ -91,6 +170,87 @@ func (q *Queries) GetLayersByFileID(ctx context.Context, fileID uint64) ([]GetLa
 			&i.VersionID,
 			&i.Tag,
 			&i.ObjectKey,
+			&i.CompactedInto,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLayersWithAncestry = `-- name: GetLayersWithAncestry :many
+WITH RECURSIVE ancestry (file_id, base_layer_id) AS (
+    -- the file itself, whose layers are all visible
+    SELECT 
+        files.id, NULL::BIGINT
+    FROM 
+        files
+    WHERE 
+        files.id = $1
+    UNION ALL
+    -- the file it was branched from, visible up to the branch point
+    SELECT 
+        branches.parent_file_id, branches.base_layer_id
+    FROM 
+        branches
+    INNER JOIN 
+        ancestry ON branches.file_id = ancestry.file_id
+)
+SELECT 
+    snapshot_layers.id, 
+    snapshot_layers.file_id, 
+    snapshot_layers.version_id, 
+    versions.tag, 
+    snapshot_layers.object_key,
+    snapshot_layers.compacted_into,
+    snapshot_layers.created_at
+FROM 
+    snapshot_layers
+INNER JOIN 
+    ancestry ON snapshot_layers.file_id = ancestry.file_id
+LEFT JOIN 
+    versions ON snapshot_layers.version_id = versions.id
+WHERE 
+    ancestry.base_layer_id IS NULL OR snapshot_layers.id <= ancestry.base_layer_id
+ORDER BY 
+    snapshot_layers.id ASC
+`
+
+type GetLayersWithAncestryRow struct {
+	ID            uint64         `json:"id"`
+	FileID        uint64         `json:"fileId"`
+	VersionID     sql.NullInt64  `json:"versionId"`
+	Tag           sql.NullString `json:"tag"`
+	ObjectKey     string         `json:"objectKey"`
+	CompactedInto sql.NullInt64  `json:"compactedInto"`
+	CreatedAt     sql.NullTime   `json:"createdAt"`
+}
+
+func (q *Queries) GetLayersWithAncestry(ctx context.Context, fileID uint64) ([]GetLayersWithAncestryRow, error) {
+	rows, err := q.query(ctx, q.getLayersWithAncestryStmt, getLayersWithAncestry, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []GetLayersWithAncestryRow{}
+	for rows.Next() {
+		var i GetLayersWithAncestryRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.FileID,
+			&i.VersionID,
+			&i.Tag,
+			&i.ObjectKey,
+			&i.CompactedInto,
+			&i.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -121,6 +281,45 @@ func (q *Queries) GetObjectKey(ctx context.Context, id uint64) (string, error) {
 	return object_key, err
 }
 
+const getReferencedObjectKeys = `-- name: GetReferencedObjectKeys :many
+SELECT 
+    object_key
+FROM 
+    snapshot_layers
+WHERE 
+    object_key <> ''
+UNION
+SELECT 
+    object_key
+FROM 
+    chunks
+WHERE 
+    object_key <> ''
+`
+
+func (q *Queries) GetReferencedObjectKeys(ctx context.Context) ([]string, error) {
+	rows, err := q.query(ctx, q.getReferencedObjectKeysStmt, getReferencedObjectKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []string{}
+	for rows.Next() {
+		var object_key string
+		if err := rows.Scan(&object_key); err != nil {
+			return nil, err
+		}
+		items = append(items, object_key)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const insertLayer = `-- name: InsertLayer :one
 INSERT INTO 
     snapshot_layers (file_id, version_id, object_key) 
@@ -141,3 +340,66 @@ func (q *Queries) InsertLayer(ctx context.Context, arg InsertLayerParams) (uint6
 	err := row.Scan(&id)
 	return id, err
 }
+
+const markLayersCompacted = `-- name: MarkLayersCompacted :exec
+UPDATE 
+    snapshot_layers
+SET 
+    compacted_into = $1::BIGINT,
+    object_key = ''
+WHERE 
+    file_id = $2 AND (
+        (id >= $3::BIGINT AND id < $1::BIGINT) OR
+        (compacted_into >= $3::BIGINT AND compacted_into < $1::BIGINT)
+    )
+`
+
+type MarkLayersCompactedParams struct {
+	IntoLayerID int64  `json:"intoLayerID"`
+	FileID      uint64 `json:"fileID"`
+	FromLayerID int64  `json:"fromLayerID"`
+}
+
+func (q *Queries) MarkLayersCompacted(ctx context.Context, arg MarkLayersCompactedParams) error {
+	_, err := q.exec(ctx, q.markLayersCompactedStmt, markLayersCompacted, arg.IntoLayerID, arg.FileID, arg.FromLayerID)
+	return err
+}
+
+const moveLayers = `-- name: MoveLayers :exec
+UPDATE 
+    snapshot_layers
+SET 
+    file_id = $1
+WHERE 
+    file_id = $2 AND id >= $3::BIGINT
+`
+
+type MoveLayersParams struct {
+	DstFileID   uint64 `json:"dstFileID"`
+	SrcFileID   uint64 `json:"srcFileID"`
+	FromLayerID int64  `json:"fromLayerID"`
+}
+
+func (q *Queries) MoveLayers(ctx context.Context, arg MoveLayersParams) error {
+	_, err := q.exec(ctx, q.moveLayersStmt, moveLayers, arg.DstFileID, arg.SrcFileID, arg.FromLayerID)
+	return err
+}
+
+const updateLayerObjectKey = `-- name: UpdateLayerObjectKey :exec
+UPDATE 
+    snapshot_layers
+SET 
+    object_key = $2
+WHERE 
+    id = $1
+`
+
+type UpdateLayerObjectKeyParams struct {
+	ID        uint64 `json:"id"`
+	ObjectKey string `json:"objectKey"`
+}
+
+func (q *Queries) UpdateLayerObjectKey(ctx context.Context, arg UpdateLayerObjectKeyParams) error {
+	_, err := q.exec(ctx, q.updateLayerObjectKeyStmt, updateLayerObjectKey, arg.ID, arg.ObjectKey)
+	return err
+}
@@ -9,13 +9,77 @@ import (
 	"context"
 )
 
+const deleteVersion = `-- name: DeleteVersion :exec
+DELETE FROM versions WHERE id = $1
+`
+
+func (q *Queries) DeleteVersion(ctx context.Context, id uint64) error {
+	_, err := q.exec(ctx, q.deleteVersionStmt, deleteVersion, id)
+	return err
+}
+
+const deleteVersionsOfFile = `-- name: DeleteVersionsOfFile :exec
+DELETE FROM versions WHERE file_id = $1
+`
+
+func (q *Queries) DeleteVersionsOfFile(ctx context.Context, fileID uint64) error {
+	_, err := q.exec(ctx, q.deleteVersionsOfFileStmt, deleteVersionsOfFile, fileID)
+	return err
+}
+
 const insertVersion = `-- name: InsertVersion :one
-INSERT INTO versions (tag) VALUES ($1) RETURNING id
+INSERT INTO versions (file_id, tag) VALUES ($1, $2) RETURNING id
 `
 
-func (q *Queries) InsertVersion(ctx context.Context, tag string) (uint64, error) {
-	row := q.queryRow(ctx, q.insertVersionStmt, insertVersion, tag)
+type InsertVersionParams struct {
+	FileID uint64 `json:"fileId"`
+	Tag    string `json:"tag"`
+}
+
+func (q *Queries) InsertVersion(ctx context.Context, arg InsertVersionParams) (uint64, error) {
+	row := q.queryRow(ctx, q.insertVersionStmt, insertVersion, arg.FileID, arg.Tag)
 	var id uint64
 	err := row.Scan(&id)
 	return id, err
 }
+
+const moveVersionsOfLayers = `-- name: MoveVersionsOfLayers :exec
+UPDATE 
+    versions
+SET 
+    file_id = $1
+WHERE 
+    id IN (
+        SELECT 
+            version_id 
+        FROM 
+            snapshot_layers 
+        WHERE 
+            file_id = $2 AND id >= $3::BIGINT
+    )
+`
+
+type MoveVersionsOfLayersParams struct {
+	DstFileID   uint64 `json:"dstFileID"`
+	SrcFileID   uint64 `json:"srcFileID"`
+	FromLayerID int64  `json:"fromLayerID"`
+}
+
+func (q *Queries) MoveVersionsOfLayers(ctx context.Context, arg MoveVersionsOfLayersParams) error {
+	_, err := q.exec(ctx, q.moveVersionsOfLayersStmt, moveVersionsOfLayers, arg.DstFileID, arg.SrcFileID, arg.FromLayerID)
+	return err
+}
+
+const updateVersionTag = `-- name: UpdateVersionTag :exec
+UPDATE versions SET tag = $2 WHERE id = $1
+`
+
+type UpdateVersionTagParams struct {
+	ID  uint64 `json:"id"`
+	Tag string `json:"tag"`
+}
+
+func (q *Queries) UpdateVersionTag(ctx context.Context, arg UpdateVersionTagParams) error {
+	_, err := q.exec(ctx, q.updateVersionTagStmt, updateVersionTag, arg.ID, arg.Tag)
+	return err
+}
@@ -3,3 +3,5 @@ package types
 import "errors"
 
 var ErrNotFound = errors.New("not found")
+
+var ErrAlreadyExists = errors.New("already exists")
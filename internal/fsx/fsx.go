@@ -2,8 +2,10 @@ package fsx
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,22 +22,48 @@ type FS struct {
 	sm  *storage.Manager
 	log *log.Logger
 	wm  *wal.WALManager
+	pin pin // when set, every database file is served read-only as of this version
 }
 
 // Check interface satisfied
 var _ fs.FS = (*FS)(nil)
 
-func NewFS(sm *storage.Manager, log *log.Logger, walPath string) *FS {
+// Option configures optional behavior of the filesystem
+type Option func(*FS)
+
+// WithVersion mounts the filesystem read-only, serving every database file as
+// it was when the given version tag was checkpointed.
+func WithVersion(v string) Option {
+	return func(fs *FS) {
+		fs.pin = pin{version: v}
+	}
+}
+
+// WithTimestamp mounts the filesystem read-only, serving every database file as
+// of the newest version committed at or before t.
+func WithTimestamp(t time.Time) Option {
+	return func(fs *FS) {
+		fs.pin = pin{at: t}
+	}
+}
+
+func NewFS(sm *storage.Manager, log *log.Logger, walPath string, opts ...Option) *FS {
 	l := log.With()
 	l.SetPrefix("📄 fsx")
 
 	wm := wal.NewWALManager(walPath, sm, l)
 
-	return &FS{
+	fs := &FS{
 		sm:  sm,
 		log: l,
 		wm:  wm,
 	}
+
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	return fs
 }
 
 func (fs *FS) Root() (fs.Node, error) {
@@ -43,6 +71,7 @@ func (fs *FS) Root() (fs.Node, error) {
 		sm:  fs.sm,
 		log: fs.log,
 		wm:  fs.wm,
+		pin: fs.pin,
 	}, nil
 }
 
@@ -50,6 +79,7 @@ type Dir struct {
 	sm  *storage.Manager
 	log *log.Logger
 	wm  *wal.WALManager
+	pin pin // version of the read-only mount, zero for a writable mount
 }
 
 var _ fs.Node = (*Dir)(nil)
@@ -72,12 +102,23 @@ func (dir Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 func (dir Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	dir.log.Debug("Looking up file", "name", name)
 
+	name, version := splitVersion(name)
+	p := dir.pin
+	if version != "" {
+		p = parsePin(version)
+	}
+
 	if !checkValidExtension(name) {
 		dir.log.Error("File has invalid extension", "name", name)
 		return nil, syscall.ENOENT
 	}
 
 	if wal.IsWALFile(name) {
+		// Versions are immutable, so there is never a WAL to replay on top of them
+		if !p.isZero() {
+			return nil, syscall.ENOENT
+		}
+
 		exists, err := dir.wm.Exists(name)
 		if err != nil {
 			dir.log.Error("Failed to check if WAL file exists", "name", name, "error", err)
@@ -115,9 +156,9 @@ func (dir Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return file, nil
 	}
 
-	size, err := dir.sm.SizeOf(ctx, name)
+	size, err := dir.sm.SizeOf(ctx, name, storage.WithVersion(p.version), storage.WithTimestamp(p.at))
 	if err != nil {
-		if err == types.ErrNotFound {
+		if errors.Is(err, types.ErrNotFound) {
 			return nil, syscall.ENOENT
 		}
 		return nil, err
@@ -126,6 +167,7 @@ func (dir Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	now := time.Now()
 	file := &File{
 		name:     name,
+		pin:      p,
 		created:  now,
 		modified: now,
 		accessed: now,
@@ -152,6 +194,11 @@ func (dir Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		all = append(all, fuse.Dirent{Name: file.Name, Type: fuse.DT_File})
 	}
 
+	if !dir.pin.isZero() {
+		dir.log.Debug("Directory read complete", "totalFiles", len(all), "version", dir.pin)
+		return all, nil
+	}
+
 	walFiles, err := dir.wm.ListWALFiles()
 	if err != nil {
 		dir.log.Error("Failed to list WAL files", "error", err)
@@ -169,6 +216,11 @@ func (dir Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (dir Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	dir.log.Debug("Directory received remove request", "name", req.Name)
 
+	if _, version := splitVersion(req.Name); version != "" || !dir.pin.isZero() {
+		dir.log.Error("Cannot remove a file from a read-only version", "name", req.Name)
+		return syscall.EROFS
+	}
+
 	// For directories, we would check req.Dir, but we don't support directory removal yet
 	if req.Dir {
 		dir.log.Warn("Directory removal not supported", "name", req.Name)
@@ -198,6 +250,11 @@ func (dir Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 func (dir Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
 	dir.log.Info("Creating file", "filename", req.Name, "flags", req.Flags, "mode", req.Mode)
 
+	if _, version := splitVersion(req.Name); version != "" || !dir.pin.isZero() {
+		dir.log.Error("Cannot create a file in a read-only version", "filename", req.Name)
+		return nil, nil, syscall.EROFS
+	}
+
 	if !checkValidExtension(req.Name) {
 		dir.log.Info("Rejecting file with invalid extension", "filename", req.Name)
 		return nil, nil, syscall.EINVAL
@@ -253,12 +310,53 @@ func (dir Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.C
 // checkValidExtension checks if the file has a valid extension (.duckdb or .duckdb.wal)
 func checkValidExtension(filename string) bool {
 	return filename == "duckdb.wal" || filename == "duckdb" || filename == "tmp" ||
-		(len(filename) > 0 && (filename[0] != '.' && (filename[len(filename)-7:] == ".duckdb" ||
-			filename[len(filename)-11:] == ".duckdb.wal")))
+		(len(filename) > 0 && (filename[0] != '.' && (strings.HasSuffix(filename, ".duckdb") ||
+			strings.HasSuffix(filename, ".duckdb.wal"))))
+}
+
+// splitVersion splits a versioned file name such as "db.duckdb@v1" into the
+// database file name and the version tag. Names without a version tag are
+// returned unchanged along with an empty tag.
+func splitVersion(name string) (string, string) {
+	i := strings.Index(name, ".duckdb@")
+	if i < 0 {
+		return name, ""
+	}
+
+	base := name[:i+len(".duckdb")]
+	return base, name[len(base)+1:]
+}
+
+// pin identifies a past version of a database file, either by version tag or by
+// point in time. The zero value is the writable head of the file.
+type pin struct {
+	version string
+	at      time.Time
+}
+
+// parsePin parses the version part of a versioned file name. RFC 3339 timestamps
+// select the newest version at or before that instant, anything else is a tag.
+func parsePin(version string) pin {
+	if at, err := time.Parse(time.RFC3339, version); err == nil {
+		return pin{at: at}
+	}
+	return pin{version: version}
+}
+
+func (p pin) isZero() bool {
+	return p.version == "" && p.at.IsZero()
+}
+
+func (p pin) String() string {
+	if !p.at.IsZero() {
+		return p.at.Format(time.RFC3339)
+	}
+	return p.version
 }
 
 type File struct {
 	name     string
+	pin      pin // version the file is pinned to, zero for the writable head
 	created  time.Time
 	modified time.Time
 	accessed time.Time
@@ -272,6 +370,16 @@ var _ fs.Node = (*File)(nil)
 var _ fs.NodeOpener = (*File)(nil)
 var _ fs.NodeFsyncer = (*File)(nil)
 var _ fs.NodeRemover = (*File)(nil)
+var _ fs.HandleFAllocater = (*File)(nil)
+var _ fs.NodeGetxattrer = (*File)(nil)
+var _ fs.NodeListxattrer = (*File)(nil)
+var _ fs.NodeSetxattrer = (*File)(nil)
+var _ fs.NodeRemovexattrer = (*File)(nil)
+
+// tagXattr is the extended attribute of a database file that holds the tag of
+// its next checkpoint, e.g. `setfattr -n user.quackfs.tag -v before-migration db.duckdb`.
+// On a versioned file it holds the version being served.
+const tagXattr = "user.quackfs.tag"
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	f.log.Debug("Getting file attributes", "name", f.name)
@@ -314,13 +422,16 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 		return nil
 	}
 
-	size, err := f.sm.SizeOf(ctx, f.name)
+	size, err := f.sm.SizeOf(ctx, f.name, storage.WithVersion(f.pin.version), storage.WithTimestamp(f.pin.at))
 	if err != nil {
-		f.log.Error("Failed to get file size", "name", f.name, "error", err)
+		f.log.Error("Failed to get file size", "name", f.name, "version", f.pin, "error", err)
 		return err
 	}
 
 	a.Mode = 0644
+	if !f.pin.isZero() {
+		a.Mode = 0444
+	}
 	a.Size = size
 	a.Mtime = f.modified
 	a.Ctime = f.created
@@ -333,7 +444,20 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	f.log.Debug("Opening file", "name", f.name, "flags", req.Flags)
-	return f, nil
+
+	if !f.pin.isZero() && !req.Flags.IsReadOnly() {
+		f.log.Error("Cannot open a version for writing", "name", f.name, "version", f.pin)
+		return nil, syscall.EROFS
+	}
+
+	if wal.IsWALFile(f.name) || !checkValidExtension(f.name) {
+		return f, nil
+	}
+
+	// Each handle reads through its own reader, so that the scans of different
+	// handles are detected separately
+	reader := f.sm.NewReader(f.name, storage.WithVersion(f.pin.version), storage.WithTimestamp(f.pin.at))
+	return &fileHandle{File: f, reader: reader}, nil
 }
 
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
@@ -356,7 +480,7 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 		return nil
 	}
 
-	data, err := f.sm.ReadFile(ctx, f.name, uint64(req.Offset), uint64(req.Size))
+	data, err := f.sm.ReadFile(ctx, f.name, uint64(req.Offset), uint64(req.Size), storage.WithVersion(f.pin.version), storage.WithTimestamp(f.pin.at))
 	if err != nil {
 		f.log.Error("Failed to read data", "name", f.name, "error", err)
 		return err
@@ -367,9 +491,43 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadR
 	return nil
 }
 
+// fileHandle is an open database file. Reads go through the reader of the
+// handle, which prefetches ahead of sequential scans.
+type fileHandle struct {
+	*File
+	reader *storage.Reader
+}
+
+var _ fs.HandleReader = (*fileHandle)(nil)
+var _ fs.HandleReleaser = (*fileHandle)(nil)
+
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.log.Debug("Reading file", "name", h.name, "offset", req.Offset, "size", req.Size)
+
+	data, err := h.reader.ReadFile(ctx, uint64(req.Offset), uint64(req.Size))
+	if err != nil {
+		h.log.Error("Failed to read data", "name", h.name, "error", err)
+		return err
+	}
+
+	resp.Data = data
+	h.log.Debug("Read successful", "name", h.name, "bytesRead", len(resp.Data))
+	return nil
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.reader.Close()
+	return h.File.Release(ctx, req)
+}
+
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	f.log.Debug("Writing to file", "name", f.name, "size", len(req.Data), "offset", req.Offset, "fileFlags", req.FileFlags)
 
+	if !f.pin.isZero() {
+		f.log.Error("Cannot write to a read-only version", "name", f.name, "version", f.pin)
+		return syscall.EROFS
+	}
+
 	if !checkValidExtension(f.name) {
 		f.log.Error("File has invalid extension", "name", f.name)
 		return syscall.EINVAL
@@ -405,6 +563,49 @@ func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.Wri
 	return nil
 }
 
+// FAllocate preallocates or deallocates space of a file. Since files are sparse,
+// preallocating only extends the file with a hole, and punching a hole makes a
+// range read as zeros without storing any bytes for it.
+func (f *File) FAllocate(ctx context.Context, req *fuse.FAllocateRequest) error {
+	f.log.Debug("Allocating file space", "name", f.name, "offset", req.Offset, "length", req.Length, "mode", req.Mode)
+
+	if !f.pin.isZero() {
+		f.log.Error("Cannot allocate space of a read-only version", "name", f.name, "version", f.pin)
+		return syscall.EROFS
+	}
+
+	if wal.IsWALFile(f.name) {
+		return syscall.EOPNOTSUPP
+	}
+
+	switch req.Mode {
+	case 0:
+		if err := f.sm.Extend(ctx, f.name, req.Offset+req.Length); err != nil {
+			f.log.Error("Failed to extend file", "name", f.name, "error", err)
+			return fmt.Errorf("failed to extend file: %v", err)
+		}
+		size, err := f.sm.SizeOf(ctx, f.name)
+		if err != nil {
+			f.log.Error("Failed to get file size", "name", f.name, "error", err)
+			return fmt.Errorf("failed to get file size: %v", err)
+		}
+		f.fileSize = size
+	case fuse.FAllocateKeepSize:
+		// Nothing to reserve
+		return nil
+	case fuse.FAllocatePunchHole | fuse.FAllocateKeepSize:
+		if err := f.sm.PunchHole(ctx, f.name, req.Offset, req.Length); err != nil {
+			f.log.Error("Failed to punch hole", "name", f.name, "error", err)
+			return fmt.Errorf("failed to punch hole: %v", err)
+		}
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	f.modified = time.Now()
+	return nil
+}
+
 func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	f.log.Debug("Releasing file", "name", f.name, "flags", req.Flags)
 	return nil
@@ -419,6 +620,17 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 			f.log.Error("Failed to sync WAL file", "name", f.name, "error", err)
 			return err
 		}
+		return nil
+	}
+
+	// Read-only versions have nothing to sync
+	if !f.pin.isZero() {
+		return nil
+	}
+
+	if err := f.sm.Sync(ctx, f.name); err != nil {
+		f.log.Error("Failed to sync file", "name", f.name, "error", err)
+		return err
 	}
 
 	return nil
@@ -427,6 +639,11 @@ func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 func (f *File) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	f.log.Debug("Removing file", "name", f.name)
 
+	if !f.pin.isZero() {
+		f.log.Error("Cannot remove a read-only version", "name", f.name, "version", f.pin)
+		return syscall.EROFS
+	}
+
 	if !checkValidExtension(f.name) {
 		f.log.Error("File has invalid extension", "name", f.name)
 		return syscall.EINVAL
@@ -446,3 +663,85 @@ func (f *File) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	f.log.Info("WAL file removed successfully", "name", f.name)
 	return nil
 }
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if req.Name != tagXattr || wal.IsWALFile(f.name) {
+		return fuse.ErrNoXattr
+	}
+
+	if !f.pin.isZero() {
+		resp.Xattr = []byte(f.pin.String())
+		return nil
+	}
+
+	tag, ok := f.wm.NextTag(f.name)
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+
+	resp.Xattr = []byte(tag)
+	return nil
+}
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	if wal.IsWALFile(f.name) {
+		return nil
+	}
+
+	if _, ok := f.wm.NextTag(f.name); ok || !f.pin.isZero() {
+		resp.Append(tagXattr)
+	}
+
+	return nil
+}
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	f.log.Debug("Setting extended attribute", "name", f.name, "xattr", req.Name)
+
+	if req.Name != tagXattr || wal.IsWALFile(f.name) {
+		return syscall.ENOTSUP
+	}
+
+	if !f.pin.isZero() {
+		f.log.Error("Cannot tag a read-only version", "name", f.name, "version", f.pin)
+		return syscall.EROFS
+	}
+
+	tag := strings.TrimSpace(string(req.Xattr))
+	if err := storage.ValidateTag(tag); err != nil {
+		f.log.Error("Invalid tag", "name", f.name, "tag", tag, "error", err)
+		return syscall.EINVAL
+	}
+
+	exists, err := f.sm.HasVersion(ctx, f.name, tag)
+	if err != nil {
+		f.log.Error("Failed to look up tag", "name", f.name, "tag", tag, "error", err)
+		return err
+	}
+	if exists {
+		f.log.Error("Tag already exists", "name", f.name, "tag", tag)
+		return syscall.EEXIST
+	}
+
+	f.wm.SetNextTag(f.name, tag)
+
+	f.log.Info("Next checkpoint will be tagged", "name", f.name, "tag", tag)
+	return nil
+}
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if req.Name != tagXattr || wal.IsWALFile(f.name) {
+		return fuse.ErrNoXattr
+	}
+
+	if !f.pin.isZero() {
+		return syscall.EROFS
+	}
+
+	if _, ok := f.wm.NextTag(f.name); !ok {
+		return fuse.ErrNoXattr
+	}
+
+	f.wm.SetNextTag(f.name, "")
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -240,3 +241,101 @@ func setupTestEnvironment(t *testing.T) (*storage.Manager, *log.Logger, func())
 
 	return sm, log, cleanup
 }
+
+func TestSplitVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantName    string
+		wantVersion string
+	}{
+		{"Plain database file", "db.duckdb", "db.duckdb", ""},
+		{"WAL file", "db.duckdb.wal", "db.duckdb.wal", ""},
+		{"Versioned database file", "db.duckdb@v1", "db.duckdb", "v1"},
+		{"Checkpoint tag", "db.duckdb@checkpoint-1234", "db.duckdb", "checkpoint-1234"},
+		{"At sign before extension", "db@x.duckdb", "db@x.duckdb", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, version := splitVersion(tt.input)
+			require.Equal(t, tt.wantName, name)
+			require.Equal(t, tt.wantVersion, version)
+		})
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	p := parsePin("checkpoint-1234")
+	require.Equal(t, "checkpoint-1234", p.version)
+	require.True(t, p.at.IsZero())
+
+	p = parsePin("2026-10-01T12:00:00Z")
+	require.Empty(t, p.version)
+	require.Equal(t, time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), p.at.UTC())
+
+	require.True(t, pin{}.isZero())
+	require.False(t, p.isZero())
+}
+
+// TestVersionedFileIsReadOnly tests that a file pinned to a version serves the
+// data and size of that version and rejects writes
+func TestVersionedFileIsReadOnly(t *testing.T) {
+	sm, log, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	filename := "test_versioned_read_only.duckdb"
+	_, err := sm.InsertFile(ctx, filename)
+	require.NoError(t, err)
+
+	err = sm.WriteFile(ctx, filename, []byte("v1"), 0)
+	require.NoError(t, err)
+	err = sm.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	err = sm.WriteFile(ctx, filename, []byte("version two"), 0)
+	require.NoError(t, err)
+
+	dir := Dir{sm: sm, log: log}
+	node, err := dir.Lookup(ctx, filename+"@v1")
+	require.NoError(t, err)
+
+	file := node.(*File)
+	require.Equal(t, filename, file.name)
+	require.Equal(t, "v1", file.pin.version)
+
+	attr := fuse.Attr{}
+	err = file.Attr(ctx, &attr)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), attr.Size, "Size should be the size as of the version")
+
+	readResp := &fuse.ReadResponse{}
+	err = file.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 100}, readResp)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(readResp.Data))
+
+	err = file.Write(ctx, &fuse.WriteRequest{Data: []byte("nope"), Offset: 0}, &fuse.WriteResponse{})
+	require.ErrorIs(t, err, syscall.EROFS)
+
+	_, err = file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+	require.ErrorIs(t, err, syscall.EROFS)
+
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	require.NoError(t, err)
+	readResp = &fuse.ReadResponse{}
+	err = handle.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 100}, readResp)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(readResp.Data), "Reads through a handle should see the version too")
+	require.NoError(t, handle.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{}))
+
+	_, _, err = dir.Create(ctx, &fuse.CreateRequest{Name: "new.duckdb@v1"}, &fuse.CreateResponse{})
+	require.ErrorIs(t, err, syscall.EROFS)
+
+	err = dir.Remove(ctx, &fuse.RemoveRequest{Name: filename + "@v1"})
+	require.ErrorIs(t, err, syscall.EROFS)
+
+	_, err = dir.Lookup(ctx, filename+"@missing")
+	require.ErrorIs(t, err, syscall.ENOENT)
+}
@@ -17,7 +17,15 @@ import (
 	"github.com/vinimdocarmo/quackfs/pkg/logger"
 )
 
-func SetupStorageManager(t *testing.T) (*storage.Manager, func()) {
+func SetupStorageManager(t testing.TB, opts ...storage.Option) (*storage.Manager, func()) {
+	start, cleanup := SetupRestartableStorageManager(t, opts...)
+	return start(), cleanup
+}
+
+// SetupRestartableStorageManager is like SetupStorageManager, but returns a
+// function that creates a new storage manager on the same database and object
+// store every time it is called, to test what survives a restart.
+func SetupRestartableStorageManager(t testing.TB, opts ...storage.Option) (func() *storage.Manager, func()) {
 	connStr := GetTestConnectionString(t)
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -63,10 +71,24 @@ func SetupStorageManager(t *testing.T) (*storage.Manager, func()) {
 
 	objectStore := object.NewS3(s3Client, s3BucketName)
 
-	sm := storage.NewManager(db, objectStore, log)
+	start := func() *storage.Manager {
+		sm, err := storage.NewManager(db, objectStore, log, opts...)
+		if err != nil {
+			t.Fatalf("Failed to create storage manager: %v", err)
+		}
+		return sm
+	}
 
 	cleanup := func() {
 		// delete all rows in all tables
+		_, err = db.Exec("DELETE FROM branches")
+		if err != nil {
+			t.Fatalf("Failed to clean branches table: %v", err)
+		}
+		_, err = db.Exec("DELETE FROM clones")
+		if err != nil {
+			t.Fatalf("Failed to clean clones table: %v", err)
+		}
 		_, err = db.Exec("DELETE FROM chunks")
 		if err != nil {
 			t.Fatalf("Failed to clean chunks table: %v", err)
@@ -75,6 +97,14 @@ func SetupStorageManager(t *testing.T) (*storage.Manager, func()) {
 		if err != nil {
 			t.Fatalf("Failed to clean snapshot_layers table: %v", err)
 		}
+		_, err = db.Exec("DELETE FROM versions")
+		if err != nil {
+			t.Fatalf("Failed to clean versions table: %v", err)
+		}
+		_, err = db.Exec("DELETE FROM retention_policies")
+		if err != nil {
+			t.Fatalf("Failed to clean retention_policies table: %v", err)
+		}
 		_, err = db.Exec("DELETE FROM files")
 		if err != nil {
 			t.Fatalf("Failed to clean files table: %v", err)
@@ -85,11 +115,11 @@ func SetupStorageManager(t *testing.T) (*storage.Manager, func()) {
 		}
 	}
 
-	return sm, cleanup
+	return start, cleanup
 }
 
 // GetTestConnectionString returns the PostgreSQL connection string for tests
-func GetTestConnectionString(t *testing.T) string {
+func GetTestConnectionString(t testing.TB) string {
 	connStr := os.Getenv("POSTGRES_TEST_CONN")
 	if connStr == "" {
 		t.Fatal("PostgreSQL connection string not provided. Set POSTGRES_TEST_CONN environment variable")
@@ -97,7 +127,7 @@ func GetTestConnectionString(t *testing.T) string {
 	return connStr
 }
 
-func SetupDB(t *testing.T) *sql.DB {
+func SetupDB(t testing.TB) *sql.DB {
 	connStr := GetTestConnectionString(t)
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// AutoCheckpointPolicy decides when the active layer of a file is committed
+// without waiting for DuckDB to checkpoint the database.
+type AutoCheckpointPolicy struct {
+	MaxBytes uint64        // commit an active layer once it holds more than MaxBytes, 0 disables it
+	MaxAge   time.Duration // commit an active layer once its first write is older than MaxAge, 0 disables it
+	Interval time.Duration // how often every active layer is checked against the policy
+}
+
+// exceeded reports whether an active layer of the given size and age must be
+// committed.
+func (p AutoCheckpointPolicy) exceeded(size uint64, age time.Duration) bool {
+	return (p.MaxBytes > 0 && size > p.MaxBytes) || (p.MaxAge > 0 && age > p.MaxAge)
+}
+
+// RunAutoCheckpoint commits active layers that exceed the policy until ctx is
+// done, which bounds the writes at risk and the memory they take. The layers
+// are committed under a generated tag, as versions of their own; a checkpoint
+// of DuckDB that finds nothing left to commit afterwards tags the last of them
+// instead of creating an empty version.
+func (mgr *Manager) RunAutoCheckpoint(ctx context.Context, policy AutoCheckpointPolicy) {
+	if (policy.MaxBytes == 0 && policy.MaxAge <= 0) || policy.Interval <= 0 {
+		mgr.log.Debug("Automatic checkpoints disabled")
+		return
+	}
+
+	mgr.log.Info("Automatic checkpoints enabled", "maxBytes", humanize.Bytes(policy.MaxBytes), "maxAge", policy.MaxAge, "interval", policy.Interval)
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := mgr.autoCheckpointByPolicy(ctx, policy); err != nil {
+				mgr.log.Error("Automatic checkpoint failed", "error", err)
+			}
+		}
+	}
+}
+
+// autoCheckpointByPolicy runs a single pass of the policy over every active
+// layer. A file that fails to be checkpointed is logged and skipped, so that it
+// doesn't hold up the others.
+func (mgr *Manager) autoCheckpointByPolicy(ctx context.Context, policy AutoCheckpointPolicy) error {
+	now := time.Now()
+
+	var due []uint64
+	for fileID, state := range mgr.files() {
+		state.mu.RLock()
+		if layer := state.active; layer != nil && policy.exceeded(layer.DataSize(), now.Sub(layer.CreatedAt)) {
+			due = append(due, fileID)
+		}
+		state.mu.RUnlock()
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	files, err := mgr.metaStore.GetAllFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	names := make(map[uint64]string, len(files))
+	for _, file := range files {
+		names[file.ID] = file.Name
+	}
+
+	for _, fileID := range due {
+		filename, ok := names[fileID]
+		if !ok {
+			continue
+		}
+
+		if err := mgr.autoCheckpointIfExceeded(ctx, policy, filename, fileID); err != nil {
+			mgr.log.Error("Automatic checkpoint failed", "filename", filename, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// autoCheckpointIfExceeded commits the active layer of a file if it still
+// exceeds the policy. DuckDB may have checkpointed the file since it was found
+// to exceed it.
+func (mgr *Manager) autoCheckpointIfExceeded(ctx context.Context, policy AutoCheckpointPolicy, filename string, fileID uint64) error {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	state, ok := mgr.lookupFile(fileID)
+	if !ok {
+		return nil
+	}
+
+	state.checkpointMu.Lock()
+	defer state.checkpointMu.Unlock()
+
+	state.mu.RLock()
+	var size uint64
+	var age time.Duration
+	if state.active != nil {
+		size, age = state.active.DataSize(), time.Since(state.active.CreatedAt)
+	}
+	state.mu.RUnlock()
+
+	if !policy.exceeded(size, age) {
+		return nil
+	}
+
+	tag, _, err := mgr.autoCheckpoint(ctx, filename, fileID, state)
+	if err != nil || tag == "" {
+		return err
+	}
+
+	mgr.log.Info("Active layer frozen for an automatic checkpoint", "filename", filename, "tag", tag, "size", humanize.Bytes(size), "age", age.Round(time.Millisecond))
+
+	return nil
+}
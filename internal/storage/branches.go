@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// Branch is a writable line of history forked from a version of another file,
+// its parent. A branch is stored as a file of its own that only holds the layers
+// written on the branch: older data is read from the parent, as it was at the
+// branch point.
+type Branch struct {
+	Name        string    // name of the branch, unique among the branches of its parent
+	FileName    string    // name of the file holding the branch, e.g. db@feature-x.duckdb
+	FileID      uint64    // ID of the file holding the branch
+	Parent      string    // file the branch was created from
+	BaseLayerID uint64    // newest layer of the parent visible on the branch
+	BaseTag     string    // version of the parent the branch was created from
+	CreatedAt   time.Time // when the branch was created
+}
+
+// BranchFileName returns the name of the file holding the given branch of a
+// file. The branch name goes before the extension so that the branch is still
+// recognized as a DuckDB database: branch feature-x of db.duckdb is stored as
+// db@feature-x.duckdb.
+func BranchFileName(filename string, branch string) string {
+	stem, ok := strings.CutSuffix(filename, ".duckdb")
+	if !ok {
+		return filename + "@" + branch
+	}
+	return stem + "@" + branch + ".duckdb"
+}
+
+// ValidateBranchName checks that a branch name can be used in a file name and
+// cannot be mistaken for a version of a file.
+func ValidateBranchName(name string) error {
+	if name == "" {
+		return errors.New("branch name cannot be empty")
+	}
+	if strings.ContainsAny(name, "@/\x00") {
+		return errors.New("branch name cannot contain '@', '/' or NUL characters")
+	}
+	if strings.HasPrefix(name, ".") {
+		return errors.New("branch name cannot start with '.'")
+	}
+	return nil
+}
+
+// CreateBranch creates a branch of a file from the given version tag, or from
+// its latest committed version if the tag is empty. The branch starts with the
+// exact content of that version and can then be written independently: writes
+// to the branch never affect the parent and writes to the parent after the
+// branch point are not visible on the branch. No data is copied, the branch
+// reads the layers of its parent up to the branch point. Data in the parent's
+// active layer is not part of the branch.
+func (mgr *Manager) CreateBranch(ctx context.Context, filename string, name string, version string) (*Branch, error) {
+	if err := ValidateBranchName(name); err != nil {
+		return nil, err
+	}
+
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	branchFile := BranchFileName(filename, name)
+
+	mgr.log.Debug("Creating branch", "filename", filename, "branch", name, "version", version)
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	parentID, err := mgr.metaStore.GetFileIDByName(ctx, filename, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	// Keeps a compaction from folding the branch point into a newer layer
+	if err = mgr.metaStore.LockFile(ctx, tx, parentID); err != nil {
+		mgr.log.Error("Failed to lock file", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	_, err = mgr.metaStore.GetFileIDByName(ctx, branchFile, metadata.WithTx(tx))
+	if err == nil {
+		err = fmt.Errorf("%s already exists: %w", branchFile, types.ErrAlreadyExists)
+		return nil, err
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		mgr.log.Error("Failed to get file ID", "filename", branchFile, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	branch := &Branch{
+		Name:      name,
+		FileName:  branchFile,
+		Parent:    filename,
+		BaseTag:   version,
+		CreatedAt: time.Now(),
+	}
+
+	if version != "" {
+		branch.BaseLayerID, err = mgr.resolveVersionedLayer(ctx, tx, parentID, readFileOpts{version: version})
+		if err != nil {
+			mgr.log.Error("Version tag not found or error fetching layer", "version", version, "filename", filename, "error", err)
+			return nil, err
+		}
+	} else {
+		// The parent may itself be a branch without layers of its own yet, in which
+		// case its latest version is a layer of one of its ancestors
+		var layers []*metadata.Layer
+		layers, err = mgr.metaStore.LoadLayersWithAncestry(ctx, parentID, metadata.WithTx(tx))
+		if err != nil {
+			mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+			return nil, fmt.Errorf("failed to load layers: %w", err)
+		}
+		if len(layers) == 0 {
+			err = fmt.Errorf("%s has no committed version to branch from", filename)
+			return nil, err
+		}
+		branch.BaseLayerID = layers[len(layers)-1].ID
+		branch.BaseTag = layers[len(layers)-1].Tag
+	}
+
+	branch.FileID, err = mgr.metaStore.InsertFile(ctx, branchFile, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to insert branch file", "filename", branchFile, "error", err)
+		return nil, fmt.Errorf("failed to insert branch file: %w", err)
+	}
+
+	if err = mgr.metaStore.InsertBranch(ctx, tx, branch.FileID, name, parentID, branch.BaseLayerID); err != nil {
+		mgr.log.Error("Failed to insert branch", "filename", filename, "branch", name, "error", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	mgr.log.Info("Branch created", "filename", filename, "branch", name, "file", branchFile, "baseLayerID", branch.BaseLayerID)
+
+	return branch, nil
+}
+
+// ListBranches returns the branches created from a file, ordered by name.
+// Branches of those branches are not included.
+func (mgr *Manager) ListBranches(ctx context.Context, filename string) ([]Branch, error) {
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	rows, err := mgr.metaStore.GetBranches(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to get branches", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	branches := make([]Branch, 0, len(rows))
+	for _, row := range rows {
+		branches = append(branches, Branch{
+			Name:        row.Name,
+			FileName:    row.FileName,
+			FileID:      row.FileID,
+			Parent:      filename,
+			BaseLayerID: row.BaseLayerID,
+			BaseTag:     row.BaseTag.String,
+			CreatedAt:   row.CreatedAt.Time,
+		})
+	}
+
+	return branches, nil
+}
+
+// DeleteBranch deletes a branch of a file together with every version written
+// on it. Writes to the branch that were not checkpointed are discarded. A branch
+// that has branches of its own cannot be deleted. The layer objects of the
+// branch are left to the garbage collector.
+func (mgr *Manager) DeleteBranch(ctx context.Context, filename string, name string) error {
+	// Compaction and retention must not work on the branch while it goes away
+	mgr.compactMu.Lock()
+	defer mgr.compactMu.Unlock()
+
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	mgr.log.Debug("Deleting branch", "filename", filename, "branch", name)
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	parentID, err := mgr.metaStore.GetFileIDByName(ctx, filename, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	branches, err := mgr.metaStore.GetBranches(ctx, parentID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get branches", "filename", filename, "error", err)
+		return err
+	}
+
+	var branchID uint64
+	for _, b := range branches {
+		if b.Name == name {
+			branchID = b.FileID
+			break
+		}
+	}
+	if branchID == 0 {
+		err = fmt.Errorf("branch %q of %s not found: %w", name, filename, types.ErrNotFound)
+		return err
+	}
+
+	children, err := mgr.metaStore.GetBranches(ctx, branchID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get branches", "filename", BranchFileName(filename, name), "error", err)
+		return err
+	}
+	if len(children) > 0 {
+		err = fmt.Errorf("branch %q of %s has %d branches of its own, delete them first", name, filename, len(children))
+		return err
+	}
+
+	if err = mgr.metaStore.DeleteFile(ctx, tx, branchID); err != nil {
+		mgr.log.Error("Failed to delete branch file", "filename", BranchFileName(filename, name), "error", err)
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	mgr.forgetFile(branchID)
+
+	mgr.log.Info("Branch deleted", "filename", filename, "branch", name)
+
+	return nil
+}
@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+const compactBatchSize = 64 << 20 // bytes of committed chunks a compaction fetches at a time
+
+// ErrVersionCompacted is returned when reading a version that was folded into a
+// newer layer by compaction, which no longer holds its exact content.
+var ErrVersionCompacted = errors.New("version was compacted")
+
+// CompactionResult describes the outcome of folding a run of layers into one.
+type CompactionResult struct {
+	FileID       uint64
+	IntoLayerID  uint64        // layer that now holds the visible bytes of the whole run
+	LayersMerged int           // number of live layers that were folded together
+	ChunksBefore int           // chunks of the run before compaction
+	ChunksAfter  int           // chunks of the compacted layer
+	BytesBefore  uint64        // bytes stored by the layers of the run before compaction
+	BytesAfter   uint64        // bytes stored by the compacted layer
+	ObjectKey    string        // object holding the compacted layer
+	ReleasedKeys []string      // objects no longer referenced by this file
+	Took         time.Duration // time spent compacting
+}
+
+// CompactionPolicy decides when files are compacted in the background.
+type CompactionPolicy struct {
+	MaxLayers int           // compact a file once it has more than MaxLayers live layers
+	Interval  time.Duration // how often every file is checked against the policy
+}
+
+// Compact folds the run of live layers between the fromVersion and toVersion
+// tags (inclusive) into a single layer containing only the bytes of the run
+// that are still visible. Empty tags select the oldest and newest layers. The
+// compacted layer keeps the position of the newest layer of the run, so layers
+// written later keep shadowing it.
+//
+// Only the newest version of the run stays readable; reading any other version
+// of the run fails with ErrVersionCompacted. Versions with a named tag and the
+// versions that branches and clones were created from, or that the file was
+// cloned from, keep their exact content: they can only be the newest layer of a
+// run, and without an explicit start the run starts right after the newest of
+// them.
+func (mgr *Manager) Compact(ctx context.Context, filename string, fromVersion string, toVersion string) (*CompactionResult, error) {
+	mgr.compactMu.Lock()
+	defer mgr.compactMu.Unlock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	var fromLayerID, toLayerID uint64
+	if fromVersion != "" {
+		fromLayerID, err = mgr.resolveVersionedLayer(ctx, nil, fileID, readFileOpts{version: fromVersion})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve version %q: %w", fromVersion, err)
+		}
+	}
+	if toVersion != "" {
+		toLayerID, err = mgr.resolveVersionedLayer(ctx, nil, fileID, readFileOpts{version: toVersion})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve version %q: %w", toVersion, err)
+		}
+	}
+
+	layers, err := mgr.metaStore.LoadLayersByFileID(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	var run []*metadata.Layer
+	for _, layer := range layers {
+		if layer.CompactedInto != 0 {
+			continue
+		}
+		if fromLayerID != 0 && layer.ID < fromLayerID {
+			continue
+		}
+		if toLayerID != 0 && layer.ID > toLayerID {
+			break
+		}
+		run = append(run, layer)
+	}
+
+	boundaries, err := mgr.runBoundaries(ctx, fileID, layers)
+	if err != nil {
+		mgr.log.Error("Failed to get run boundaries", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	for i := len(run) - 2; i >= 0; i-- {
+		reason, ok := boundaries[run[i].ID]
+		if !ok {
+			continue
+		}
+		if fromVersion != "" {
+			return nil, fmt.Errorf("cannot compact past version %q (%s)", run[i].Tag, reason)
+		}
+		run = run[i+1:]
+		break
+	}
+
+	return mgr.compactLayers(ctx, filename, fileID, run)
+}
+
+// runBoundaries returns the layers of a file whose exact content must stay
+// readable, and which can thus only be the newest layer of a compacted run,
+// with the reason why, in the words of retention decisions.
+func (mgr *Manager) runBoundaries(ctx context.Context, fileID uint64, layers []*metadata.Layer, opts ...metadata.QueryOpt) (map[uint64]string, error) {
+	boundaries := make(map[uint64]string)
+
+	for _, layer := range layers {
+		if isNamedTag(layer.Tag) {
+			boundaries[layer.ID] = "named tag"
+		}
+	}
+
+	// Branches read this file as of the layer they were created from
+	branchPoints, err := mgr.metaStore.GetBranchPoints(ctx, fileID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get branch points: %w", err)
+	}
+	for id := range branchPoints {
+		boundaries[id] = "branch point"
+	}
+
+	// Promotions compare clones and their sources as of the layers they share
+	clonePoints, err := mgr.metaStore.GetClonePoints(ctx, fileID, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get clone points: %w", err)
+	}
+	for id := range clonePoints {
+		boundaries[id] = "clone point"
+	}
+
+	clone, err := mgr.metaStore.GetClone(ctx, fileID, opts...)
+	if err == nil {
+		boundaries[clone.BaseLayerID] = "clone base"
+	} else if !errors.Is(err, types.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get clone: %w", err)
+	}
+
+	return boundaries, nil
+}
+
+// verifyRun checks, within tx, that the run of layers about to be swapped for
+// their compacted layer is still the run of live layers between its oldest and
+// newest layers, unchanged since it was read, and that no layer but its newest
+// became a run boundary meanwhile.
+func (mgr *Manager) verifyRun(ctx context.Context, tx *sql.Tx, fileID uint64, run []*metadata.Layer) error {
+	layers, err := mgr.metaStore.LoadLayersByFileID(ctx, fileID, metadata.WithTx(tx))
+	if err != nil {
+		return fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	from, into := run[0], run[len(run)-1]
+
+	var live []*metadata.Layer
+	for _, layer := range layers {
+		if layer.ID >= from.ID && layer.ID <= into.ID && layer.CompactedInto == 0 {
+			live = append(live, layer)
+		}
+	}
+
+	if len(live) != len(run) {
+		return fmt.Errorf("layers of the run changed during compaction")
+	}
+	for i, layer := range live {
+		if layer.ID != run[i].ID || layer.ObjectKey != run[i].ObjectKey {
+			return fmt.Errorf("layers of the run changed during compaction")
+		}
+	}
+
+	boundaries, err := mgr.runBoundaries(ctx, fileID, layers, metadata.WithTx(tx))
+	if err != nil {
+		return err
+	}
+	for _, layer := range run[:len(run)-1] {
+		if reason, ok := boundaries[layer.ID]; ok {
+			return fmt.Errorf("cannot compact past version %q anymore (%s)", layer.Tag, reason)
+		}
+	}
+
+	return nil
+}
+
+// compactLayers folds the given run of contiguous live layers, ordered from the
+// oldest to the newest, into the newest layer of the run.
+func (mgr *Manager) compactLayers(ctx context.Context, filename string, fileID uint64, run []*metadata.Layer) (*CompactionResult, error) {
+	start := time.Now()
+
+	if len(run) < 2 {
+		mgr.log.Debug("Nothing to compact", "filename", filename, "layers", len(run))
+		return &CompactionResult{FileID: fileID, LayersMerged: len(run)}, nil
+	}
+
+	from, into := run[0], run[len(run)-1]
+
+	result := &CompactionResult{
+		FileID:       fileID,
+		IntoLayerID:  into.ID,
+		LayersMerged: len(run),
+	}
+
+	var chunks []metadata.Chunk
+	for _, layer := range run {
+		layerChunks, err := mgr.metaStore.GetLayerChunks(ctx, layer.ID)
+		if err != nil {
+			mgr.log.Error("Failed to load layer chunks", "layerID", layer.ID, "error", err)
+			return nil, fmt.Errorf("failed to load layer chunks: %w", err)
+		}
+		for _, c := range layerChunks {
+			// Chunks of a restored version point into the objects of other layers
+			if c.ObjectKey == "" {
+				result.BytesBefore += c.LayerRange[1] - c.LayerRange[0]
+			}
+		}
+		chunks = append(chunks, layerChunks...)
+		if layer.ObjectKey != "" {
+			result.ReleasedKeys = append(result.ReleasedKeys, layer.ObjectKey)
+		}
+	}
+	result.ChunksBefore = len(chunks)
+
+	// Copy every visible byte of the run into a new layer, merging extents that
+	// are contiguous in the file into a single chunk. The layer is written to a
+	// temporary file, so compacting a large file doesn't need it in memory.
+	var size uint64
+	var compacted []metadata.Chunk
+	var sources []metadata.Chunk // where the data of the new layer comes from, in order
+	for _, extent := range metadata.Resolve(chunks) {
+		// Holes stay holes, they have no bytes to copy
+		if extent.Chunk.Zero {
+			if n := len(compacted); n > 0 && compacted[n-1].Zero && compacted[n-1].FileRange[1] == extent.FileRange[0] {
+				compacted[n-1].FileRange[1] = extent.FileRange[1]
+				continue
+			}
+			compacted = append(compacted, metadata.Chunk{
+				LayerID:    into.ID,
+				Flushed:    true,
+				LayerRange: [2]uint64{size, size},
+				FileRange:  extent.FileRange,
+				Zero:       true,
+			})
+			continue
+		}
+
+		layerRange := extent.LayerRange()
+		sources = append(sources, metadata.Chunk{
+			LayerID:    extent.Chunk.LayerID,
+			Flushed:    true,
+			LayerRange: layerRange,
+			FileRange:  extent.FileRange,
+			ObjectKey:  extent.Chunk.ObjectKey,
+		})
+
+		offset := size
+		size += layerRange[1] - layerRange[0]
+
+		if n := len(compacted); n > 0 && !compacted[n-1].Zero && compacted[n-1].FileRange[1] == extent.FileRange[0] {
+			compacted[n-1].FileRange[1] = extent.FileRange[1]
+			compacted[n-1].LayerRange[1] = size
+			continue
+		}
+
+		compacted = append(compacted, metadata.Chunk{
+			LayerID:    into.ID,
+			Flushed:    true,
+			LayerRange: [2]uint64{offset, size},
+			FileRange:  extent.FileRange,
+		})
+	}
+	result.BytesAfter = size
+	result.ChunksAfter = len(compacted)
+
+	data, err := os.CreateTemp(mgr.spillDir, fmt.Sprintf("quackfs-compact-%d-*", fileID))
+	if err != nil {
+		mgr.log.Error("Failed to create compaction file", "error", err)
+		return nil, fmt.Errorf("failed to create compaction file: %w", err)
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+
+	if err := mgr.copyChunks(ctx, data, sources); err != nil {
+		mgr.log.Error("Failed to read extents", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to read extents: %w", err)
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind compaction file: %w", err)
+	}
+
+	objectKey := fmt.Sprintf("layers/%s/%d-%d-compacted-%d", filename, fileID, into.VersionID, from.ID)
+	if err := mgr.objectStore.PutObjectReader(ctx, objectKey, data); err != nil {
+		mgr.log.Error("Failed to upload compacted layer", "objectKey", objectKey, "error", err)
+		return nil, fmt.Errorf("failed to upload compacted layer: %w", err)
+	}
+	result.ObjectKey = objectKey
+
+	// The metadata swap is serialized with the operations of this process that
+	// hold mgr.mu, like checkpoints and restores
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	// Other processes may have changed the layers of the file while the run was
+	// being copied, so it is checked again with them locked
+	if err = mgr.metaStore.LockFile(ctx, tx, fileID); err != nil {
+		mgr.log.Error("Failed to lock file", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	if err = mgr.verifyRun(ctx, tx, fileID, run); err != nil {
+		mgr.log.Error("Failed to verify compacted run", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	if err = mgr.metaStore.DeleteChunksOfLayers(ctx, tx, fileID, from.ID, into.ID); err != nil {
+		mgr.log.Error("Failed to delete chunks of compacted layers", "error", err)
+		return nil, err
+	}
+
+	for _, c := range compacted {
+		if err = mgr.metaStore.InsertChunk(ctx, into.ID, c, metadata.WithTx(tx)); err != nil {
+			mgr.log.Error("Failed to insert compacted chunk", "error", err)
+			return nil, err
+		}
+	}
+
+	if err = mgr.metaStore.UpdateLayerObjectKey(ctx, tx, into.ID, objectKey); err != nil {
+		mgr.log.Error("Failed to update object key of compacted layer", "error", err)
+		return nil, err
+	}
+
+	if err = mgr.metaStore.MarkLayersCompacted(ctx, tx, fileID, from.ID, into.ID); err != nil {
+		mgr.log.Error("Failed to mark layers as compacted", "error", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	result.Took = time.Since(start)
+
+	mgr.log.Info("Layers compacted",
+		"filename", filename,
+		"layers", result.LayersMerged,
+		"intoLayerID", result.IntoLayerID,
+		"chunks", fmt.Sprintf("%d → %d", result.ChunksBefore, result.ChunksAfter),
+		"bytes", fmt.Sprintf("%s → %s", humanize.Bytes(result.BytesBefore), humanize.Bytes(result.BytesAfter)),
+		"took", result.Took)
+
+	return result, nil
+}
+
+// copyChunks writes the data of committed chunks to w, in order. The chunks are
+// fetched in batches of about compactBatchSize bytes, each batch with merged
+// and concurrent range requests.
+func (mgr *Manager) copyChunks(ctx context.Context, w io.Writer, chunks []metadata.Chunk) error {
+	for len(chunks) > 0 {
+		n, size := 0, uint64(0)
+		for n < len(chunks) && (n == 0 || size < compactBatchSize) {
+			size += chunks[n].LayerRange[1] - chunks[n].LayerRange[0]
+			n++
+		}
+
+		fetched, err := mgr.fetchChunks(ctx, chunks[:n])
+		if err != nil {
+			return err
+		}
+		for i, data := range fetched {
+			if want := chunks[i].LayerRange[1] - chunks[i].LayerRange[0]; uint64(len(data)) != want {
+				return fmt.Errorf("layer %d has no data for range %v", chunks[i].LayerID, chunks[i].LayerRange)
+			}
+			if _, err := w.Write(data); err != nil {
+				return fmt.Errorf("failed to write chunk data: %w", err)
+			}
+		}
+
+		chunks = chunks[n:]
+	}
+
+	return nil
+}
+
+// RunCompaction compacts, every policy.Interval, the whole history of each file
+// that has more than policy.MaxLayers live layers. It blocks until ctx is done.
+func (mgr *Manager) RunCompaction(ctx context.Context, policy CompactionPolicy) {
+	if policy.MaxLayers <= 0 || policy.Interval <= 0 {
+		mgr.log.Debug("Background compaction disabled")
+		return
+	}
+
+	mgr.log.Info("Background compaction enabled", "maxLayers", policy.MaxLayers, "interval", policy.Interval)
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := mgr.compactByPolicy(ctx, policy); err != nil {
+				mgr.log.Error("Background compaction failed", "error", err)
+			}
+		}
+	}
+}
+
+// compactByPolicy runs a single pass of the compaction policy over every file.
+func (mgr *Manager) compactByPolicy(ctx context.Context, policy CompactionPolicy) error {
+	files, err := mgr.metaStore.GetAllFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	for _, file := range files {
+		layers, err := mgr.metaStore.LoadLayersByFileID(ctx, file.ID)
+		if err != nil {
+			return fmt.Errorf("failed to load layers of %s: %w", file.Name, err)
+		}
+
+		var live int
+		for _, layer := range layers {
+			if layer.CompactedInto == 0 {
+				live++
+			}
+		}
+
+		if live <= policy.MaxLayers {
+			continue
+		}
+
+		mgr.log.Debug("File exceeds the compaction policy", "filename", file.Name, "layers", live, "maxLayers", policy.MaxLayers)
+
+		if _, err := mgr.Compact(ctx, file.Name, "", ""); err != nil {
+			return fmt.Errorf("failed to compact %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
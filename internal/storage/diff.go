@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+const (
+	// DuckDBHeaderSize is the size of the headers at the start of a DuckDB file,
+	// one main header followed by two database headers of 4KiB each.
+	DuckDBHeaderSize = 3 * 4096
+	// DuckDBBlockSize is the size of the blocks that follow the headers.
+	DuckDBBlockSize = 256 * 1024
+)
+
+// DiffResult lists the file ranges whose bytes may differ between two versions.
+type DiffResult struct {
+	FromLayerID uint64
+	ToLayerID   uint64
+	Ranges      [][2]uint64 // sorted, non-overlapping and non-adjacent
+	Bytes       uint64      // total length of the ranges
+}
+
+// Blocks returns the DuckDB blocks touched by the diff and whether the file
+// headers were touched.
+func (d *DiffResult) Blocks() (header bool, blocks []uint64) {
+	for _, r := range d.Ranges {
+		start, end := r[0], r[1]
+		if start < DuckDBHeaderSize {
+			header = true
+			start = DuckDBHeaderSize
+		}
+		if start >= end {
+			continue
+		}
+
+		first := (start - DuckDBHeaderSize) / DuckDBBlockSize
+		last := (end - 1 - DuckDBHeaderSize) / DuckDBBlockSize
+		for b := first; b <= last; b++ {
+			if n := len(blocks); n > 0 && blocks[n-1] >= b {
+				continue
+			}
+			blocks = append(blocks, b)
+		}
+	}
+
+	return header, blocks
+}
+
+// Diff returns the ranges of a file whose visible bytes may differ between the
+// fromVersion and toVersion tags. An empty toVersion stands for the latest
+// committed version. Only the chunks metadata is read: a range is reported as
+// soon as it is read from a different write in each version, even if the bytes
+// that were written happen to be the same.
+func (mgr *Manager) Diff(ctx context.Context, filename string, fromVersion string, toVersion string) (*DiffResult, error) {
+	if fromVersion == "" {
+		return nil, fmt.Errorf("a version to diff from is required")
+	}
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	result := &DiffResult{}
+
+	result.FromLayerID, err = mgr.resolveVersionedLayer(ctx, nil, fileID, readFileOpts{version: fromVersion})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve version %q: %w", fromVersion, err)
+	}
+
+	if toVersion != "" {
+		result.ToLayerID, err = mgr.resolveVersionedLayer(ctx, nil, fileID, readFileOpts{version: toVersion})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve version %q: %w", toVersion, err)
+		}
+	}
+
+	layers, err := mgr.metaStore.LoadLayersWithAncestry(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	if result.ToLayerID == 0 && len(layers) > 0 {
+		result.ToLayerID = layers[len(layers)-1].ID
+	}
+
+	var from, to []metadata.Chunk
+	for _, layer := range layers {
+		if layer.ID > result.FromLayerID && layer.ID > result.ToLayerID {
+			break
+		}
+
+		chunks, err := mgr.metaStore.GetLayerChunks(ctx, layer.ID)
+		if err != nil {
+			mgr.log.Error("Failed to load layer chunks", "layerID", layer.ID, "error", err)
+			return nil, fmt.Errorf("failed to load layer chunks: %w", err)
+		}
+
+		if layer.ID <= result.FromLayerID {
+			from = append(from, chunks...)
+		}
+		if layer.ID <= result.ToLayerID {
+			to = append(to, chunks...)
+		}
+	}
+
+	result.Ranges = metadata.DiffExtents(metadata.Resolve(from), metadata.Resolve(to))
+	for _, r := range result.Ranges {
+		result.Bytes += r[1] - r[0]
+	}
+
+	mgr.log.Debug("Diffed versions", "filename", filename, "from", fromVersion, "to", toVersion, "ranges", len(result.Ranges), "bytes", result.Bytes)
+
+	return result, nil
+}
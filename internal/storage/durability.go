@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// Durability selects what Sync guarantees for the writes to a file that were
+// not checkpointed yet.
+type Durability string
+
+const (
+	// DurabilityNone acknowledges a sync right away: writes are only safe once
+	// they are checkpointed.
+	DurabilityNone Durability = "none"
+	// DurabilityLocal flushes the journal of the file to the local disk, so its
+	// writes survive a crash of the process or of the machine.
+	DurabilityLocal Durability = "local"
+	// DurabilityRemote commits the active layer of the file to the object store
+	// and the metadata database as a new version, so its writes survive the loss
+	// of the machine.
+	DurabilityRemote Durability = "remote"
+)
+
+// ParseDurability returns the durability mode with the given name.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityNone, DurabilityLocal, DurabilityRemote:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown durability mode %q, expected none, local or remote", s)
+	}
+}
+
+// WithDurability sets what Sync guarantees. DurabilityLocal requires a journal,
+// see WithJournal. The default is DurabilityLocal when a journal is configured
+// and DurabilityNone otherwise.
+func WithDurability(d Durability) Option {
+	return func(mgr *Manager) {
+		mgr.durability = d
+	}
+}
+
+// Durability returns what Sync guarantees.
+func (mgr *Manager) Durability() Durability {
+	return mgr.durability
+}
+
+// Sync makes the writes to a file that were not checkpointed yet durable, as
+// selected by the durability mode of the manager.
+func (mgr *Manager) Sync(ctx context.Context, filename string) error {
+	switch mgr.durability {
+	case DurabilityLocal:
+		return mgr.syncLocal(ctx, filename)
+	case DurabilityRemote:
+		return mgr.syncRemote(ctx, filename)
+	default:
+		return nil
+	}
+}
+
+// syncLocal flushes the journal of a file to disk.
+func (mgr *Manager) syncLocal(ctx context.Context, filename string) error {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state, ok := mgr.lookupFile(fileID)
+	if !ok {
+		return nil
+	}
+
+	// Keep the journal from being frozen while it is synced
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	if err := mgr.journal.Sync(fileID); err != nil {
+		mgr.log.Error("Failed to sync journal", "filename", filename, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// syncRemote commits the active layer of a file as a new version, and waits for
+// the checkpoints of the file started before to be committed as well.
+func (mgr *Manager) syncRemote(ctx context.Context, filename string) error {
+	state, err := mgr.freezeForSync(ctx, filename)
+	if err != nil || state == nil {
+		return err
+	}
+
+	state.mu.RLock()
+	seq := state.queued
+	state.mu.RUnlock()
+
+	if err := mgr.waitFlushed(ctx, state, seq); err != nil {
+		return fmt.Errorf("failed to commit active layer: %w", err)
+	}
+
+	return nil
+}
+
+// freezeForSync queues the active layer of a file to be committed, and returns
+// the in-memory state of the file, if it has one.
+func (mgr *Manager) freezeForSync(ctx context.Context, filename string) (*fileState, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state, ok := mgr.lookupFile(fileID)
+	if !ok {
+		return nil, nil
+	}
+
+	state.checkpointMu.Lock()
+	defer state.checkpointMu.Unlock()
+
+	tag, _, err := mgr.autoCheckpoint(ctx, filename, fileID, state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit active layer: %w", err)
+	}
+	if tag != "" {
+		mgr.log.Debug("Active layer frozen on sync", "filename", filename, "tag", tag)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+const (
+	defaultFetchGap         = 64 << 10 // bytes between two ranges of an object under which they are fetched together
+	defaultFetchConcurrency = 8        // range requests a read makes at the same time
+)
+
+// WithRangeFetch sets how reads fetch the committed chunks they need. Ranges of
+// the same layer object that are at most gap bytes apart are fetched with a
+// single range request, the bytes in between being thrown away, and at most
+// concurrency requests are made at the same time. A gap of 0 only merges
+// adjacent ranges, a concurrency of 1 makes requests one after the other.
+func WithRangeFetch(gap uint64, concurrency int) Option {
+	return func(mgr *Manager) {
+		mgr.fetchGap = gap
+		mgr.fetchConcurrency = max(concurrency, 1)
+	}
+}
+
+// fetch is a range [start, end) of a layer object that a read needs.
+type fetch struct {
+	key string
+	rng [2]uint64
+}
+
+// rangeRequest is a range [start, end) of a layer object requested from the
+// object store, which holds the ranges of one or more fetches.
+type rangeRequest struct {
+	key     string
+	rng     [2]uint64
+	fetches []int // indexes of the fetches it serves
+}
+
+// planFetches turns fetches into range requests, merging the ranges of the same
+// object that are at most gap bytes apart. Empty fetches need no request.
+func planFetches(fetches []fetch, gap uint64) []rangeRequest {
+	byKey := make(map[string][]int)
+	var keys []string
+	for i, f := range fetches {
+		if f.rng[0] >= f.rng[1] {
+			continue
+		}
+		if _, ok := byKey[f.key]; !ok {
+			keys = append(keys, f.key)
+		}
+		byKey[f.key] = append(byKey[f.key], i)
+	}
+
+	var requests []rangeRequest
+	for _, key := range keys {
+		indexes := byKey[key]
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return fetches[indexes[a]].rng[0] < fetches[indexes[b]].rng[0]
+		})
+
+		first := len(requests)
+		for _, i := range indexes {
+			rng := fetches[i].rng
+			if last := len(requests) - 1; last >= first && rng[0] <= requests[last].rng[1]+gap {
+				requests[last].rng[1] = max(requests[last].rng[1], rng[1])
+				requests[last].fetches = append(requests[last].fetches, i)
+				continue
+			}
+			requests = append(requests, rangeRequest{key: key, rng: rng, fetches: []int{i}})
+		}
+	}
+
+	return requests
+}
+
+// fetchAll returns the data of every fetch, in the same order, making the range
+// requests planned for them with at most concurrency of them at the same time.
+func fetchAll(ctx context.Context, store objectStore, fetches []fetch, gap uint64, concurrency int) ([][]byte, error) {
+	requests := planFetches(fetches, gap)
+
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]byte, len(fetches))
+	errs := make([]error, len(requests))
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(max(concurrency, 1), len(requests)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(requests) || fetchCtx.Err() != nil {
+					return
+				}
+
+				req := requests[i]
+				size := req.rng[1] - req.rng[0]
+				data, err := store.GetObject(fetchCtx, req.key, [2]uint64{req.rng[0], req.rng[1] - 1}) // object ranges are inclusive of the end
+				if err == nil && uint64(len(data)) != size {
+					err = fmt.Errorf("received incorrect number of bytes from object store: got %d, expected %d", len(data), size)
+				}
+				if err != nil {
+					errs[i] = fmt.Errorf("error retrieving data from object store: %w", err)
+					cancel()
+					return
+				}
+
+				// Each fetch belongs to a single request, so workers never write the
+				// same result
+				for _, f := range req.fetches {
+					rng := fetches[f].rng
+					results[f] = data[rng[0]-req.rng[0] : rng[1]-req.rng[0]]
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		if results[i] == nil {
+			results[i] = []byte{}
+		}
+	}
+
+	return results, nil
+}
+
+// fetchChunks returns the data of committed chunks, in the same order. Holes
+// and chunks of layers without an object have no data.
+func (mgr *Manager) fetchChunks(ctx context.Context, chunks []metadata.Chunk) ([][]byte, error) {
+	fetches := make([]fetch, len(chunks))
+	for i, c := range chunks {
+		if c.Zero {
+			continue
+		}
+
+		objectKey, err := mgr.chunkObjectKey(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if objectKey == "" {
+			continue
+		}
+
+		fetches[i] = fetch{key: objectKey, rng: c.LayerRange}
+	}
+
+	return fetchAll(ctx, mgr.objectStore, fetches, mgr.fetchGap, mgr.fetchConcurrency)
+}
+
+// chunkObjectKey returns the key of the object holding the bytes of a committed
+// chunk, which is the object of its layer unless the chunk says otherwise.
+func (mgr *Manager) chunkObjectKey(ctx context.Context, c metadata.Chunk) (string, error) {
+	if c.ObjectKey != "" {
+		return c.ObjectKey, nil
+	}
+
+	objectKey, err := mgr.metaStore.GetObjectKey(ctx, c.LayerID)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving object key: %w", err)
+	}
+
+	return objectKey, nil
+}
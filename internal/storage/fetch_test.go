@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	objectstore "github.com/vinimdocarmo/quackfs/internal/storage/object"
+)
+
+// slowStore is an object store whose objects are generated from their keys and
+// whose range requests take latency, like requests to S3 do.
+type slowStore struct {
+	latency  time.Duration
+	requests atomic.Int64
+	fail     string // key whose requests fail
+}
+
+func objectByte(key string, offset uint64) byte {
+	return key[0] + byte(offset%23)
+}
+
+func (s *slowStore) GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error) {
+	s.requests.Add(1)
+
+	select {
+	case <-time.After(s.latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if key == s.fail {
+		return nil, errors.New("injected failure")
+	}
+
+	data := make([]byte, dataRange[1]-dataRange[0]+1)
+	for i := range data {
+		data[i] = objectByte(key, dataRange[0]+uint64(i))
+	}
+	return data, nil
+}
+
+func (s *slowStore) PutObject(ctx context.Context, key string, data []byte) error {
+	return errors.New("read-only")
+}
+
+func (s *slowStore) PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error {
+	return errors.New("read-only")
+}
+
+func (s *slowStore) DeleteObject(ctx context.Context, key string) error {
+	return errors.New("read-only")
+}
+
+func (s *slowStore) ListObjects(ctx context.Context, prefix string) ([]objectstore.ObjectInfo, error) {
+	return nil, nil
+}
+
+func TestPlanFetches(t *testing.T) {
+	fetches := []fetch{
+		{key: "b", rng: [2]uint64{0, 10}},
+		{key: "a", rng: [2]uint64{100, 110}},
+		{key: "a", rng: [2]uint64{0, 10}},
+		{key: "a", rng: [2]uint64{10, 20}}, // adjacent
+		{key: "a", rng: [2]uint64{24, 30}}, // within the gap
+		{key: "a", rng: [2]uint64{5, 8}},   // inside another one
+		{key: "b", rng: [2]uint64{3, 3}},   // empty
+	}
+
+	assert.Equal(t, []rangeRequest{
+		{key: "b", rng: [2]uint64{0, 10}, fetches: []int{0}},
+		{key: "a", rng: [2]uint64{0, 30}, fetches: []int{2, 5, 3, 4}},
+		{key: "a", rng: [2]uint64{100, 110}, fetches: []int{1}},
+	}, planFetches(fetches, 4))
+
+	assert.Len(t, planFetches(fetches, 0), 4, "Only adjacent ranges should be merged without a gap")
+}
+
+func TestFetchAll(t *testing.T) {
+	ctx := context.Background()
+	store := &slowStore{latency: time.Millisecond}
+
+	var fetches []fetch
+	for i := range uint64(20) {
+		key := fmt.Sprintf("%c", 'a'+i%3)
+		fetches = append(fetches, fetch{key: key, rng: [2]uint64{i * 50, i*50 + 40}})
+	}
+	fetches = append(fetches, fetch{})
+
+	results, err := fetchAll(ctx, store, fetches, 0, 4)
+	require.NoError(t, err)
+	require.Len(t, results, len(fetches))
+	for i, f := range fetches {
+		expected := make([]byte, f.rng[1]-f.rng[0])
+		for j := range expected {
+			expected[j] = objectByte(f.key, f.rng[0]+uint64(j))
+		}
+		if f.key == "" {
+			expected = []byte{}
+		}
+		assert.Equal(t, expected, results[i], "fetch %d", i)
+	}
+
+	store.fail = "b"
+	_, err = fetchAll(ctx, store, fetches, 0, 4)
+	assert.ErrorContains(t, err, "injected failure")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = fetchAll(canceled, &slowStore{}, fetches, 0, 4)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// BenchmarkFetchDuckDBBlock reads a 256KiB DuckDB block made of 4KiB pages
+// written at different times, so that they are spread over several layers with
+// small gaps of overwritten bytes in between.
+func BenchmarkFetchDuckDBBlock(b *testing.B) {
+	const (
+		blockSize = 256 << 10
+		pageSize  = 4 << 10
+		layers    = 4
+	)
+
+	var fetches []fetch
+	for page := uint64(0); page < blockSize/pageSize; page++ {
+		key := fmt.Sprintf("%c-layer", 'a'+page%layers)
+		start := page * (pageSize + 512)
+		fetches = append(fetches, fetch{key: key, rng: [2]uint64{start, start + pageSize}})
+	}
+
+	ctx := context.Background()
+	store := &slowStore{latency: 2 * time.Millisecond}
+
+	b.Run("sequential", func(b *testing.B) {
+		store.requests.Store(0)
+		for range b.N {
+			for _, f := range fetches {
+				if _, err := store.GetObject(ctx, f.key, [2]uint64{f.rng[0], f.rng[1] - 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(store.requests.Load())/float64(b.N), "requests/op")
+	})
+
+	b.Run("coalesced", func(b *testing.B) {
+		store.requests.Store(0)
+		for range b.N {
+			if _, err := fetchAll(ctx, store, fetches, defaultFetchGap, defaultFetchConcurrency); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(store.requests.Load())/float64(b.N), "requests/op")
+	})
+
+	b.Run("parallel", func(b *testing.B) {
+		store.requests.Store(0)
+		for range b.N {
+			if _, err := fetchAll(ctx, store, fetches, 0, defaultFetchConcurrency); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(store.requests.Load())/float64(b.N), "requests/op")
+	})
+}
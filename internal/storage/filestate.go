@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// fileState holds the layers of a file that live in memory: the active layer,
+// which takes the writes, and the layers frozen by checkpoints, which are read
+// from memory until a background goroutine has committed them.
+//
+// Operations on a single file hold mgr.mu for reading and then the locks of the
+// file, so that files never wait on each other. Operations that span files hold
+// mgr.mu for writing instead, which excludes every other operation.
+type fileState struct {
+	checkpointMu sync.Mutex      // serializes checkpoints of the file, taken before mu
+	mu           sync.RWMutex    // guards everything below but autoTag
+	active       *metadata.Layer // writes made since the last checkpoint started, nil if none
+	flushing     []*flush        // layers frozen by checkpoints, oldest first, committed in that order
+	autoTag      string          // tag of the last automatic checkpoint, guarded by checkpointMu
+
+	flusher   bool             // whether a goroutine is committing the flushing layers
+	queued    uint64           // sequence number of the last checkpoint started
+	committed uint64           // sequence number of the last checkpoint committed
+	failures  int              // failed attempts to commit the oldest flushing layer
+	lastErr   error            // error of the last failed attempt, nil once one succeeds
+	changed   chan struct{}    // closed and replaced whenever an attempt ends
+	forgotten bool             // the file was deleted, its flushing layers are dropped
+	rejected  map[uint64]error // errors of checkpoints committed under another tag, by sequence number
+}
+
+// flush is a layer frozen by a checkpoint, waiting to be committed.
+type flush struct {
+	seq        uint64
+	filename   string
+	layer      *metadata.Layer
+	tag        string // may be replaced by a later checkpoint until the flush is done
+	versionID  uint64 // version the layer was committed as, 0 until it is
+	versionTag string // tag the version was last committed with
+	err        error  // why the version could not get the tag it was given, nil if it could
+}
+
+// activeLayer returns the active layer of the file, creating it if needed.
+// state.mu must be held for writing.
+func (state *fileState) activeLayer(fileID uint64) *metadata.Layer {
+	if state.active == nil {
+		state.active = &metadata.Layer{
+			FileID:    fileID,
+			Chunks:    []metadata.Chunk{},
+			Data:      []byte{},
+			Active:    true,
+			CreatedAt: time.Now(),
+		}
+	}
+	return state.active
+}
+
+// layers returns the layers of the file held in memory, oldest first. state.mu
+// must be held.
+func (state *fileState) layers() []*metadata.Layer {
+	var layers []*metadata.Layer
+	for _, f := range state.flushing {
+		layers = append(layers, f.layer)
+	}
+	if state.active != nil {
+		layers = append(layers, state.active)
+	}
+	return layers
+}
+
+// hasData reports whether the file has writes that are not committed yet.
+// state.mu must be held.
+func (state *fileState) hasData() bool {
+	for _, layer := range state.layers() {
+		if layer.Changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// notify wakes up everyone waiting for the flushing layers to change. state.mu
+// must be held for writing.
+func (state *fileState) notify() {
+	close(state.changed)
+	state.changed = make(chan struct{})
+}
+
+// file returns the in-memory state of a file, creating it if needed.
+func (mgr *Manager) file(fileID uint64) *fileState {
+	mgr.memtableMu.Lock()
+	defer mgr.memtableMu.Unlock()
+
+	state, ok := mgr.memtable[fileID]
+	if !ok {
+		state = &fileState{changed: make(chan struct{})}
+		mgr.memtable[fileID] = state
+	}
+	return state
+}
+
+// lookupFile returns the in-memory state of a file, if it has one.
+func (mgr *Manager) lookupFile(fileID uint64) (*fileState, bool) {
+	mgr.memtableMu.Lock()
+	defer mgr.memtableMu.Unlock()
+
+	state, ok := mgr.memtable[fileID]
+	return state, ok
+}
+
+// files returns the in-memory state of every file that has one.
+func (mgr *Manager) files() map[uint64]*fileState {
+	mgr.memtableMu.Lock()
+	defer mgr.memtableMu.Unlock()
+
+	files := make(map[uint64]*fileState, len(mgr.memtable))
+	for fileID, state := range mgr.memtable {
+		files[fileID] = state
+	}
+	return files
+}
+
+// forgetFile drops the layers of a deleted file held in memory, together with
+// their spill files and journal. Checkpoints of the file that are not committed
+// yet are given up. mgr.mu must be held for writing.
+func (mgr *Manager) forgetFile(fileID uint64) {
+	mgr.memtableMu.Lock()
+	state, ok := mgr.memtable[fileID]
+	delete(mgr.memtable, fileID)
+	mgr.memtableMu.Unlock()
+
+	if ok {
+		state.mu.Lock()
+		for _, layer := range state.layers() {
+			if err := layer.Release(); err != nil {
+				mgr.log.Warn("Failed to remove spill file", "fileID", fileID, "error", err)
+			}
+		}
+		state.active = nil
+		state.flushing = nil
+		state.forgotten = true
+		state.notify()
+		state.mu.Unlock()
+	}
+
+	if mgr.journal != nil {
+		if err := mgr.journal.Remove(fileID); err != nil {
+			mgr.log.Warn("Failed to remove journal", "fileID", fileID, "error", err)
+		}
+	}
+}
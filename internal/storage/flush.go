@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+const (
+	checkpointRetries    = 5                      // failed attempts after which waiting for a checkpoint fails
+	checkpointBackoff    = 100 * time.Millisecond // delay before retrying a failed checkpoint
+	maxCheckpointBackoff = 30 * time.Second       // the delay doubles after each failure up to this
+)
+
+// enqueue queues a layer frozen by a checkpoint to be committed with the given
+// tag, after the layers queued before it, and starts committing them in the
+// background if needed. It returns the sequence number of the checkpoint.
+// state.mu must be held for writing.
+func (mgr *Manager) enqueue(ctx context.Context, filename string, fileID uint64, state *fileState, layer *metadata.Layer, tag string) uint64 {
+	state.queued++
+	state.flushing = append(state.flushing, &flush{
+		seq:      state.queued,
+		filename: filename,
+		layer:    layer,
+		tag:      tag,
+	})
+
+	if !state.flusher {
+		state.flusher = true
+		go mgr.runFlusher(context.WithoutCancel(ctx), fileID, state)
+	}
+
+	return state.queued
+}
+
+// failing returns the error of the oldest flushing layer of the file once it
+// failed to be committed too many times in a row. state.mu must be held.
+func (state *fileState) failing() error {
+	if state.failures < checkpointRetries {
+		return nil
+	}
+	return fmt.Errorf("checkpoint failed %d times, still retrying: %w", state.failures, state.lastErr)
+}
+
+// runFlusher commits the flushing layers of a file one after the other, oldest
+// first, until there are none left. A failed commit is retried with a growing
+// delay until it succeeds or the file is deleted; the layer stays readable from
+// memory meanwhile, and later checkpoints of the file wait behind it. Errors
+// that retrying can't fix are not retried: a layer whose tag is taken is
+// committed under another tag, and the checkpoints of a file deleted by another
+// process are given up. A layer is only done once the journal of its writes is
+// removed too, so that a crash never replays them on top of the layers
+// committed after it.
+func (mgr *Manager) runFlusher(ctx context.Context, fileID uint64, state *fileState) {
+	backoff := checkpointBackoff
+
+	for {
+		state.mu.Lock()
+		if state.forgotten || len(state.flushing) == 0 {
+			state.flusher = false
+			state.mu.Unlock()
+			return
+		}
+		f := state.flushing[0]
+		tag, versionID, versionTag := f.tag, f.versionID, f.versionTag
+		state.mu.Unlock()
+
+		var err error
+		switch {
+		case versionID == 0:
+			// Only the latest bytes of each range of the file are uploaded, with no
+			// lock held: cross-file operations don't wait for it. A layer without
+			// data, like a restored version, has nothing to upload. A failed commit
+			// uploads again, the garbage collector only spares an object that is not
+			// referenced yet for a grace period.
+			start := time.Now()
+			chunks, data, size := f.layer.Coalesce()
+			var objectKey string
+			if size > 0 {
+				objectKey, err = mgr.uploadLayer(ctx, f.filename, fileID, data)
+			}
+			if err == nil {
+				versionID, err = mgr.commitFlushed(ctx, fileID, state, chunks, objectKey, tag)
+			}
+			if err == nil && versionID != 0 {
+				written := f.layer.DataSize()
+				mgr.log.Info("Checkpoint committed", "filename", f.filename, "tag", tag,
+					"size", humanize.Bytes(size), "written", humanize.Bytes(written), "saved", humanize.Bytes(written-size),
+					"chunks", len(chunks), "writes", len(f.layer.Chunks), "took", time.Since(start).Round(time.Millisecond))
+			}
+		case tag != versionTag:
+			// A later checkpoint gave the version another tag while it was committed
+			mgr.mu.RLock()
+			err = mgr.tagVersion(ctx, versionID, tag)
+			mgr.mu.RUnlock()
+		}
+
+		// Only transient errors are retried. A file deleted by another process
+		// can't get new versions anymore, so its checkpoints are given up.
+		if errors.Is(err, types.ErrNotFound) && mgr.deletedElsewhere(ctx, fileID) {
+			mgr.log.Warn("File was deleted, dropping its checkpoints", "filename", f.filename, "error", err)
+			mgr.metaStore.Invalidate()
+			mgr.mu.Lock()
+			mgr.forgetFile(fileID)
+			mgr.mu.Unlock()
+			continue
+		}
+
+		state.mu.Lock()
+		if err == nil {
+			f.versionID, f.versionTag = versionID, tag
+			if f.tag == tag && !state.forgotten {
+				err = mgr.doneFlushing(fileID, state, f)
+			}
+		}
+		if errors.Is(err, types.ErrAlreadyExists) && f.tag == tag {
+			// The tag is taken, the version keeps the tag it was committed with, or
+			// gets a generated one, so that its writes are not lost. The checkpoint
+			// fails with the error once the version is committed.
+			f.err = err
+			f.tag = f.versionTag
+			if f.versionID == 0 {
+				f.tag = fmt.Sprintf("%s%s", autoTagPrefix, uuid.New().String())
+			}
+			state.mu.Unlock()
+
+			mgr.log.Error("Failed to tag checkpoint, committing it under another tag", "filename", f.filename, "tag", tag, "newTag", f.tag, "error", err)
+			continue
+		}
+		if err != nil {
+			state.failures++
+			state.lastErr = err
+			failures := state.failures
+			state.notify()
+			state.mu.Unlock()
+
+			mgr.log.Error("Failed to commit checkpoint", "filename", f.filename, "tag", tag, "attempt", failures, "retryIn", backoff, "error", err)
+
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxCheckpointBackoff)
+			continue
+		}
+
+		backoff = checkpointBackoff
+		state.failures = 0
+		state.lastErr = nil
+
+		state.notify()
+		state.mu.Unlock()
+	}
+}
+
+// doneFlushing removes the oldest flushing layer of a file once it is committed
+// with its final tag. Its frozen journal goes first: replayed after a crash, it
+// would undo the checkpoints committed after this one, so the layer stays
+// flushing until the journal is gone. state.mu must be held for writing.
+func (mgr *Manager) doneFlushing(fileID uint64, state *fileState, f *flush) error {
+	if mgr.journal != nil {
+		if err := mgr.journal.RemoveFrozen(fileID, f.seq); err != nil {
+			return fmt.Errorf("failed to remove journal of committed checkpoint: %w", err)
+		}
+	}
+
+	state.flushing = state.flushing[1:]
+	state.committed = f.seq
+
+	if f.err != nil {
+		if state.rejected == nil {
+			state.rejected = make(map[uint64]error)
+		}
+		state.rejected[f.seq] = fmt.Errorf("checkpoint committed as version %q instead: %w", f.tag, f.err)
+	}
+
+	if err := f.layer.Release(); err != nil {
+		mgr.log.Warn("Failed to remove spill file", "filename", f.filename, "error", err)
+	}
+
+	return nil
+}
+
+// deletedElsewhere reports whether a file no longer exists in the database,
+// deleted by another process.
+func (mgr *Manager) deletedElsewhere(ctx context.Context, fileID uint64) bool {
+	exists, err := mgr.metaStore.FileExists(ctx, fileID)
+	return err == nil && !exists
+}
+
+// commitFlushed commits the metadata of a flushing layer of a file, unless the
+// file was deleted during the upload, in which case it returns 0. Cross-file
+// operations like promotions and compactions hold mgr.mu, they don't expect new
+// layers to show up while they run.
+func (mgr *Manager) commitFlushed(ctx context.Context, fileID uint64, state *fileState, chunks []metadata.Chunk, objectKey string, tag string) (uint64, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	state.mu.RLock()
+	forgotten := state.forgotten
+	state.mu.RUnlock()
+	if forgotten {
+		return 0, nil
+	}
+
+	return mgr.commitLayer(ctx, fileID, chunks, objectKey, tag)
+}
+
+// waitFlushed waits until the checkpoint of a file with the given sequence
+// number is committed. It gives up once the commit failed too many times in a
+// row, while it keeps being retried in the background, and fails if the
+// checkpoint could not be committed with the tag it was given.
+func (mgr *Manager) waitFlushed(ctx context.Context, state *fileState, seq uint64) error {
+	for {
+		state.mu.RLock()
+		committed, forgotten, changed := state.committed, state.forgotten, state.changed
+		rejected := state.rejected[seq]
+		err := state.failing()
+		state.mu.RUnlock()
+
+		if committed >= seq {
+			return rejected
+		}
+		if forgotten {
+			return fmt.Errorf("file was deleted before its checkpoint was committed: %w", types.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Flush waits until every checkpoint of a file started so far is committed.
+func (mgr *Manager) Flush(ctx context.Context, filename string) error {
+	mgr.mu.RLock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.mu.RUnlock()
+		if err == types.ErrNotFound {
+			return nil
+		}
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state, ok := mgr.lookupFile(fileID)
+	mgr.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	state.mu.RLock()
+	seq := state.queued
+	state.mu.RUnlock()
+
+	return mgr.waitFlushed(ctx, state, seq)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// VersionInfo describes a committed layer of a file.
+type VersionInfo struct {
+	LayerID       uint64    `json:"layerId"`
+	VersionID     uint64    `json:"versionId"`
+	Tag           string    `json:"tag"`
+	CreatedAt     time.Time `json:"createdAt"`
+	ObjectKey     string    `json:"objectKey"`
+	Chunks        int       `json:"chunks"`        // chunks written in the layer
+	Bytes         uint64    `json:"bytes"`         // bytes stored in the layer
+	VisibleBytes  uint64    `json:"visibleBytes"`  // bytes of the layer not overwritten by later layers
+	CompactedInto uint64    `json:"compactedInto"` // layer holding the data of this version after compaction, 0 if none
+}
+
+// History returns every committed layer of a file, from the oldest to the newest.
+func (mgr *Manager) History(ctx context.Context, filename string) ([]VersionInfo, error) {
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	layers, err := mgr.metaStore.LoadLayersByFileID(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	history := make([]VersionInfo, len(layers))
+	index := make(map[uint64]int, len(layers))
+
+	var chunks []metadata.Chunk
+	for i, layer := range layers {
+		layerChunks, err := mgr.metaStore.GetLayerChunks(ctx, layer.ID)
+		if err != nil {
+			mgr.log.Error("Failed to load layer chunks", "layerID", layer.ID, "error", err)
+			return nil, fmt.Errorf("failed to load layer chunks: %w", err)
+		}
+
+		history[i] = VersionInfo{
+			LayerID:       layer.ID,
+			VersionID:     layer.VersionID,
+			Tag:           layer.Tag,
+			CreatedAt:     layer.CreatedAt,
+			ObjectKey:     layer.ObjectKey,
+			Chunks:        len(layerChunks),
+			CompactedInto: layer.CompactedInto,
+		}
+		for _, c := range layerChunks {
+			history[i].Bytes += c.LayerRange[1] - c.LayerRange[0]
+		}
+
+		index[layer.ID] = i
+		chunks = append(chunks, layerChunks...)
+	}
+
+	for _, extent := range metadata.Resolve(chunks) {
+		history[index[extent.Chunk.LayerID]].VisibleBytes += extent.FileRange[1] - extent.FileRange[0]
+	}
+
+	return history, nil
+}
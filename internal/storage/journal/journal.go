@@ -0,0 +1,482 @@
+// Package journal keeps a durable local copy of the writes held in the active
+// layers of the storage manager, so that they survive a crash of the process
+// before they are checkpointed.
+//
+// Each file has a journal of its own, named after its ID, made of records that
+// are only ever appended:
+//
+//	crc32 (4 bytes) | offset (8 bytes) | length (4 bytes) | data (length bytes)
+//
+// The checksum covers the offset, the length and the data, so a record that was
+// only partially written when the process died is detected and dropped. A record
+// with the highest bit of its length set punches a hole instead: its data is the
+// length of the hole, as 8 bytes. A record without data extends the file up to
+// its offset.
+//
+// When the writes of a file are checkpointed, its journal is frozen: the records
+// it holds are set aside under the sequence number of the checkpoint and new ones
+// go to a fresh journal, so that the frozen records can be dropped once they are
+// committed without losing the writes made in the meantime. Several checkpoints
+// of a file can be waiting to be committed, each with frozen records of its own.
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	headerSize = 16
+	holeFlag   = 1 << 31
+	extension  = ".journal"
+	frozen     = ".frozen" + extension
+)
+
+// Record is a write recorded in a journal.
+type Record struct {
+	Offset uint64
+	Data   []byte
+	Hole   uint64 // length of a hole punched at Offset, in which case Data is empty
+}
+
+// Extends reports whether the record extends the file up to Offset rather than
+// writing to it.
+func (r Record) Extends() bool {
+	return len(r.Data) == 0 && r.Hole == 0
+}
+
+// ErrLocked is returned by Open when another process uses the journals.
+var ErrLocked = errors.New("journal is used by another process")
+
+// Journal is a set of per-file write journals stored in a local directory.
+type Journal struct {
+	dir   string
+	lock  *os.File // holds the lock on dir for as long as the journal is open
+	mu    sync.Mutex
+	files map[uint64]*os.File
+}
+
+// Open opens the journals in dir, creating the directory if needed. The
+// journals are named after file IDs, which only mean something to the
+// metadata database they come from, so a process locks the directory while it
+// uses it, and Open fails with ErrLocked if another process does.
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	// The lock lives next to the directory so that only journals live in it
+	lock, err := os.OpenFile(filepath.Clean(dir)+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal lock: %w", err)
+	}
+
+	// A POSIX record lock belongs to the process, so reopening the journal in the
+	// same process, like after a simulated crash, doesn't lock itself out
+	flock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	if err := syscall.FcntlFlock(lock.Fd(), syscall.F_SETLK, &flock); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+			return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+		}
+		return nil, fmt.Errorf("failed to lock journal: %w", err)
+	}
+
+	return &Journal{
+		dir:   dir,
+		lock:  lock,
+		files: make(map[uint64]*os.File),
+	}, nil
+}
+
+func (j *Journal) path(fileID uint64) string {
+	return filepath.Join(j.dir, strconv.FormatUint(fileID, 10)+extension)
+}
+
+func (j *Journal) frozenPath(fileID uint64, seq uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%d.%d%s", fileID, seq, frozen))
+}
+
+// frozenPaths returns the frozen records of a file, oldest first.
+func (j *Journal) frozenPaths(fileID uint64) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(j.dir, fmt.Sprintf("%d.*%s", fileID, frozen)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list frozen journals: %w", err)
+	}
+
+	seqs := make(map[string]uint64, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), frozen)
+		_, seq, _ := strings.Cut(name, ".")
+		seqs[path], _ = strconv.ParseUint(seq, 10, 64)
+	}
+	sort.Slice(paths, func(a, b int) bool { return seqs[paths[a]] < seqs[paths[b]] })
+
+	return paths, nil
+}
+
+// file returns the open journal of a file, creating it if needed. j.mu must be held.
+func (j *Journal) file(fileID uint64) (*os.File, error) {
+	if f, ok := j.files[fileID]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(j.path(fileID), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.files[fileID] = f
+
+	return f, nil
+}
+
+// Append records a write of data at offset in a file. The record reaches the
+// operating system before Append returns, so it survives a crash of the
+// process, but it is only durable on disk once the journal is synced.
+func (j *Journal) Append(fileID uint64, offset uint64, data []byte) error {
+	if uint64(len(data)) >= holeFlag {
+		return fmt.Errorf("write of %d bytes is too large for a journal record", len(data))
+	}
+
+	return j.append(fileID, offset, uint32(len(data)), data)
+}
+
+// AppendHole records a hole of length bytes punched at offset in a file, like
+// Append.
+func (j *Journal) AppendHole(fileID uint64, offset uint64, length uint64) error {
+	return j.append(fileID, offset, 8|holeFlag, binary.LittleEndian.AppendUint64(nil, length))
+}
+
+// AppendExtension records that a file was extended up to size bytes, like
+// Append.
+func (j *Journal) AppendExtension(fileID uint64, size uint64) error {
+	return j.append(fileID, size, 0, nil)
+}
+
+func (j *Journal) append(fileID uint64, offset uint64, length uint32, data []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := j.file(fileID)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint64(record[4:12], offset)
+	binary.LittleEndian.PutUint32(record[12:16], length)
+	copy(record[headerSize:], data)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+
+	if _, err := f.Write(record); err != nil {
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+
+	return nil
+}
+
+// Sync flushes the journal of a file to disk. Frozen records are flushed when
+// they are frozen. It must not run concurrently with Freeze, Discard or Remove
+// for the same file.
+func (j *Journal) Sync(fileID uint64) error {
+	j.mu.Lock()
+	f, ok := j.files[fileID]
+	j.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+
+	return nil
+}
+
+// Remove deletes the journal of a file, frozen records included, once its
+// writes are committed elsewhere or no longer wanted.
+func (j *Journal) Remove(fileID uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.close(fileID); err != nil {
+		return err
+	}
+
+	paths, err := j.frozenPaths(fileID)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range append(paths, j.path(fileID)) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove journal: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Discard deletes the records of a file that are not frozen, when the writes
+// they hold are overwritten before being checkpointed.
+func (j *Journal) Discard(fileID uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.close(fileID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(j.path(fileID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to discard journal: %w", err)
+	}
+
+	return nil
+}
+
+// Freeze sets the records of a file aside under the sequence number of the
+// checkpoint committing them, after flushing them to disk. Later appends go to
+// a new journal.
+func (j *Journal) Freeze(fileID uint64, seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := os.Stat(j.frozenPath(fileID, seq)); err == nil {
+		return fmt.Errorf("journal of file %d is already frozen as %d", fileID, seq)
+	}
+
+	if f, ok := j.files[fileID]; ok {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync journal: %w", err)
+		}
+	}
+
+	if err := j.close(fileID); err != nil {
+		return err
+	}
+
+	if err := os.Rename(j.path(fileID), j.frozenPath(fileID, seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to freeze journal: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveFrozen deletes the records of a file frozen under a sequence number once
+// they are committed.
+func (j *Journal) RemoveFrozen(fileID uint64, seq uint64) error {
+	if err := os.Remove(j.frozenPath(fileID, seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove frozen journal: %w", err)
+	}
+
+	return nil
+}
+
+// thaw puts the frozen records of a file, left by a crash before their
+// checkpoints were committed, back in front of the records appended since. j.mu
+// must be held.
+func (j *Journal) thaw(fileID uint64) error {
+	paths, err := j.frozenPaths(fileID)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+
+	if err := j.close(fileID); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open frozen journal: %w", err)
+	}
+	defer dst.Close()
+
+	for _, path := range append(paths[1:], j.path(fileID)) {
+		src, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open journal: %w", err)
+		}
+
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			return fmt.Errorf("failed to thaw journal: %w", err)
+		}
+	}
+
+	if err := dst.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+
+	for _, path := range paths[1:] {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to thaw journal: %w", err)
+		}
+	}
+
+	if err := os.Rename(paths[0], j.path(fileID)); err != nil {
+		return fmt.Errorf("failed to thaw journal: %w", err)
+	}
+
+	return nil
+}
+
+// close closes the open journal of a file, if any. j.mu must be held.
+func (j *Journal) close(fileID uint64) error {
+	f, ok := j.files[fileID]
+	if !ok {
+		return nil
+	}
+
+	delete(j.files, fileID)
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close journal: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the journals without removing them, and releases the lock on
+// their directory.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var errs []error
+	for fileID, f := range j.files {
+		delete(j.files, fileID)
+		errs = append(errs, f.Close())
+	}
+	errs = append(errs, j.lock.Close())
+
+	return errors.Join(errs...)
+}
+
+// Replay calls fn with every record of the journals, in the order they
+// were appended, one file after the other in ascending file ID order. Frozen
+// records, left by a crash in the middle of a checkpoint, are thawed first. A
+// torn or corrupt record at the end of a journal, left by a crash in the middle
+// of an append, is cut off together with anything after it. Replay returns the
+// number of bytes that were cut off.
+func (j *Journal) Replay(fn func(fileID uint64, r Record) error) (uint64, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read journal directory: %w", err)
+	}
+
+	seen := make(map[uint64]bool)
+	var fileIDs []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), extension)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, _, _ := strings.Cut(name, ".")
+		fileID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil || seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Slice(fileIDs, func(a, b int) bool { return fileIDs[a] < fileIDs[b] })
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var dropped uint64
+	for _, fileID := range fileIDs {
+		if err := j.thaw(fileID); err != nil {
+			return dropped, err
+		}
+
+		f, err := j.file(fileID)
+		if err != nil {
+			return dropped, err
+		}
+
+		n, err := replayFile(f, func(r Record) error {
+			return fn(fileID, r)
+		})
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+
+	return dropped, nil
+}
+
+// replayFile calls fn with every valid record of f and truncates f after the
+// last one.
+func replayFile(f *os.File, fn func(r Record) error) (uint64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat journal: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek journal: %w", err)
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	var valid int64
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+
+		offset := binary.LittleEndian.Uint64(header[4:12])
+		length := binary.LittleEndian.Uint32(header[12:16])
+		hole := length&holeFlag != 0
+		length &^= holeFlag
+		if valid+headerSize+int64(length) > info.Size() || (hole && length != 8) {
+			break
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		crc := crc32.ChecksumIEEE(header[4:])
+		crc = crc32.Update(crc, crc32.IEEETable, data)
+		if crc != binary.LittleEndian.Uint32(header[0:4]) {
+			break
+		}
+
+		r := Record{Offset: offset, Data: data}
+		if hole {
+			r = Record{Offset: offset, Hole: binary.LittleEndian.Uint64(data)}
+		}
+		if err := fn(r); err != nil {
+			return 0, err
+		}
+		valid += headerSize + int64(length)
+	}
+
+	if valid < info.Size() {
+		if err := f.Truncate(valid); err != nil {
+			return 0, fmt.Errorf("failed to truncate journal: %w", err)
+		}
+	}
+
+	return uint64(info.Size() - valid), nil
+}
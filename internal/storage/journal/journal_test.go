@@ -0,0 +1,262 @@
+package journal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type write struct {
+	fileID uint64
+	offset uint64
+	data   string
+}
+
+func replayAll(t *testing.T, j *Journal) ([]write, uint64) {
+	var writes []write
+	dropped, err := j.Replay(func(fileID uint64, r Record) error {
+		if r.Hole > 0 {
+			writes = append(writes, write{fileID, r.Offset, fmt.Sprintf("hole of %d", r.Hole)})
+			return nil
+		}
+		if r.Extends() {
+			writes = append(writes, write{fileID, r.Offset, "extension"})
+			return nil
+		}
+		writes = append(writes, write{fileID, r.Offset, string(r.Data)})
+		return nil
+	})
+	require.NoError(t, err)
+	return writes, dropped
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Append(2, 0, []byte("hello")))
+	require.NoError(t, j.Append(1, 10, []byte("world")))
+	require.NoError(t, j.Append(2, 3, []byte("p!")))
+	require.NoError(t, j.AppendExtension(2, 5))
+	require.NoError(t, j.AppendHole(2, 1, 3))
+	require.NoError(t, j.Sync(2))
+	require.NoError(t, j.Close())
+
+	j, err = Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	writes, dropped := replayAll(t, j)
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, []write{
+		{1, 10, "world"},
+		{2, 0, "hello"},
+		{2, 3, "p!"},
+		{2, 5, "extension"},
+		{2, 1, "hole of 3"},
+	}, writes)
+
+	// Writes after a replay go after the replayed records
+	require.NoError(t, j.Append(1, 0, []byte("again")))
+	writes, _ = replayAll(t, j)
+	assert.Equal(t, write{1, 0, "again"}, writes[1])
+}
+
+func TestReplayTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Append(1, 0, []byte("first")))
+	require.NoError(t, j.Append(1, 5, []byte("second")))
+	require.NoError(t, j.Close())
+
+	// The process died halfway through the last record
+	path := filepath.Join(dir, "1.journal")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	j, err = Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	writes, dropped := replayAll(t, j)
+	assert.Equal(t, []write{{1, 0, "first"}}, writes)
+	assert.Equal(t, uint64(headerSize+6-3), dropped)
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(headerSize+5), info.Size(), "Torn record should be cut off")
+
+	// A record appended after the cut is replayed
+	require.NoError(t, j.Append(1, 5, []byte("third")))
+	writes, dropped = replayAll(t, j)
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, []write{{1, 0, "first"}, {1, 5, "third"}}, writes)
+}
+
+func TestReplayCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, j.Append(1, 0, []byte("first")))
+	require.NoError(t, j.Append(1, 5, []byte("second")))
+	require.NoError(t, j.Close())
+
+	path := filepath.Join(dir, "1.journal")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	content[len(content)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	j, err = Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	writes, _ := replayAll(t, j)
+	assert.Equal(t, []write{{1, 0, "first"}}, writes)
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	require.NoError(t, j.Append(1, 0, []byte("one")))
+	require.NoError(t, j.Append(2, 0, []byte("two")))
+	require.NoError(t, j.Remove(1))
+	require.NoError(t, j.Remove(3), "Removing a missing journal should not fail")
+
+	writes, _ := replayAll(t, j)
+	assert.Equal(t, []write{{2, 0, "two"}}, writes)
+
+	_, err = os.Stat(filepath.Join(dir, "1.journal"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFreeze(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	require.NoError(t, j.Append(1, 0, []byte("first")))
+	require.NoError(t, j.Freeze(1, 1))
+	require.NoError(t, j.Append(1, 5, []byte("second")))
+	require.NoError(t, j.Freeze(1, 2))
+	assert.Error(t, j.Freeze(1, 2), "A journal cannot be frozen twice under the same number")
+	require.NoError(t, j.Append(1, 11, []byte("new")))
+
+	// The first checkpoint committed, the records frozen after it are kept
+	require.NoError(t, j.RemoveFrozen(1, 1))
+	writes, _ := replayAll(t, j)
+	assert.Equal(t, []write{{1, 5, "second"}, {1, 11, "new"}}, writes)
+}
+
+func TestDiscard(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	require.NoError(t, j.Append(1, 0, []byte("frozen")))
+	require.NoError(t, j.Freeze(1, 1))
+	require.NoError(t, j.Append(1, 6, []byte("discarded")))
+	require.NoError(t, j.Discard(1))
+	require.NoError(t, j.Append(1, 6, []byte("kept")))
+
+	writes, _ := replayAll(t, j)
+	assert.Equal(t, []write{{1, 0, "frozen"}, {1, 6, "kept"}}, writes)
+}
+
+func TestReplayFrozen(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	require.NoError(t, err)
+
+	// The process died while two checkpoints were being committed
+	require.NoError(t, j.Append(1, 0, []byte("first")))
+	require.NoError(t, j.Freeze(1, 9))
+	require.NoError(t, j.Append(1, 5, []byte("second")))
+	require.NoError(t, j.Freeze(1, 10))
+	require.NoError(t, j.Append(1, 11, []byte("new")))
+	require.NoError(t, j.Close())
+
+	j, err = Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+
+	writes, _ := replayAll(t, j)
+	assert.Equal(t, []write{{1, 0, "first"}, {1, 5, "second"}, {1, 11, "new"}}, writes)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Frozen records should be thawed")
+	assert.Equal(t, "1.journal", entries[0].Name())
+}
+
+func TestOpenLocked(t *testing.T) {
+	// Locks belong to the process, so the journal is held by a copy of the test
+	// binary that runs this test with the environment variable set
+	if dir := os.Getenv("JOURNAL_LOCK_DIR"); dir != "" {
+		j, err := Open(dir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		io.ReadAll(os.Stdin) // hold the lock until the parent closes stdin
+		j.Close()
+		os.Exit(0)
+	}
+
+	dir := filepath.Join(t.TempDir(), "journal")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestOpenLocked$")
+	cmd.Env = append(os.Environ(), "JOURNAL_LOCK_DIR="+dir)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "locked\n", line)
+
+	_, err = Open(dir)
+	assert.ErrorIs(t, err, ErrLocked, "A journal should not be shared by two processes")
+
+	require.NoError(t, stdin.Close())
+	require.NoError(t, cmd.Wait())
+
+	j, err := Open(dir)
+	require.NoError(t, err, "The journal should be free once the other process closed it")
+	require.NoError(t, j.Close())
+
+	// Reopening in the same process, as after a simulated crash, is allowed
+	j, err = Open(dir)
+	require.NoError(t, err)
+	defer j.Close()
+	other, err := Open(dir)
+	require.NoError(t, err)
+	defer other.Close()
+}
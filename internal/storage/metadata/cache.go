@@ -0,0 +1,205 @@
+package metadata
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	cachedFiles = 256  // extent maps of files kept in memory
+	cachedNames = 4096 // IDs and generations of files kept in memory
+
+	// maxStaleness bounds how long a change made by another process can go
+	// unnoticed: the IDs and generations of files read from the database are
+	// trusted for that long, so that hot reads don't query the database at all.
+	// A stale extent map only points at objects the garbage collector keeps for
+	// much longer than this. Changes made through this process invalidate them
+	// right away.
+	maxStaleness = time.Second
+)
+
+// fileKey identifies the extent map of a file as of a version, versionedLayerID
+// being 0 for the latest committed state.
+type fileKey struct {
+	fileID           uint64
+	versionedLayerID uint64
+}
+
+// fileExtents is the extent map of a file as it was at a generation of the file.
+type fileExtents struct {
+	generation int64
+	extents    []Extent
+}
+
+// checked is a value read from the database, with the time it was read at.
+type checked[V any] struct {
+	value V
+	at    time.Time
+}
+
+// cache keeps the extent maps of the committed state of files in memory, so
+// that reads of a file don't query and resolve all of its chunks every time.
+// Layers are changed by other processes too, like op compact or retention, so
+// an extent map is only used while the generation of its file in the database,
+// which is bumped whenever a layer of the file changes, is the one it was read
+// at. Generations, like the IDs of files, are themselves read again once they
+// are older than maxStaleness, or once this process changed files.
+type cache struct {
+	mu          sync.Mutex
+	files       *lru[fileKey, fileExtents]
+	ids         *lru[string, checked[uint64]] // IDs of files by name
+	generations *lru[uint64, checked[int64]]  // generations of files by ID
+	epoch       uint64                        // bumped by invalidate
+	now         func() time.Time
+}
+
+func newCache() *cache {
+	return &cache{
+		files:       newLRU[fileKey, fileExtents](cachedFiles),
+		ids:         newLRU[string, checked[uint64]](cachedNames),
+		generations: newLRU[uint64, checked[int64]](cachedNames),
+		now:         time.Now,
+	}
+}
+
+// begin returns the epoch and the time a read of the database starts at, to
+// cache what it reads with.
+func (c *cache) begin() (uint64, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.epoch, c.now()
+}
+
+// fileID returns the ID of the file named name, if it was read recently enough.
+func (c *cache) fileID(name string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.ids.get(name)
+	if !ok || c.now().Sub(cached.at) >= maxStaleness {
+		return 0, false
+	}
+	return cached.value, true
+}
+
+// setFileID caches the ID of a file read by a read that started at epoch and
+// at, unless files were changed since.
+func (c *cache) setFileID(name string, id uint64, epoch uint64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch == c.epoch {
+		c.ids.add(name, checked[uint64]{value: id, at: at})
+	}
+}
+
+// generation returns the generation of a file, if it was read recently enough.
+func (c *cache) generation(fileID uint64) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.generations.get(fileID)
+	if !ok || c.now().Sub(cached.at) >= maxStaleness {
+		return 0, false
+	}
+	return cached.value, true
+}
+
+// setGeneration caches the generation of a file read by a read that started at
+// epoch and at, unless files were changed since.
+func (c *cache) setGeneration(fileID uint64, generation int64, epoch uint64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch == c.epoch {
+		c.generations.add(fileID, checked[int64]{value: generation, at: at})
+	}
+}
+
+// invalidate forgets the IDs and generations of files read so far, including
+// those being read, once this process changed files. Extent maps stay, they are
+// checked against the generations read next.
+func (c *cache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.ids = newLRU[string, checked[uint64]](cachedNames)
+	c.generations = newLRU[uint64, checked[int64]](cachedNames)
+}
+
+// lookup returns the extent map of key, if it was cached at generation.
+func (c *cache) lookup(key fileKey, generation int64) ([]Extent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.files.get(key)
+	if !ok || cached.generation != generation {
+		return nil, false
+	}
+	return cached.extents, true
+}
+
+// fill caches the extent map of key read at generation, unless a newer one is
+// cached already.
+func (c *cache) fill(key fileKey, generation int64, extents []Extent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.files.get(key); ok && cached.generation > generation {
+		return
+	}
+	c.files.add(key, fileExtents{generation: generation, extents: extents})
+}
+
+// lru is a map that holds at most max entries, dropping the least recently
+// used one to make room for a new one. It is not safe for concurrent use.
+type lru[K comparable, V any] struct {
+	max   int
+	order *list.List // entries, most recently used first
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](max int) *lru[K, V] {
+	return &lru[K, V]{
+		max:   max,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func (l *lru[K, V]) get(key K) (V, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[K, V]).value, true
+}
+
+func (l *lru[K, V]) add(key K, value V) {
+	if elem, ok := l.items[key]; ok {
+		elem.Value.(*lruEntry[K, V]).value = value
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+	for l.order.Len() > l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (l *lru[K, V]) len() int {
+	return l.order.Len()
+}
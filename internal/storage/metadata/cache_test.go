@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	l := newLRU[string, int](2)
+
+	l.add("a", 1)
+	l.add("b", 2)
+	_, _ = l.get("a") // now the most recently used
+	l.add("c", 3)     // evicts b
+
+	assert.Equal(t, 2, l.len())
+	_, ok := l.get("b")
+	assert.False(t, ok, "The least recently used entry should be evicted")
+	v, ok := l.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	l.add("a", 4)
+	v, _ = l.get("a")
+	assert.Equal(t, 4, v, "Adding an existing key should replace its value")
+
+}
+
+func TestCacheGeneration(t *testing.T) {
+	c := newCache()
+	head := fileKey{fileID: 1}
+	version := fileKey{fileID: 1, versionedLayerID: 7}
+	extents := []Extent{{FileRange: [2]uint64{0, 10}, Chunk: Chunk{LayerID: 1}}}
+
+	c.fill(head, 3, extents)
+	c.fill(version, 3, extents)
+
+	cached, ok := c.lookup(head, 3)
+	assert.True(t, ok)
+	assert.Equal(t, extents, cached)
+	_, ok = c.lookup(head, 4)
+	assert.False(t, ok, "An extent map should not be used once its file changed")
+
+	// A read that started before a change must not replace what a read that
+	// started after it cached
+	c.fill(head, 4, nil)
+	c.fill(head, 3, extents)
+	cached, ok = c.lookup(head, 4)
+	assert.True(t, ok)
+	assert.Empty(t, cached)
+
+	_, ok = c.lookup(version, 3)
+	assert.True(t, ok, "Versions of a file are cached on their own")
+}
+
+func TestCacheStaleness(t *testing.T) {
+	c := newCache()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	epoch, at := c.begin()
+	c.setFileID("test.duckdb", 1, epoch, at)
+	c.setGeneration(1, 3, epoch, at)
+
+	id, ok := c.fileID("test.duckdb")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), id)
+	generation, ok := c.generation(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), generation)
+
+	now = now.Add(maxStaleness)
+	_, ok = c.fileID("test.duckdb")
+	assert.False(t, ok, "An ID should be read again once it is too old")
+	_, ok = c.generation(1)
+	assert.False(t, ok, "A generation should be read again once it is too old")
+
+	// A read that started before this process changed files must not cache
+	// what it read
+	epoch, at = c.begin()
+	c.invalidate()
+	c.setGeneration(1, 3, epoch, at)
+	_, ok = c.generation(1)
+	assert.False(t, ok, "A generation read before a change should not be cached")
+
+	epoch, at = c.begin()
+	c.setGeneration(1, 4, epoch, at)
+	c.invalidate()
+	_, ok = c.generation(1)
+	assert.False(t, ok, "Generations should be read again once this process changed files")
+}
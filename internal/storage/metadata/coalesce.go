@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Coalesce lays the data of an active layer out again without the bytes that
+// later writes to the layer overwrote, as it should be uploaded. It returns the
+// chunks of the coalesced layer, sorted by file offset, a reader over its data,
+// which is read from the layer as it goes, and the size of that data.
+//
+// File offset →    0    5    10
+// Write 2          ··╔╗······
+// Write 1          ╔════════╗
+// Layer data       111111111122
+// Coalesced data   1122111111
+func (l *Layer) Coalesce() ([]Chunk, io.ReadSeeker, uint64) {
+	var chunks []Chunk
+	var segments [][2]uint64
+	var size uint64
+
+	for _, e := range Resolve(l.Chunks) {
+		r := e.LayerRange()
+
+		// Chunks of a restored version keep pointing into the object holding
+		// their bytes, they have no data in the layer
+		if e.Chunk.ObjectKey != "" {
+			chunks = append(chunks, Chunk{
+				LayerRange: r,
+				FileRange:  e.FileRange,
+				ObjectKey:  e.Chunk.ObjectKey,
+			})
+			continue
+		}
+
+		n := r[1] - r[0]
+
+		// Extents that follow each other in the file also follow each other in
+		// the coalesced data, so they make a single chunk, unless only one of
+		// them is a hole
+		if last := len(chunks) - 1; last >= 0 && chunks[last].FileRange[1] == e.FileRange[0] && chunks[last].Zero == e.Chunk.Zero && chunks[last].ObjectKey == "" {
+			chunks[last].FileRange[1] = e.FileRange[1]
+			chunks[last].LayerRange[1] += n
+		} else {
+			chunks = append(chunks, Chunk{
+				LayerRange: [2]uint64{size, size + n},
+				FileRange:  e.FileRange,
+				Zero:       e.Chunk.Zero,
+			})
+		}
+
+		if n == 0 {
+			continue
+		}
+		if last := len(segments) - 1; last >= 0 && segments[last][1] == r[0] {
+			segments[last][1] = r[1]
+		} else {
+			segments = append(segments, r)
+		}
+
+		size += n
+	}
+
+	var data io.ReaderAt = bytes.NewReader(l.Data)
+	if l.spill != nil {
+		data = l.spill
+	}
+
+	return chunks, newSegmentReader(data, segments), size
+}
+
+// segmentReader reads a list of ranges of an io.ReaderAt one after the other,
+// as if they were a single stream.
+type segmentReader struct {
+	r        io.ReaderAt
+	segments [][2]uint64
+	starts   []uint64 // offset of each segment in the stream
+	size     uint64
+	offset   uint64
+}
+
+func newSegmentReader(r io.ReaderAt, segments [][2]uint64) *segmentReader {
+	sr := &segmentReader{r: r, segments: segments, starts: make([]uint64, len(segments))}
+	for i, s := range segments {
+		sr.starts[i] = sr.size
+		sr.size += s[1] - s[0]
+	}
+	return sr
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	if sr.offset >= sr.size {
+		return 0, io.EOF
+	}
+
+	// Last segment starting at or before the offset
+	i := sort.Search(len(sr.starts), func(i int) bool { return sr.starts[i] > sr.offset }) - 1
+	s := sr.segments[i]
+	pos := s[0] + (sr.offset - sr.starts[i])
+
+	n := min(uint64(len(p)), s[1]-pos)
+	read, err := sr.r.ReadAt(p[:n], int64(pos))
+	sr.offset += uint64(read)
+	if errors.Is(err, io.EOF) && uint64(read) == n {
+		err = nil
+	}
+	return read, err
+}
+
+func (sr *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = int64(sr.offset) + offset
+	case io.SeekEnd:
+		abs = int64(sr.size) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	sr.offset = uint64(abs)
+	return abs, nil
+}
@@ -0,0 +1,103 @@
+package metadata
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// write applies a write to an active layer the way the storage manager does.
+func write(t *testing.T, l *Layer, offset uint64, data string) {
+	size := l.DataSize()
+	require.NoError(t, l.AppendData([]byte(data)))
+	l.Chunks = append(l.Chunks, Chunk{
+		LayerRange: [2]uint64{size, size + uint64(len(data))},
+		FileRange:  [2]uint64{offset, offset + uint64(len(data))},
+	})
+}
+
+func TestLayerCoalesce(t *testing.T) {
+	for _, spilled := range []bool{false, true} {
+		layer := &Layer{FileID: 1, Active: true}
+		if spilled {
+			require.NoError(t, layer.SpillTo(t.TempDir()))
+		}
+
+		write(t, layer, 0, "aaaaaaaaaa")
+		write(t, layer, 2, "bb")
+		write(t, layer, 20, "cccc")
+		write(t, layer, 20, "dddd")
+		write(t, layer, 24, "e")
+
+		chunks, data, size := layer.Coalesce()
+
+		assert.Equal(t, []Chunk{
+			{LayerRange: [2]uint64{0, 10}, FileRange: [2]uint64{0, 10}},
+			{LayerRange: [2]uint64{10, 15}, FileRange: [2]uint64{20, 25}},
+		}, chunks)
+		assert.Equal(t, uint64(15), size)
+
+		all, err := io.ReadAll(data)
+		require.NoError(t, err)
+		assert.Equal(t, "aabbaaaaaadddde", string(all))
+
+		// The object store may read it again after a failed attempt
+		_, err = data.Seek(11, io.SeekStart)
+		require.NoError(t, err)
+		rest, err := io.ReadAll(data)
+		require.NoError(t, err)
+		assert.Equal(t, "ddde", string(rest))
+
+		require.NoError(t, layer.Release())
+	}
+}
+
+func TestLayerCoalesceHoles(t *testing.T) {
+	layer := &Layer{FileID: 1, Active: true}
+
+	write(t, layer, 0, "aaaaaaaaaa")
+	layer.Chunks = append(layer.Chunks,
+		Chunk{LayerRange: [2]uint64{10, 10}, FileRange: [2]uint64{2, 6}, Zero: true},
+		Chunk{LayerRange: [2]uint64{10, 10}, FileRange: [2]uint64{10, 20}, Zero: true},
+	)
+	write(t, layer, 4, "bb")
+
+	chunks, data, size := layer.Coalesce()
+
+	assert.Equal(t, []Chunk{
+		{LayerRange: [2]uint64{0, 2}, FileRange: [2]uint64{0, 2}},
+		{LayerRange: [2]uint64{2, 2}, FileRange: [2]uint64{2, 4}, Zero: true},
+		{LayerRange: [2]uint64{2, 8}, FileRange: [2]uint64{4, 10}},
+		{LayerRange: [2]uint64{8, 8}, FileRange: [2]uint64{10, 20}, Zero: true},
+	}, chunks)
+	assert.Equal(t, uint64(8), size)
+
+	all, err := io.ReadAll(data)
+	require.NoError(t, err)
+	assert.Equal(t, "aabbaaaa", string(all))
+}
+
+func TestLayerCoalesceObjectKeys(t *testing.T) {
+	// A restored version points into the objects of other layers
+	layer := &Layer{FileID: 1, Active: true, Chunks: []Chunk{
+		{LayerRange: [2]uint64{5, 10}, FileRange: [2]uint64{0, 5}, ObjectKey: "layers/a"},
+		{LayerRange: [2]uint64{0, 3}, FileRange: [2]uint64{5, 8}, ObjectKey: "layers/a"},
+		{FileRange: [2]uint64{8, 12}, Zero: true},
+	}}
+	assert.True(t, layer.Changed())
+
+	chunks, data, size := layer.Coalesce()
+
+	assert.Equal(t, []Chunk{
+		{LayerRange: [2]uint64{5, 10}, FileRange: [2]uint64{0, 5}, ObjectKey: "layers/a"},
+		{LayerRange: [2]uint64{0, 3}, FileRange: [2]uint64{5, 8}, ObjectKey: "layers/a"},
+		{LayerRange: [2]uint64{0, 0}, FileRange: [2]uint64{8, 12}, Zero: true},
+	}, chunks, "Chunks pointing into other objects should not be merged")
+	assert.Zero(t, size)
+
+	all, err := io.ReadAll(data)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
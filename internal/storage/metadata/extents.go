@@ -0,0 +1,213 @@
+package metadata
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+)
+
+// Extent is a range of the virtual file whose visible bytes all come from a
+// single chunk.
+type Extent struct {
+	FileRange [2]uint64 // Range within the virtual file, a sub-range of Chunk.FileRange
+	Chunk     Chunk     // Chunk that owns the bytes of the range
+}
+
+// LayerRange returns the range within the chunk's layer that holds the bytes of
+// the extent. It is empty for a hole.
+func (e Extent) LayerRange() [2]uint64 {
+	if e.Chunk.Zero {
+		return [2]uint64{e.Chunk.LayerRange[0], e.Chunk.LayerRange[0]}
+	}
+	start := e.Chunk.LayerRange[0] + (e.FileRange[0] - e.Chunk.FileRange[0])
+	return [2]uint64{start, start + (e.FileRange[1] - e.FileRange[0])}
+}
+
+// Cut returns the chunk of the extent, cut down to the range of the extent.
+func (e Extent) Cut() Chunk {
+	c := e.Chunk
+	c.LayerRange = e.LayerRange()
+	c.FileRange = e.FileRange
+	return c
+}
+
+// IndexedExtent is an extent together with the position of its chunk in the
+// list given to ResolveIndexed, for callers that need to tell apart chunks
+// coming from different places.
+type IndexedExtent struct {
+	Extent
+	Index int
+}
+
+// Within returns the part of the extent that falls within rng, if any.
+func (e Extent) Within(rng [2]uint64) (Extent, bool) {
+	start, end := max(e.FileRange[0], rng[0]), min(e.FileRange[1], rng[1])
+	if start >= end {
+		return Extent{}, false
+	}
+	e.FileRange = [2]uint64{start, end}
+	return e, true
+}
+
+// Resolve turns chunks, ordered from the oldest to the newest write, into the
+// list of extents that are visible once every chunk is applied in that order.
+// The returned extents are sorted by file offset and never overlap.
+//
+// File offset →    0    5    10   15   20
+// Chunk 3 (newest) ···╔════╗···········
+// Chunk 2          ········╔══════════╗
+// Chunk 1 (oldest) ╔══════════════╗····
+// Visible extents  11133333322222222222
+func Resolve(chunks []Chunk) []Extent {
+	indexed := ResolveIndexed(chunks)
+	extents := make([]Extent, len(indexed))
+	for i, e := range indexed {
+		extents[i] = e.Extent
+	}
+	return extents
+}
+
+// ResolveIndexed is Resolve, giving the position in chunks of the chunk of each
+// extent. It sweeps the boundaries of the chunks in file order, keeping the
+// chunks that cover the current offset in a heap ordered by position, so the
+// newest one is always on top; a chunk that ended is only dropped once it
+// reaches the top. It takes O(n log n) for n chunks.
+func ResolveIndexed(chunks []Chunk) []IndexedExtent {
+	var starts []int
+	var bounds []uint64
+	for i, c := range chunks {
+		if c.FileRange[0] >= c.FileRange[1] {
+			continue
+		}
+		starts = append(starts, i)
+		bounds = append(bounds, c.FileRange[0], c.FileRange[1])
+	}
+	slices.SortFunc(starts, func(a, b int) int { return cmp.Compare(chunks[a].FileRange[0], chunks[b].FileRange[0]) })
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var extents []IndexedExtent
+	covering := &newestFirst{}
+	next := 0
+
+	for k := 0; k+1 < len(bounds); k++ {
+		start, end := bounds[k], bounds[k+1]
+
+		for ; next < len(starts) && chunks[starts[next]].FileRange[0] <= start; next++ {
+			heap.Push(covering, starts[next])
+		}
+		for covering.Len() > 0 && chunks[(*covering)[0]].FileRange[1] <= start {
+			heap.Pop(covering)
+		}
+		if covering.Len() == 0 {
+			continue
+		}
+
+		i := (*covering)[0]
+		if n := len(extents); n > 0 && extents[n-1].Index == i && extents[n-1].FileRange[1] == start {
+			extents[n-1].FileRange[1] = end
+			continue
+		}
+		extents = append(extents, IndexedExtent{Extent{FileRange: [2]uint64{start, end}, Chunk: chunks[i]}, i})
+	}
+
+	return extents
+}
+
+// newestFirst is a heap of positions of chunks, the highest first.
+type newestFirst []int
+
+func (h newestFirst) Len() int           { return len(h) }
+func (h newestFirst) Less(i, j int) bool { return h[i] > h[j] }
+func (h newestFirst) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *newestFirst) Push(x any)        { *h = append(*h, x.(int)) }
+
+func (h *newestFirst) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// DiffExtents returns the sorted, merged file ranges whose visible bytes may
+// differ between two resolved lists of extents. A byte is considered unchanged
+// only if both lists take it from the same offset of the same layer, so the
+// result is computed without looking at any data.
+func DiffExtents(a []Extent, b []Extent) [][2]uint64 {
+	var bounds []uint64
+	for _, e := range a {
+		bounds = append(bounds, e.FileRange[0], e.FileRange[1])
+	}
+	for _, e := range b {
+		bounds = append(bounds, e.FileRange[0], e.FileRange[1])
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	// source returns the layer and layer offset a list of extents takes the byte
+	// at offset from, advancing *i past the extents that end before it
+	source := func(extents []Extent, i *int, offset uint64) (uint64, uint64, bool) {
+		for *i < len(extents) && extents[*i].FileRange[1] <= offset {
+			*i++
+		}
+		if *i == len(extents) || extents[*i].FileRange[0] > offset {
+			return 0, 0, false
+		}
+		e := extents[*i]
+		return e.Chunk.LayerID, e.LayerRange()[0] + (offset - e.FileRange[0]), true
+	}
+
+	var diff [][2]uint64
+	var ai, bi int
+
+	for k := 0; k+1 < len(bounds); k++ {
+		start, end := bounds[k], bounds[k+1]
+
+		aLayer, aOffset, aOK := source(a, &ai, start)
+		bLayer, bOffset, bOK := source(b, &bi, start)
+
+		if aOK == bOK && (!aOK || (aLayer == bLayer && aOffset == bOffset)) {
+			continue
+		}
+
+		if n := len(diff); n > 0 && diff[n-1][1] == start {
+			diff[n-1][1] = end
+			continue
+		}
+		diff = append(diff, [2]uint64{start, end})
+	}
+
+	return diff
+}
+
+// WrittenRanges returns the sorted, merged file ranges covered by at least one
+// of the chunks.
+func WrittenRanges(chunks []Chunk) [][2]uint64 {
+	var ranges [][2]uint64
+	for _, e := range Resolve(chunks) {
+		if n := len(ranges); n > 0 && ranges[n-1][1] == e.FileRange[0] {
+			ranges[n-1][1] = e.FileRange[1]
+			continue
+		}
+		ranges = append(ranges, e.FileRange)
+	}
+	return ranges
+}
+
+// IntersectRanges returns the ranges covered by both a and b, which must be
+// sorted and non-overlapping.
+func IntersectRanges(a [][2]uint64, b [][2]uint64) [][2]uint64 {
+	var out [][2]uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := max(a[i][0], b[j][0]), min(a[i][1], b[j][1])
+		if start < end {
+			out = append(out, [2]uint64{start, end})
+		}
+		if a[i][1] < b[j][1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
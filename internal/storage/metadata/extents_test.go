@@ -0,0 +1,193 @@
+package metadata
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	chunks := []Chunk{
+		{LayerID: 1, LayerRange: [2]uint64{0, 16}, FileRange: [2]uint64{0, 16}},
+		{LayerID: 2, LayerRange: [2]uint64{0, 12}, FileRange: [2]uint64{8, 20}},
+		{LayerID: 3, LayerRange: [2]uint64{100, 106}, FileRange: [2]uint64{3, 9}},
+	}
+
+	extents := Resolve(chunks)
+
+	assert.Equal(t, []Extent{
+		{FileRange: [2]uint64{0, 3}, Chunk: chunks[0]},
+		{FileRange: [2]uint64{3, 9}, Chunk: chunks[2]},
+		{FileRange: [2]uint64{9, 20}, Chunk: chunks[1]},
+	}, extents)
+
+	assert.Equal(t, [2]uint64{0, 3}, extents[0].LayerRange())
+	assert.Equal(t, [2]uint64{100, 106}, extents[1].LayerRange())
+	assert.Equal(t, [2]uint64{1, 12}, extents[2].LayerRange())
+}
+
+func TestResolveSplitsOlderExtent(t *testing.T) {
+	chunks := []Chunk{
+		{LayerID: 1, LayerRange: [2]uint64{0, 10}, FileRange: [2]uint64{0, 10}},
+		{LayerID: 2, LayerRange: [2]uint64{0, 2}, FileRange: [2]uint64{4, 6}},
+		{LayerID: 2, LayerRange: [2]uint64{2, 4}, FileRange: [2]uint64{20, 22}},
+	}
+
+	extents := Resolve(chunks)
+
+	assert.Equal(t, []Extent{
+		{FileRange: [2]uint64{0, 4}, Chunk: chunks[0]},
+		{FileRange: [2]uint64{4, 6}, Chunk: chunks[1]},
+		{FileRange: [2]uint64{6, 10}, Chunk: chunks[0]},
+		{FileRange: [2]uint64{20, 22}, Chunk: chunks[2]},
+	}, extents)
+
+	assert.Equal(t, [2]uint64{6, 10}, extents[2].LayerRange())
+}
+
+func TestResolveEmpty(t *testing.T) {
+	assert.Empty(t, Resolve(nil))
+	assert.Empty(t, Resolve([]Chunk{{FileRange: [2]uint64{5, 5}}}))
+}
+
+// TestResolveMatchesPainter checks Resolve against painting every chunk over
+// the file byte by byte, oldest first, on random lists of chunks.
+func TestResolveMatchesPainter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for iteration := range 2000 {
+		const fileSize = 64
+
+		chunks := make([]Chunk, rng.Intn(20))
+		var layerOffset uint64
+		for i := range chunks {
+			start := uint64(rng.Intn(fileSize))
+			end := start + uint64(rng.Intn(fileSize/4))
+			chunks[i] = Chunk{
+				LayerID:    uint64(i % 3),
+				LayerRange: [2]uint64{layerOffset, layerOffset + end - start},
+				FileRange:  [2]uint64{start, end},
+			}
+			layerOffset += end - start
+		}
+
+		// Layer and offset within the layer each byte is read from, the painter
+		// algorithm the read path used to rely on
+		type source struct {
+			index  int
+			offset uint64
+		}
+		var painted [fileSize + fileSize/4]*source
+		for i, c := range chunks {
+			for b := c.FileRange[0]; b < c.FileRange[1]; b++ {
+				painted[b] = &source{i, c.LayerRange[0] + b - c.FileRange[0]}
+			}
+		}
+
+		var resolved [fileSize + fileSize/4]*source
+		extents := ResolveIndexed(chunks)
+		for k, e := range extents {
+			if k > 0 {
+				require.LessOrEqual(t, extents[k-1].FileRange[1], e.FileRange[0], "iteration %d: extents should be sorted and not overlap", iteration)
+			}
+			require.Less(t, e.FileRange[0], e.FileRange[1], "iteration %d: extents should not be empty", iteration)
+			require.Equal(t, chunks[e.Index], e.Chunk)
+
+			layerRange := e.LayerRange()
+			for b := e.FileRange[0]; b < e.FileRange[1]; b++ {
+				resolved[b] = &source{e.Index, layerRange[0] + b - e.FileRange[0]}
+			}
+		}
+
+		require.Equal(t, painted, resolved, "iteration %d: %v", iteration, chunks)
+	}
+}
+
+// BenchmarkResolveIndexed resolves the chunks of a file written to at random
+// offsets many times, like a database file between compactions.
+func BenchmarkResolveIndexed(b *testing.B) {
+	for _, n := range []int{1_000, 10_000, 100_000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			rng := rand.New(rand.NewSource(1))
+			const fileSize, blockSize = 1 << 30, 1 << 18
+
+			chunks := make([]Chunk, n)
+			var layerOffset uint64
+			for i := range chunks {
+				start := uint64(rng.Intn(fileSize/blockSize)) * blockSize
+				end := start + uint64(1+rng.Intn(4))*blockSize
+				chunks[i] = Chunk{
+					LayerID:    uint64(i / 100),
+					LayerRange: [2]uint64{layerOffset, layerOffset + end - start},
+					FileRange:  [2]uint64{start, end},
+				}
+				layerOffset += end - start
+			}
+
+			b.ResetTimer()
+			for range b.N {
+				ResolveIndexed(chunks)
+			}
+		})
+	}
+}
+
+func TestExtentWithin(t *testing.T) {
+	e := Extent{
+		FileRange: [2]uint64{10, 20},
+		Chunk:     Chunk{LayerID: 1, LayerRange: [2]uint64{100, 110}, FileRange: [2]uint64{10, 20}},
+	}
+
+	clipped, ok := e.Within([2]uint64{15, 30})
+	require.True(t, ok)
+	assert.Equal(t, [2]uint64{15, 20}, clipped.FileRange)
+	assert.Equal(t, [2]uint64{105, 110}, clipped.LayerRange())
+
+	_, ok = e.Within([2]uint64{20, 30})
+	assert.False(t, ok)
+}
+
+func TestDiffExtents(t *testing.T) {
+	v1 := []Chunk{
+		{LayerID: 1, LayerRange: [2]uint64{0, 20}, FileRange: [2]uint64{0, 20}},
+	}
+	v2 := append(v1,
+		Chunk{LayerID: 2, LayerRange: [2]uint64{0, 4}, FileRange: [2]uint64{4, 8}},
+		Chunk{LayerID: 2, LayerRange: [2]uint64{4, 6}, FileRange: [2]uint64{8, 10}},
+		Chunk{LayerID: 2, LayerRange: [2]uint64{6, 10}, FileRange: [2]uint64{30, 34}},
+	)
+
+	a, b := Resolve(v1), Resolve(v2)
+
+	assert.Equal(t, [][2]uint64{{4, 10}, {30, 34}}, DiffExtents(a, b), "Adjacent changed ranges should be merged")
+	assert.Equal(t, [][2]uint64{{4, 10}, {30, 34}}, DiffExtents(b, a), "Diff should be symmetric")
+	assert.Empty(t, DiffExtents(b, b))
+	assert.Equal(t, [][2]uint64{{0, 20}}, DiffExtents(nil, a))
+
+	// The same bytes read from a different offset of the same layer may differ
+	shifted := Resolve([]Chunk{{LayerID: 1, LayerRange: [2]uint64{1, 21}, FileRange: [2]uint64{0, 20}}})
+	assert.Equal(t, [][2]uint64{{0, 20}}, DiffExtents(a, shifted))
+}
+
+func TestWrittenRanges(t *testing.T) {
+	chunks := []Chunk{
+		{LayerID: 1, LayerRange: [2]uint64{0, 4}, FileRange: [2]uint64{0, 4}},
+		{LayerID: 1, LayerRange: [2]uint64{4, 8}, FileRange: [2]uint64{2, 6}},
+		{LayerID: 2, LayerRange: [2]uint64{0, 4}, FileRange: [2]uint64{10, 14}},
+	}
+
+	assert.Equal(t, [][2]uint64{{0, 6}, {10, 14}}, WrittenRanges(chunks))
+	assert.Empty(t, WrittenRanges(nil))
+}
+
+func TestIntersectRanges(t *testing.T) {
+	a := [][2]uint64{{0, 6}, {10, 14}, {20, 30}}
+	b := [][2]uint64{{4, 12}, {14, 20}, {25, 26}}
+
+	assert.Equal(t, [][2]uint64{{4, 6}, {10, 12}, {25, 26}}, IntersectRanges(a, b))
+	assert.Equal(t, IntersectRanges(a, b), IntersectRanges(b, a), "Intersection should be symmetric")
+	assert.Empty(t, IntersectRanges(a, nil))
+}
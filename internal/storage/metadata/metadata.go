@@ -3,10 +3,16 @@ package metadata
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/vinimdocarmo/quackfs/db/sqlc"
 	"github.com/vinimdocarmo/quackfs/db/types"
 )
@@ -17,6 +23,8 @@ type Chunk struct {
 	Flushed    bool      // whether the chunk metadata has been persisted to the database
 	LayerRange [2]uint64 // Range within a layer as an array of two integers
 	FileRange  [2]uint64 // Range within the virtual file as an array of two integers
+	Zero       bool      // whether the chunk is a hole, which reads as zeros and has no bytes in its layer
+	ObjectKey  string    // object holding the bytes of the chunk when they are not in the object of its layer
 }
 
 // Layer represents a snapshot layer.
@@ -32,25 +40,50 @@ type Chunk struct {
 // data is always written in a append-only fashion. The writes are their offsets
 // are stored in the chunks metadata. Which write will be represented by a
 // chunkMetadata.
+//
+// The data of a large active layer can be moved from memory to a local spill
+// file with SpillTo, so it must be accessed through AppendData, ReadData and
+// DataReader rather than through Data.
 type Layer struct {
-	ID        uint64
-	FileID    uint64
-	Active    bool // whether or not it is the current active layer (memory resident)
-	VersionID uint64
-	Tag       string
-	Chunks    []Chunk
-	Size      uint64
-	Data      []byte
-	ObjectKey string
+	ID            uint64
+	FileID        uint64
+	Active        bool // whether or not it is the current active layer (memory resident)
+	VersionID     uint64
+	Tag           string
+	Chunks        []Chunk
+	Size          uint64
+	Data          []byte
+	ObjectKey     string
+	CompactedInto uint64    // ID of the layer this layer was folded into by compaction, 0 if it is live
+	CreatedAt     time.Time // when the layer was committed, or got its first write if it is active
+
+	spill     *os.File // when set, the data of the active layer lives in this file instead of Data
+	spillSize uint64   // bytes of layer data in the spill file
+}
+
+// Changed reports whether the layer changes the content of the file, either
+// with bytes or with holes.
+func (l *Layer) Changed() bool {
+	if l.DataSize() > 0 {
+		return true
+	}
+	for _, c := range l.Chunks {
+		if c.Zero || c.ObjectKey != "" {
+			return true
+		}
+	}
+	return false
 }
 
 type MetadataStore struct {
 	queries *sqlc.Queries
+	cache   *cache // metadata of committed layers, used by queries made outside of a transaction
 }
 
 func NewMetadataStore(db *sql.DB) *MetadataStore {
 	return &MetadataStore{
 		queries: sqlc.New(db),
+		cache:   newCache(),
 	}
 }
 
@@ -66,6 +99,8 @@ func WithTx(tx *sql.Tx) QueryOpt {
 	}
 }
 
+// GetFileIDByName returns the ID of the file named name. Outside of a
+// transaction, it comes from the cache if it was read recently enough.
 func (ms *MetadataStore) GetFileIDByName(ctx context.Context, name string, opts ...QueryOpt) (uint64, error) {
 	options := QueryOpts{}
 	for _, opt := range opts {
@@ -79,8 +114,11 @@ func (ms *MetadataStore) GetFileIDByName(ctx context.Context, name string, opts
 
 	if options.tx != nil {
 		queries = ms.queries.WithTx(options.tx)
+	} else if fileID, ok := ms.cache.fileID(name); ok {
+		return fileID, nil
 	}
 
+	epoch, at := ms.cache.begin()
 	fileID, err = queries.GetFileIDByName(ctx, name)
 
 	if err != nil {
@@ -90,11 +128,34 @@ func (ms *MetadataStore) GetFileIDByName(ctx context.Context, name string, opts
 		return 0, err
 	}
 
+	if options.tx == nil {
+		ms.cache.setFileID(name, fileID, epoch, at)
+	}
+
 	return fileID, nil
 }
 
-func (ms *MetadataStore) InsertFile(ctx context.Context, name string) (uint64, error) {
-	fileID, err := ms.queries.InsertFile(ctx, name)
+// Invalidate makes the next reads outside of a transaction read the IDs and
+// generations of files from the database again. It is called once this process
+// changed files, so that it sees its own changes right away; those of other
+// processes are seen within maxStaleness.
+func (ms *MetadataStore) Invalidate() {
+	ms.cache.invalidate()
+}
+
+func (ms *MetadataStore) InsertFile(ctx context.Context, name string, opts ...QueryOpt) (uint64, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	fileID, err := queries.InsertFile(ctx, name)
 	if err != nil {
 		return 0, err
 	}
@@ -106,23 +167,50 @@ func (ms *MetadataStore) GetAllFiles(ctx context.Context) ([]sqlc.File, error) {
 	return ms.queries.GetAllFiles(ctx)
 }
 
+// FileExists reports whether a file with the given ID exists
+func (ms *MetadataStore) FileExists(ctx context.Context, fileID uint64) (bool, error) {
+	exists, err := ms.queries.FileExists(ctx, fileID)
+	if err != nil {
+		return false, fmt.Errorf("error checking file %d: %w", fileID, err)
+	}
+	return exists, nil
+}
+
 // CalcSizeOf calculates the total byte size of the DuckDB database file
 func (ms *MetadataStore) CalcSizeOf(ctx context.Context, fileID uint64, opts ...QueryOpt) (uint64, error) {
+	return ms.CalcSizeOfVersion(ctx, fileID, 0, opts...)
+}
+
+// CalcSizeOfVersion calculates the byte size of the DuckDB database file as it was
+// when the given versioned layer was committed. If versionedLayerID is 0 the latest
+// committed state is used.
+func (ms *MetadataStore) CalcSizeOfVersion(ctx context.Context, fileID uint64, versionedLayerID uint64, opts ...QueryOpt) (uint64, error) {
 	options := QueryOpts{}
 	for _, opt := range opts {
 		opt(&options)
 	}
 
+	// The size is the end of the last extent, which the cached extent map tells
+	if options.tx == nil {
+		extents, err := ms.committedExtents(ctx, fileKey{fileID, versionedLayerID})
+		if err != nil {
+			return 0, err
+		}
+		if len(extents) == 0 {
+			return 0, nil
+		}
+		return extents[len(extents)-1].FileRange[1], nil
+	}
+
 	var fileSize int64
 	var err error
 
-	queries := ms.queries
+	queries := ms.queries.WithTx(options.tx)
 
-	if options.tx != nil {
-		queries = ms.queries.WithTx(options.tx)
-	}
-
-	fileSize, err = queries.CalcFileSize(ctx, fileID)
+	fileSize, err = queries.CalcFileSize(ctx, sqlc.CalcFileSizeParams{
+		FileID:           fileID,
+		VersionedLayerID: versionedLayerID,
+	})
 
 	if err != nil {
 		// If the file has no chunks, its size is 0
@@ -150,6 +238,8 @@ func (ms *MetadataStore) InsertChunk(ctx context.Context, layerID uint64, c Chun
 		SnapshotLayerID: layerID,
 		LayerRange:      layerRange,
 		FileRange:       fileRange,
+		ObjectKey:       c.ObjectKey,
+		Zero:            c.Zero,
 	}
 
 	queries := ms.queries
@@ -166,6 +256,23 @@ func (ms *MetadataStore) InsertChunk(ctx context.Context, layerID uint64, c Chun
 	return nil
 }
 
+// CopyLayerChunks copies the chunk metadata of one layer to another, preserving
+// the order in which the chunks were written. Both layers end up referencing the
+// same ranges of the same layer object, so no layer data is copied.
+func (ms *MetadataStore) CopyLayerChunks(ctx context.Context, tx *sql.Tx, srcLayerID uint64, dstLayerID uint64) error {
+	params := sqlc.CopyLayerChunksParams{
+		DstLayerID: int64(dstLayerID),
+		SrcLayerID: srcLayerID,
+	}
+
+	err := ms.queries.WithTx(tx).CopyLayerChunks(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to copy chunks of layer %d: %w", srcLayerID, err)
+	}
+
+	return nil
+}
+
 func (ms *MetadataStore) LoadLayersByFileID(ctx context.Context, fileID uint64, opts ...QueryOpt) ([]*Layer, error) {
 	options := QueryOpts{}
 	for _, opt := range opts {
@@ -189,32 +296,105 @@ func (ms *MetadataStore) LoadLayersByFileID(ctx context.Context, fileID uint64,
 	var layers []*Layer
 
 	for _, row := range rows {
-		layer := &Layer{FileID: row.FileID}
-		layer.ID = row.ID
-		if row.VersionID.Valid {
-			layer.VersionID = uint64(row.VersionID.Int64)
-		} else {
-			layer.VersionID = 0
-		}
-		if row.Tag.Valid {
-			layer.Tag = row.Tag.String
-		}
-		layer.ObjectKey = row.ObjectKey
-		layers = append(layers, layer)
+		layers = append(layers, toLayer(row))
+	}
+
+	return layers, nil
+}
+
+// LoadLayersWithAncestry returns the layers visible from a file: the layers of
+// the file itself and, if it is a branch, the layers of its ancestors up to the
+// layer each branch was created from. Layers are ordered from the oldest to the
+// newest.
+func (ms *MetadataStore) LoadLayersWithAncestry(ctx context.Context, fileID uint64, opts ...QueryOpt) ([]*Layer, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	rows, err := queries.GetLayersWithAncestry(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []*Layer
+
+	for _, row := range rows {
+		layers = append(layers, toLayer(sqlc.GetLayersByFileIDRow(row)))
 	}
 
 	return layers, nil
 }
 
-func (ms *MetadataStore) InsertVersion(ctx context.Context, tx *sql.Tx, version string) (uint64, error) {
+// toLayer converts a layer row into a committed Layer without its chunks
+func toLayer(row sqlc.GetLayersByFileIDRow) *Layer {
+	layer := &Layer{FileID: row.FileID}
+	layer.ID = row.ID
+	if row.VersionID.Valid {
+		layer.VersionID = uint64(row.VersionID.Int64)
+	} else {
+		layer.VersionID = 0
+	}
+	if row.Tag.Valid {
+		layer.Tag = row.Tag.String
+	}
+	layer.ObjectKey = row.ObjectKey
+	if row.CompactedInto.Valid {
+		layer.CompactedInto = uint64(row.CompactedInto.Int64)
+	}
+	if row.CreatedAt.Valid {
+		layer.CreatedAt = row.CreatedAt.Time
+	}
+	return layer
+}
+
+func (ms *MetadataStore) InsertVersion(ctx context.Context, tx *sql.Tx, fileID uint64, version string) (uint64, error) {
 	queries := ms.queries.WithTx(tx)
-	versionID, err := queries.InsertVersion(ctx, version)
+	versionID, err := queries.InsertVersion(ctx, sqlc.InsertVersionParams{FileID: fileID, Tag: version})
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert new version: %w", err)
+		return 0, fmt.Errorf("failed to insert new version: %w", versionError(err, version))
 	}
 	return versionID, nil
 }
 
+// versionError maps the constraint violations of a version to the errors they
+// stand for: a tag the file already has, or a file that doesn't exist.
+func versionError(err error, tag string) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code.Name() {
+	case "unique_violation":
+		return fmt.Errorf("tag %q: %w", tag, types.ErrAlreadyExists)
+	case "foreign_key_violation":
+		return fmt.Errorf("file of version %q: %w", tag, types.ErrNotFound)
+	}
+
+	return err
+}
+
+// UpdateVersionTag renames a version
+func (ms *MetadataStore) UpdateVersionTag(ctx context.Context, tx *sql.Tx, versionID uint64, tag string) error {
+	params := sqlc.UpdateVersionTagParams{
+		ID:  versionID,
+		Tag: tag,
+	}
+
+	if err := ms.queries.WithTx(tx).UpdateVersionTag(ctx, params); err != nil {
+		return fmt.Errorf("failed to update tag of version %d: %w", versionID, versionError(err, tag))
+	}
+
+	return nil
+}
+
 func (ms *MetadataStore) InsertLayer(ctx context.Context, tx *sql.Tx, fileID uint64, versionID uint64, objectKey string) (uint64, error) {
 	params := sqlc.InsertLayerParams{
 		FileID:    fileID,
@@ -237,20 +417,355 @@ func (ms *MetadataStore) GetObjectKey(ctx context.Context, layerID uint64) (stri
 		}
 		return "", fmt.Errorf("error retrieving object key: %w", err)
 	}
+
 	return objectKey, nil
 }
 
+// DeleteLayer deletes a layer together with its version. The layer must no
+// longer have chunks nor be the target of a compaction.
+func (ms *MetadataStore) DeleteLayer(ctx context.Context, tx *sql.Tx, layer *Layer) error {
+	queries := ms.queries.WithTx(tx)
+
+	if err := queries.DeleteLayer(ctx, layer.ID); err != nil {
+		return fmt.Errorf("failed to delete layer %d: %w", layer.ID, err)
+	}
+
+	if layer.VersionID != 0 {
+		if err := queries.DeleteVersion(ctx, layer.VersionID); err != nil {
+			return fmt.Errorf("failed to delete version %d: %w", layer.VersionID, err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteFile deletes a file together with its whole history: chunks, layers,
+// versions, retention policy and, if the file is a branch or a clone, its branch
+// or clone record.
+// Layer objects are left to the garbage collector.
+func (ms *MetadataStore) DeleteFile(ctx context.Context, tx *sql.Tx, fileID uint64) error {
+	queries := ms.queries.WithTx(tx)
+
+	if err := queries.DeleteChunksOfFile(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete chunks of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteLayersOfFile(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete layers of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteVersionsOfFile(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete versions of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteRetentionPolicy(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete retention policy of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteBranch(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete branch of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteClone(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete clone of file %d: %w", fileID, err)
+	}
+	if err := queries.DeleteFile(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to delete file %d: %w", fileID, err)
+	}
+
+	return nil
+}
+
+// InsertBranch records that the file fileID is a branch named name of the file
+// parentFileID, created from the layer baseLayerID
+func (ms *MetadataStore) InsertBranch(ctx context.Context, tx *sql.Tx, fileID uint64, name string, parentFileID uint64, baseLayerID uint64) error {
+	params := sqlc.InsertBranchParams{
+		FileID:       fileID,
+		Name:         name,
+		ParentFileID: parentFileID,
+		BaseLayerID:  baseLayerID,
+	}
+
+	if err := ms.queries.WithTx(tx).InsertBranch(ctx, params); err != nil {
+		return fmt.Errorf("failed to insert branch: %w", err)
+	}
+
+	return nil
+}
+
+// GetBranch returns the branch record of a file, or types.ErrNotFound if the
+// file is not a branch
+func (ms *MetadataStore) GetBranch(ctx context.Context, fileID uint64, opts ...QueryOpt) (sqlc.Branch, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	branch, err := queries.GetBranchByFileID(ctx, fileID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return branch, types.ErrNotFound
+		}
+		return branch, fmt.Errorf("error retrieving branch: %w", err)
+	}
+	return branch, nil
+}
+
+// InsertClone records that the file fileID is a clone of the file sourceFileID
+// up to the layer sourceLayerID, whose copy is the layer baseLayerID of the clone
+func (ms *MetadataStore) InsertClone(ctx context.Context, tx *sql.Tx, fileID uint64, sourceFileID uint64, sourceLayerID uint64, baseLayerID uint64) error {
+	params := sqlc.InsertCloneParams{
+		FileID:        fileID,
+		SourceFileID:  sourceFileID,
+		SourceLayerID: sourceLayerID,
+		BaseLayerID:   baseLayerID,
+	}
+
+	if err := ms.queries.WithTx(tx).InsertClone(ctx, params); err != nil {
+		return fmt.Errorf("failed to insert clone: %w", err)
+	}
+
+	return nil
+}
+
+// GetClone returns the clone record of a file, or types.ErrNotFound if the file
+// is not a clone
+func (ms *MetadataStore) GetClone(ctx context.Context, fileID uint64, opts ...QueryOpt) (sqlc.Clone, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	clone, err := queries.GetCloneByFileID(ctx, fileID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return clone, types.ErrNotFound
+		}
+		return clone, fmt.Errorf("error retrieving clone: %w", err)
+	}
+	return clone, nil
+}
+
+// GetBranches returns the branches created from a file, ordered by name
+func (ms *MetadataStore) GetBranches(ctx context.Context, parentFileID uint64, opts ...QueryOpt) ([]sqlc.GetBranchesByParentRow, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	branches, err := queries.GetBranchesByParent(ctx, parentFileID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving branches: %w", err)
+	}
+	return branches, nil
+}
+
+// GetBranchPoints returns the set of layers of a file that branches were created
+// from. Their state must be preserved, as branches read through them.
+func (ms *MetadataStore) GetBranchPoints(ctx context.Context, fileID uint64, opts ...QueryOpt) (map[uint64]struct{}, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	layerIDs, err := queries.GetBranchPoints(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving branch points: %w", err)
+	}
+
+	points := make(map[uint64]struct{}, len(layerIDs))
+	for _, id := range layerIDs {
+		points[id] = struct{}{}
+	}
+
+	return points, nil
+}
+
+// GetClonePoints returns the set of layers of a file that clones were created
+// from. Promoting a clone compares the file against them.
+func (ms *MetadataStore) GetClonePoints(ctx context.Context, fileID uint64, opts ...QueryOpt) (map[uint64]struct{}, error) {
+	options := QueryOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	queries := ms.queries
+
+	if options.tx != nil {
+		queries = ms.queries.WithTx(options.tx)
+	}
+
+	layerIDs, err := queries.GetClonePoints(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving clone points: %w", err)
+	}
+
+	points := make(map[uint64]struct{}, len(layerIDs))
+	for _, id := range layerIDs {
+		points[id] = struct{}{}
+	}
+
+	return points, nil
+}
+
+// GetRetentionPolicy returns the retention policy of a file, or
+// types.ErrNotFound if the file has none.
+func (ms *MetadataStore) GetRetentionPolicy(ctx context.Context, fileID uint64) (sqlc.RetentionPolicy, error) {
+	policy, err := ms.queries.GetRetentionPolicy(ctx, fileID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return policy, types.ErrNotFound
+		}
+		return policy, fmt.Errorf("error retrieving retention policy: %w", err)
+	}
+	return policy, nil
+}
+
+// SetRetentionPolicy creates or replaces the retention policy of a file
+func (ms *MetadataStore) SetRetentionPolicy(ctx context.Context, policy sqlc.RetentionPolicy) error {
+	err := ms.queries.UpsertRetentionPolicy(ctx, sqlc.UpsertRetentionPolicyParams(policy))
+	if err != nil {
+		return fmt.Errorf("failed to set retention policy: %w", err)
+	}
+	return nil
+}
+
+// GetReferencedObjectKeys returns the set of object keys that are referenced by
+// at least one layer of any file
+func (ms *MetadataStore) GetReferencedObjectKeys(ctx context.Context) (map[string]struct{}, error) {
+	keys, err := ms.queries.GetReferencedObjectKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving referenced object keys: %w", err)
+	}
+
+	referenced := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		referenced[key] = struct{}{}
+	}
+
+	return referenced, nil
+}
+
+// MoveLayers hands the layers of srcFileID whose ID is at least fromLayerID,
+// together with their versions, over to dstFileID
+func (ms *MetadataStore) MoveLayers(ctx context.Context, tx *sql.Tx, srcFileID uint64, dstFileID uint64, fromLayerID uint64) error {
+	queries := ms.queries.WithTx(tx)
+
+	// Versions first, they are found through the layers that are about to move
+	err := queries.MoveVersionsOfLayers(ctx, sqlc.MoveVersionsOfLayersParams{
+		DstFileID:   dstFileID,
+		SrcFileID:   srcFileID,
+		FromLayerID: int64(fromLayerID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move versions: %w", err)
+	}
+
+	err = queries.MoveLayers(ctx, sqlc.MoveLayersParams{
+		DstFileID:   dstFileID,
+		SrcFileID:   srcFileID,
+		FromLayerID: int64(fromLayerID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move layers: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateLayerObjectKey points a layer to a different object in the object store
+func (ms *MetadataStore) UpdateLayerObjectKey(ctx context.Context, tx *sql.Tx, layerID uint64, objectKey string) error {
+	params := sqlc.UpdateLayerObjectKeyParams{
+		ID:        layerID,
+		ObjectKey: objectKey,
+	}
+
+	if err := ms.queries.WithTx(tx).UpdateLayerObjectKey(ctx, params); err != nil {
+		return fmt.Errorf("failed to update object key of layer %d: %w", layerID, err)
+	}
+
+	return nil
+}
+
+// DeleteChunksOfLayers deletes the chunks of every layer of the file whose ID is
+// within [fromLayerID, toLayerID]
+func (ms *MetadataStore) DeleteChunksOfLayers(ctx context.Context, tx *sql.Tx, fileID uint64, fromLayerID uint64, toLayerID uint64) error {
+	params := sqlc.DeleteChunksOfLayersParams{
+		FileID:      fileID,
+		FromLayerID: int64(fromLayerID),
+		ToLayerID:   int64(toLayerID),
+	}
+
+	if err := ms.queries.WithTx(tx).DeleteChunksOfLayers(ctx, params); err != nil {
+		return fmt.Errorf("failed to delete chunks of layers: %w", err)
+	}
+
+	return nil
+}
+
+// LockFile keeps the layers of a file from changing, in this process or any
+// other, until tx ends.
+func (ms *MetadataStore) LockFile(ctx context.Context, tx *sql.Tx, fileID uint64) error {
+	if err := ms.queries.WithTx(tx).LockFile(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	return nil
+}
+
+// MarkLayersCompacted records that the layers of the file within [fromLayerID, intoLayerID)
+// were folded into intoLayerID. Layers previously folded into one of those layers
+// are redirected to intoLayerID as well, so they always point to a live layer.
+func (ms *MetadataStore) MarkLayersCompacted(ctx context.Context, tx *sql.Tx, fileID uint64, fromLayerID uint64, intoLayerID uint64) error {
+	params := sqlc.MarkLayersCompactedParams{
+		IntoLayerID: int64(intoLayerID),
+		FileID:      fileID,
+		FromLayerID: int64(fromLayerID),
+	}
+
+	if err := ms.queries.WithTx(tx).MarkLayersCompacted(ctx, params); err != nil {
+		return fmt.Errorf("failed to mark layers as compacted: %w", err)
+	}
+
+	return nil
+}
+
 func (ms *MetadataStore) GetLayerByVersion(ctx context.Context, fileID uint64, versionTag string, tx *sql.Tx) (*Layer, error) {
 	params := sqlc.GetLayerByVersionParams{
 		FileID: fileID,
 		Tag:    versionTag,
 	}
 
-	row, err := ms.queries.WithTx(tx).GetLayerByVersion(ctx, params)
+	queries := ms.queries
+
+	if tx != nil {
+		queries = ms.queries.WithTx(tx)
+	}
+
+	row, err := queries.GetLayerByVersion(ctx, params)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("version tag not found")
+			return nil, fmt.Errorf("version tag not found: %w", types.ErrNotFound)
 		}
 		return nil, fmt.Errorf("failed to fetch layer: %w", err)
 	}
@@ -266,6 +781,9 @@ func (ms *MetadataStore) GetLayerByVersion(ctx context.Context, fileID uint64, v
 	}
 	layer.Tag = row.Tag
 	layer.ObjectKey = row.ObjectKey
+	if row.CompactedInto.Valid {
+		layer.CompactedInto = uint64(row.CompactedInto.Int64)
+	}
 
 	// Load the chunk metadata for this layer
 	chunks, err := ms.GetLayerChunks(ctx, layer.ID)
@@ -277,6 +795,46 @@ func (ms *MetadataStore) GetLayerByVersion(ctx context.Context, fileID uint64, v
 	return layer, nil
 }
 
+// GetLayerByTimestamp returns the newest committed layer of the file created at
+// or before the given instant
+func (ms *MetadataStore) GetLayerByTimestamp(ctx context.Context, fileID uint64, at time.Time, tx *sql.Tx) (*Layer, error) {
+	params := sqlc.GetLayerByTimestampParams{
+		FileID: fileID,
+		At:     at,
+	}
+
+	queries := ms.queries
+
+	if tx != nil {
+		queries = ms.queries.WithTx(tx)
+	}
+
+	row, err := queries.GetLayerByTimestamp(ctx, params)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no version found at or before %s: %w", at.Format(time.RFC3339), types.ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to fetch layer: %w", err)
+	}
+
+	layer := &Layer{
+		ID:     row.ID,
+		FileID: row.FileID,
+	}
+
+	if row.VersionID.Valid {
+		layer.VersionID = uint64(row.VersionID.Int64)
+	}
+	layer.Tag = row.Tag
+	layer.ObjectKey = row.ObjectKey
+	if row.CompactedInto.Valid {
+		layer.CompactedInto = uint64(row.CompactedInto.Int64)
+	}
+
+	return layer, nil
+}
+
 // ParseRange parses strings of the form "[start, end)" into two uint64 values
 func ParseRange(rg string) (uint64, uint64, error) {
 	parts := strings.Split(strings.Trim(rg, "[)"), ",")
@@ -303,12 +861,14 @@ func RangesOverlap(range1 [2]uint64, range2 [2]uint64) bool {
 }
 
 // Helper function to convert chunk row data into a Chunk struct
-func toChunk(layerID uint64, layerRange types.Range, fileRange types.Range, flushed bool) Chunk {
+func toChunk(layerID uint64, layerRange types.Range, fileRange types.Range, objectKey string, zero bool, flushed bool) Chunk {
 	return Chunk{
 		LayerID:    layerID,
 		Flushed:    flushed,
 		LayerRange: [2]uint64(layerRange),
 		FileRange:  [2]uint64(fileRange),
+		Zero:       zero,
+		ObjectKey:  objectKey,
 	}
 }
 
@@ -321,7 +881,7 @@ func (ms *MetadataStore) GetLayerChunks(ctx context.Context, layerID uint64) ([]
 	var chunks []Chunk
 
 	for _, row := range rows {
-		chunk := toChunk(layerID, row.LayerRange, row.FileRange, true)
+		chunk := toChunk(layerID, row.LayerRange, row.FileRange, row.ObjectKey, row.Zero, true)
 		chunks = append(chunks, chunk)
 	}
 
@@ -342,20 +902,27 @@ func WithVersionedLayerID(id uint64) ChunkQueryOpt {
 	}
 }
 
-// getOverlappingChunks retrieves chunks that overlap with a specific range for a file
+// getOverlappingChunks retrieves chunks that overlap with a specific range for a
+// file. Chunks of a branch include the chunks of its ancestors up to the layer
+// each branch was created from. Every chunk with bytes comes with the key of the
+// object holding them, read together with the chunks so that a compaction that
+// replaces the object of a layer can't slip in between.
 func (ms *MetadataStore) getOverlappingChunks(ctx context.Context, tx *sql.Tx, fileID uint64, offsetRange [2]uint64, opts ...ChunkQueryOpt) ([]Chunk, error) {
 	options := ChunkQueryOpts{}
 	for _, opt := range opts {
 		opt(&options)
 	}
 
-	queries := ms.queries.WithTx(tx)
+	queries := ms.queries
+	if tx != nil {
+		queries = ms.queries.WithTx(tx)
+	}
 
 	var chunks []Chunk
 
 	params := sqlc.GetOverlappingChunksWithVersionParams{
-		VersionedLayerID: options.versionedLayerID,
 		FileID:           fileID,
+		VersionedLayerID: options.versionedLayerID,
 		Range:            types.Range(offsetRange),
 	}
 	rows, err := queries.GetOverlappingChunksWithVersion(ctx, params)
@@ -364,22 +931,93 @@ func (ms *MetadataStore) getOverlappingChunks(ctx context.Context, tx *sql.Tx, f
 	}
 
 	for _, row := range rows {
-		chunk := toChunk(row.SnapshotLayerID, row.LayerRange, row.FileRange, true)
+		chunk := toChunk(row.SnapshotLayerID, row.LayerRange, row.FileRange, row.ObjectKey, row.Zero, true)
+		if chunk.ObjectKey == "" && !chunk.Zero {
+			chunk.ObjectKey = row.LayerObjectKey
+		}
 		chunks = append(chunks, chunk)
 	}
 
 	return chunks, nil
 }
 
+// fileGeneration returns the generation of a file, which changes whenever a
+// layer of the file, or of a file it was branched from, changes. It is -1 for a
+// file that doesn't exist. It comes from the cache if it was read recently
+// enough.
+func (ms *MetadataStore) fileGeneration(ctx context.Context, fileID uint64) (int64, error) {
+	if generation, ok := ms.cache.generation(fileID); ok {
+		return generation, nil
+	}
+
+	epoch, at := ms.cache.begin()
+	generation, err := ms.queries.GetFileGeneration(ctx, fileID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get generation of file %d: %w", fileID, err)
+	}
+	ms.cache.setGeneration(fileID, generation, epoch, at)
+
+	return generation, nil
+}
+
+// committedExtents returns the extents visible in a file as of a version, from
+// the cache if the file didn't change since they were cached.
+func (ms *MetadataStore) committedExtents(ctx context.Context, key fileKey) ([]Extent, error) {
+	// The generation is read first, so that an extent map read while the file
+	// changes is cached as of the older generation and never used
+	generation, err := ms.fileGeneration(ctx, key.fileID)
+	if err != nil {
+		return nil, err
+	}
+	if extents, ok := ms.cache.lookup(key, generation); ok {
+		return extents, nil
+	}
+
+	chunks, err := ms.getOverlappingChunks(ctx, nil, key.fileID, [2]uint64{0, math.MaxInt64},
+		WithVersionedLayerID(key.versionedLayerID))
+	if err != nil {
+		return nil, err
+	}
+	extents := Resolve(chunks)
+
+	if generation >= 0 {
+		ms.cache.fill(key, generation, extents)
+	}
+
+	return extents, nil
+}
+
+// GetAllOverlappingChunks returns the chunks of a file that overlap a range:
+// the committed ones first, followed by those of activeLayer. Committed chunks
+// carry the key of the object holding their bytes. Without a transaction, they
+// are the extents of the cached extent map that overlap the range, cut to it,
+// so they never overlap each other.
 func (ms *MetadataStore) GetAllOverlappingChunks(ctx context.Context, tx *sql.Tx, fileID uint64, offsetRange [2]uint64, activeLayer *Layer, opts ...ChunkQueryOpt) ([]Chunk, error) {
 	options := ChunkQueryOpts{}
 	for _, opt := range opts {
 		opt(&options)
 	}
 
-	chunks, err := ms.getOverlappingChunks(ctx, tx, fileID, offsetRange, opts...)
-	if err != nil {
-		return nil, err
+	var chunks []Chunk
+	if tx == nil {
+		extents, err := ms.committedExtents(ctx, fileKey{fileID, options.versionedLayerID})
+		if err != nil {
+			return nil, err
+		}
+		first := sort.Search(len(extents), func(i int) bool { return extents[i].FileRange[1] > offsetRange[0] })
+		for _, e := range extents[first:] {
+			e, ok := e.Within(offsetRange)
+			if !ok {
+				break
+			}
+			chunks = append(chunks, e.Cut())
+		}
+	} else {
+		var err error
+		chunks, err = ms.getOverlappingChunks(ctx, tx, fileID, offsetRange, opts...)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	hasVersion := options.versionedLayerID > 0
@@ -0,0 +1,107 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DataSize returns the number of bytes of layer data held by an active layer,
+// in memory or in its spill file.
+func (l *Layer) DataSize() uint64 {
+	if l.spill != nil {
+		return l.spillSize
+	}
+	return uint64(len(l.Data))
+}
+
+// Spilled reports whether the data of the layer was moved to a spill file.
+func (l *Layer) Spilled() bool {
+	return l.spill != nil
+}
+
+// AppendData appends p to the data of an active layer.
+func (l *Layer) AppendData(p []byte) error {
+	if l.spill == nil {
+		l.Data = append(l.Data, p...)
+		return nil
+	}
+
+	n, err := l.spill.WriteAt(p, int64(l.spillSize))
+	l.spillSize += uint64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to spill file: %w", err)
+	}
+	return nil
+}
+
+// ReadData returns the bytes of the layer data within the layer range r.
+func (l *Layer) ReadData(r [2]uint64) ([]byte, error) {
+	if r[1] > l.DataSize() || r[0] > r[1] {
+		return nil, fmt.Errorf("range [%d, %d) is out of the %d bytes of layer data", r[0], r[1], l.DataSize())
+	}
+
+	if l.spill == nil {
+		return l.Data[r[0]:r[1]], nil
+	}
+
+	buf := make([]byte, r[1]-r[0])
+	if _, err := l.spill.ReadAt(buf, int64(r[0])); err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+	return buf, nil
+}
+
+// DataReader returns a reader over the whole layer data, which does not have to
+// fit in memory.
+func (l *Layer) DataReader() io.ReadSeeker {
+	if l.spill == nil {
+		return bytes.NewReader(l.Data)
+	}
+	return io.NewSectionReader(l.spill, 0, int64(l.spillSize))
+}
+
+// SpillTo moves the data of an active layer from memory to a new file in dir.
+// Later appends and reads go to that file until the layer is released.
+func (l *Layer) SpillTo(dir string) error {
+	if l.spill != nil {
+		return nil
+	}
+
+	f, err := os.CreateTemp(dir, fmt.Sprintf("quackfs-layer-%d-*.spill", l.FileID))
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+
+	if _, err := f.Write(l.Data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+
+	l.spill = f
+	l.spillSize = uint64(len(l.Data))
+	l.Data = nil
+
+	return nil
+}
+
+// Release frees the resources held by an active layer that is no longer
+// needed, removing its spill file if it has one.
+func (l *Layer) Release() error {
+	if l.spill == nil {
+		return nil
+	}
+
+	name := l.spill.Name()
+	err := l.spill.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+
+	l.spill = nil
+	l.spillSize = 0
+
+	return err
+}
@@ -0,0 +1,48 @@
+package metadata
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayerSpill(t *testing.T) {
+	dir := t.TempDir()
+	layer := &Layer{FileID: 1, Active: true}
+
+	require.NoError(t, layer.AppendData([]byte("hello ")))
+	assert.False(t, layer.Spilled())
+	assert.Equal(t, uint64(6), layer.DataSize())
+
+	require.NoError(t, layer.SpillTo(dir))
+	assert.True(t, layer.Spilled())
+	assert.Nil(t, layer.Data, "Spilled data should not be kept in memory")
+
+	require.NoError(t, layer.AppendData([]byte("world")))
+	assert.Equal(t, uint64(11), layer.DataSize())
+
+	data, err := layer.ReadData([2]uint64{3, 9})
+	require.NoError(t, err)
+	assert.Equal(t, "lo wor", string(data))
+
+	_, err = layer.ReadData([2]uint64{3, 12})
+	assert.Error(t, err, "Reading past the layer data should fail")
+
+	all, err := io.ReadAll(layer.DataReader())
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(all))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.NoError(t, layer.Release())
+	assert.False(t, layer.Spilled())
+
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Release should remove the spill file")
+}
@@ -0,0 +1,475 @@
+package objectstore
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is an object store that a DiskCache can sit in front of.
+type Store interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+	PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error
+	GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error)
+	DeleteObject(ctx context.Context, key string) error
+	ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// DiskCache keeps the bytes read from an object store in files of a local
+// directory, so that reading them again doesn't go to the network. Objects are
+// cached in aligned blocks of a fixed size, so that reads of overlapping ranges,
+// which DuckDB makes all the time, share the blocks they have in common. Objects
+// are never modified once uploaded, so a cached block never goes stale; it is
+// only dropped when its object is deleted or, least recently used first, when
+// the cache grows past its size limit. The cache survives restarts: the files
+// found in the directory are picked up again, in the order they were last used.
+type DiskCache struct {
+	store     Store
+	dir       string
+	maxBytes  uint64
+	blockSize uint64
+
+	mu      sync.Mutex
+	lru     *list.List               // cached blocks, most recently used first
+	entries map[string]*list.Element // cached blocks by file name
+	size    uint64                   // bytes of all cached blocks
+	pending map[string]*pendingRead  // blocks being read from the object store
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+var _ Store = (*DiskCache)(nil)
+
+// touchInterval is how often the modification time of the file of a block is
+// updated while it keeps being read. The time only orders the blocks on the
+// next run, so it doesn't have to be exact, and hits don't pay for a write.
+const touchInterval = time.Minute
+
+// cacheEntry is a block of an object stored in a file of the cache.
+type cacheEntry struct {
+	name      string
+	size      uint64
+	touchedAt time.Time // modification time of the file
+}
+
+// pendingRead is a read of a block from the object store that concurrent reads
+// of the same block wait for instead of reading it again.
+type pendingRead struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// CacheStats counts what a DiskCache did since it was created.
+type CacheStats struct {
+	Hits      uint64 // blocks served from the cache
+	Misses    uint64 // blocks read from the object store
+	Evictions uint64 // blocks dropped to stay under the size limit
+	Entries   int    // blocks currently cached
+	Bytes     uint64 // bytes currently cached
+}
+
+// NewDiskCache returns a cache in dir, holding at most maxBytes bytes, in front
+// of store, caching objects in blocks of blockSize bytes. The blocks cached in
+// dir by a previous run are kept, unless they have another size.
+func NewDiskCache(store Store, dir string, maxBytes uint64, blockSize uint64) (*DiskCache, error) {
+	if blockSize == 0 {
+		return nil, fmt.Errorf("invalid cache block size: %d", blockSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	c := &DiskCache{
+		store:     store,
+		dir:       dir,
+		maxBytes:  maxBytes,
+		blockSize: blockSize,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		pending:   make(map[string]*pendingRead),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load indexes the blocks cached in the directory, using the modification time
+// of their files as the time they were last used.
+func (c *DiskCache) load() error {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	var entries []*cacheEntry
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+
+		// Leftovers of a process that died while filling the cache, and blocks
+		// of another size
+		if _, blockSize, _, ok := parseCacheName(de.Name()); !ok || blockSize != c.blockSize {
+			os.Remove(filepath.Join(c.dir, de.Name()))
+			continue
+		}
+
+		entries = append(entries, &cacheEntry{name: de.Name(), size: uint64(info.Size()), touchedAt: info.ModTime()})
+	}
+
+	// Oldest first, each one is pushed in front of the previous ones
+	sort.Slice(entries, func(i, j int) bool { return entries[i].touchedAt.Before(entries[j].touchedAt) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range entries {
+		c.entries[entry.name] = c.lru.PushFront(entry)
+		c.size += entry.size
+	}
+	c.evictLocked()
+
+	return nil
+}
+
+// cacheName returns the name of the file caching a block of an object. It
+// starts with a hash of the key, so that the blocks of an object can be found
+// without keeping the keys around.
+func (c *DiskCache) cacheName(key string, block uint64) string {
+	return fmt.Sprintf("%s-b%d-%d", keyHash(key), c.blockSize, block)
+}
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCacheName returns the key hash, the block size and the block index of a
+// cache file name.
+func parseCacheName(name string) (string, uint64, uint64, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 || len(parts[0]) != 2*sha256.Size || !strings.HasPrefix(parts[1], "b") {
+		return "", 0, 0, false
+	}
+	blockSize, err := strconv.ParseUint(parts[1][1:], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	block, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return parts[0], blockSize, block, true
+}
+
+// GetObject returns a range of an object from the blocks of the cache, reading
+// the blocks it misses from the object store and caching them. Consecutive
+// missing blocks are read with a single request. Concurrent reads of a block
+// that isn't cached yet, like a read catching up with a prefetch of the same
+// range, make a single request.
+func (c *DiskCache) GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error) {
+	if dataRange[1] < dataRange[0] {
+		return nil, fmt.Errorf("invalid data range: %v", dataRange)
+	}
+
+	first, last := dataRange[0]/c.blockSize, dataRange[1]/c.blockSize
+	blocks := make([][]byte, last-first+1)
+
+	var missing []uint64
+	for i := range blocks {
+		if data, ok := c.get(c.cacheName(key, first+uint64(i))); ok {
+			c.hits.Add(1)
+			blocks[i] = data
+		} else {
+			missing = append(missing, uint64(i))
+		}
+	}
+
+	// Blocks already being read by another read are waited for, the others are
+	// read by this one. A block cached by another read in the meantime is read
+	// again, which is harmless.
+	waiting := make(map[uint64]*pendingRead)
+	var owned []uint64
+	c.mu.Lock()
+	for _, i := range missing {
+		name := c.cacheName(key, first+i)
+		if p, ok := c.pending[name]; ok {
+			waiting[i] = p
+			continue
+		}
+		c.pending[name] = &pendingRead{done: make(chan struct{})}
+		owned = append(owned, i)
+	}
+	c.mu.Unlock()
+
+	var err error
+	for len(owned) > 0 {
+		run := 1
+		for run < len(owned) && owned[run] == owned[run-1]+1 {
+			run++
+		}
+		// Once a request failed, the remaining blocks are only released
+		var data []byte
+		if err == nil {
+			data, err = c.read(ctx, key, first+owned[0], first+owned[run-1])
+		}
+		c.resolve(key, first+owned[0], blocks[owned[0]:owned[run-1]+1], data, err)
+		owned = owned[run:]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range waiting {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if p.err == nil {
+			c.hits.Add(1)
+			blocks[i] = p.data
+			continue
+		}
+		// The other read failed, maybe only because it was canceled, so this
+		// one reads the block itself
+		data, err := c.read(ctx, key, first+i, first+i)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i] = data
+	}
+
+	// The last block of an object can be shorter than the others
+	start := dataRange[0] - first*c.blockSize
+	end := dataRange[1] - first*c.blockSize + 1
+	if len(blocks) == 1 {
+		data := blocks[0]
+		return data[min(start, uint64(len(data))):min(end, uint64(len(data)))], nil
+	}
+	data := make([]byte, 0, end-start)
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	return data[min(start, uint64(len(data))):min(end, uint64(len(data)))], nil
+}
+
+// resolve hands the blocks read from block first on, which this read registered
+// as pending, to the reads waiting for them, and stores them in blocks.
+func (c *DiskCache) resolve(key string, first uint64, blocks [][]byte, data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range blocks {
+		name := c.cacheName(key, first+uint64(i))
+		p := c.pending[name]
+		delete(c.pending, name)
+		if err != nil {
+			p.err = err
+		} else {
+			p.data = c.block(data, uint64(i))
+			blocks[i] = p.data
+		}
+		close(p.done)
+	}
+}
+
+// block returns the i-th block of data read from the first block of a run.
+func (c *DiskCache) block(data []byte, i uint64) []byte {
+	size := uint64(len(data))
+	return data[min(i*c.blockSize, size):min((i+1)*c.blockSize, size)]
+}
+
+// read reads the blocks from first to last of an object from the object store
+// and caches them. The data of the last block of the object stops where the
+// object does.
+func (c *DiskCache) read(ctx context.Context, key string, first, last uint64) ([]byte, error) {
+	c.misses.Add(last - first + 1)
+
+	data, err := c.store.GetObject(ctx, key, [2]uint64{first * c.blockSize, (last+1)*c.blockSize - 1})
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks that can't be cached are still served
+	for i := uint64(0); i <= last-first; i++ {
+		if block := c.block(data, i); len(block) > 0 {
+			c.put(c.cacheName(key, first+i), block)
+		}
+	}
+
+	return data, nil
+}
+
+// get reads a cached block and marks it as the most recently used.
+func (c *DiskCache) get(name string) ([]byte, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	elem, ok := c.entries[name]
+	var size uint64
+	var touch bool
+	if ok {
+		c.lru.MoveToFront(elem)
+		entry := elem.Value.(*cacheEntry)
+		size = entry.size
+		if now.Sub(entry.touchedAt) >= touchInterval {
+			entry.touchedAt, touch = now, true
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil || uint64(len(data)) != size {
+		// Evicted meanwhile, or damaged outside of the cache
+		c.remove(name)
+		return nil, false
+	}
+
+	// The next run orders the blocks by the modification time of their files
+	if touch {
+		os.Chtimes(path, now, now)
+	}
+
+	return data, true
+}
+
+// put caches a block read from the object store, evicting the least recently
+// used blocks if needed.
+func (c *DiskCache) put(name string, data []byte) {
+	size := uint64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	// Readers never see a partially written file
+	f, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		// Cached by a concurrent read of the same block
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, size: size, touchedAt: time.Now()})
+	c.size += size
+	c.evictLocked()
+}
+
+// evictLocked drops the least recently used blocks until the cache fits its
+// size limit. c.mu must be held.
+func (c *DiskCache) evictLocked() {
+	for c.size > c.maxBytes {
+		elem := c.lru.Back()
+		if elem == nil {
+			return
+		}
+		c.removeLocked(elem)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *DiskCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[name]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// removeLocked drops a cached block. c.mu must be held.
+func (c *DiskCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.name))
+}
+
+// DeleteObject deletes an object from the object store and drops its cached
+// blocks.
+func (c *DiskCache) DeleteObject(ctx context.Context, key string) error {
+	if err := c.store.DeleteObject(ctx, key); err != nil {
+		return err
+	}
+
+	hash := keyHash(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, elem := range c.entries {
+		if h, _, _, ok := parseCacheName(name); ok && h == hash {
+			c.removeLocked(elem)
+		}
+	}
+
+	return nil
+}
+
+func (c *DiskCache) PutObject(ctx context.Context, key string, data []byte) error {
+	return c.store.PutObject(ctx, key, data)
+}
+
+func (c *DiskCache) PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error {
+	return c.store.PutObjectReader(ctx, key, body)
+}
+
+func (c *DiskCache) ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return c.store.ListObjects(ctx, prefix)
+}
+
+// Stats returns the counters of the cache.
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   len(c.entries),
+		Bytes:     c.size,
+	}
+}
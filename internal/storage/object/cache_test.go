@@ -0,0 +1,242 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is an in-memory Store that counts the reads that reach it.
+type memStore struct {
+	objects map[string][]byte
+	gets    int
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte)}
+}
+
+func (s *memStore) PutObject(ctx context.Context, key string, data []byte) error {
+	s.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memStore) PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		return err
+	}
+	return s.PutObject(ctx, key, buf.Bytes())
+}
+
+func (s *memStore) GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error) {
+	s.gets++
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	// Like S3, a range past the end of the object stops at the end
+	return append([]byte(nil), data[dataRange[0]:min(dataRange[1]+1, uint64(len(data)))]...), nil
+}
+
+func (s *memStore) DeleteObject(ctx context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStore) ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: uint64(len(data))})
+		}
+	}
+	return objects, nil
+}
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	require.NoError(t, store.PutObject(ctx, "a", []byte("0123456789")))
+	require.NoError(t, store.PutObject(ctx, "b", []byte("abcdefghij")))
+
+	cache, err := NewDiskCache(store, t.TempDir(), 1<<20, 4)
+	require.NoError(t, err)
+
+	for range 3 {
+		data, err := cache.GetObject(ctx, "a", [2]uint64{2, 5})
+		require.NoError(t, err)
+		assert.Equal(t, "2345", string(data))
+	}
+	assert.Equal(t, 1, store.gets, "Only the first read should reach the object store, for both of its blocks")
+
+	// Overlapping ranges share the blocks they have in common
+	data, err := cache.GetObject(ctx, "a", [2]uint64{3, 6})
+	require.NoError(t, err)
+	assert.Equal(t, "3456", string(data))
+	assert.Equal(t, 1, store.gets)
+
+	// The last block of an object is shorter
+	data, err = cache.GetObject(ctx, "a", [2]uint64{7, 9})
+	require.NoError(t, err)
+	assert.Equal(t, "789", string(data))
+	assert.Equal(t, 2, store.gets)
+
+	data, err = cache.GetObject(ctx, "b", [2]uint64{0, 1})
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(data))
+
+	assert.Equal(t, CacheStats{Hits: 7, Misses: 4, Entries: 4, Bytes: 14}, cache.Stats())
+
+	// Deleting an object drops its blocks
+	require.NoError(t, cache.DeleteObject(ctx, "a"))
+	assert.Equal(t, 1, cache.Stats().Entries)
+	_, err = cache.GetObject(ctx, "a", [2]uint64{2, 5})
+	assert.Error(t, err)
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	require.NoError(t, store.PutObject(ctx, "a", []byte("0123456789")))
+
+	cache, err := NewDiskCache(store, t.TempDir(), 8, 4)
+	require.NoError(t, err)
+
+	get := func(r [2]uint64) {
+		_, err := cache.GetObject(ctx, "a", r)
+		require.NoError(t, err)
+	}
+
+	get([2]uint64{0, 3})
+	get([2]uint64{4, 7})
+	get([2]uint64{0, 3}) // now the most recently used
+	get([2]uint64{8, 9}) // evicts [4, 7]
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(6), stats.Bytes)
+
+	gets := store.gets
+	get([2]uint64{0, 3})
+	assert.Equal(t, gets, store.gets, "The most recently used block should be kept")
+	get([2]uint64{4, 7})
+	assert.Equal(t, gets+1, store.gets, "The least recently used block should be evicted")
+
+	// A range larger than the cache is served all the same
+	data, err := cache.GetObject(ctx, "a", [2]uint64{0, 9})
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	assert.LessOrEqual(t, cache.Stats().Bytes, uint64(8))
+}
+
+func TestDiskCacheRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := newMemStore()
+	require.NoError(t, store.PutObject(ctx, "a", []byte("0123456789")))
+
+	cache, err := NewDiskCache(store, dir, 1<<20, 4)
+	require.NoError(t, err)
+	_, err = cache.GetObject(ctx, "a", [2]uint64{0, 4})
+	require.NoError(t, err)
+
+	// A hit doesn't write to the file of the block every time
+	path := filepath.Join(dir, cache.cacheName("a", 0))
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+	old := before.ModTime().Add(-time.Second)
+	require.NoError(t, os.Chtimes(path, old, old))
+	_, err = cache.GetObject(ctx, "a", [2]uint64{0, 4})
+	require.NoError(t, err)
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, old, after.ModTime())
+
+	// A file left behind by a process that died while filling the cache
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0644))
+
+	cache, err = NewDiskCache(store, dir, 1<<20, 4)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{Entries: 2, Bytes: 8}, cache.Stats())
+
+	data, err := cache.GetObject(ctx, "a", [2]uint64{0, 4})
+	require.NoError(t, err)
+	assert.Equal(t, "01234", string(data))
+	assert.Equal(t, 1, store.gets, "Blocks cached before the restart should be served from disk")
+
+	_, err = os.Stat(filepath.Join(dir, "tmp-123"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Blocks of another size are dropped
+	cache, err = NewDiskCache(store, dir, 1<<20, 8)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{}, cache.Stats())
+}
+
+// gatedStore is a Store whose reads wait for a gate to open.
+type gatedStore struct {
+	*memStore
+	gate chan struct{}
+	gets atomic.Int64
+}
+
+func (s *gatedStore) GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error) {
+	s.gets.Add(1)
+	<-s.gate
+	return []byte("0123456789")[dataRange[0]:min(dataRange[1]+1, 10)], nil
+}
+
+func TestDiskCacheConcurrentReads(t *testing.T) {
+	ctx := context.Background()
+	store := &gatedStore{memStore: newMemStore(), gate: make(chan struct{})}
+
+	cache, err := NewDiskCache(store, t.TempDir(), 1<<20, 4)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := cache.GetObject(ctx, "a", [2]uint64{2, 5})
+			assert.NoError(t, err)
+			assert.Equal(t, "2345", string(data))
+		}()
+	}
+	close(store.gate)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), store.gets.Load(), "Concurrent reads of a range should make a single request")
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(14), stats.Hits)
+
+	// A read canceled while waiting for another one gives up
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	store.gate = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = cache.GetObject(ctx, "b", [2]uint64{0, 1})
+	}()
+	for store.gets.Load() < 2 {
+		runtime.Gosched()
+	}
+	_, err = cache.GetObject(canceled, "b", [2]uint64{0, 1})
+	assert.ErrorIs(t, err, context.Canceled)
+	close(store.gate)
+	<-done
+}
@@ -5,12 +5,20 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// ObjectInfo describes an object stored in the object store.
+type ObjectInfo struct {
+	Key          string
+	Size         uint64
+	LastModified time.Time
+}
+
 type S3Store struct {
 	client     *s3.Client
 	bucketName string
@@ -24,11 +32,16 @@ func NewS3(client *s3.Client, bucketName string) *S3Store {
 }
 
 func (s *S3Store) PutObject(ctx context.Context, key string, data []byte) error {
-	r := bytes.NewReader(data)
+	return s.PutObjectReader(ctx, key, bytes.NewReader(data))
+}
+
+// PutObjectReader uploads the content of body, which is read from its current
+// position to its end, without loading it in memory.
+func (s *S3Store) PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error {
 	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:            aws.String(s.bucketName),
 		Key:               aws.String(key),
-		Body:              r,
+		Body:              body,
 		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
 	})
 	if err != nil {
@@ -63,3 +76,44 @@ func (s *S3Store) GetObject(ctx context.Context, key string, dataRange [2]uint64
 
 	return data, nil
 }
+
+// DeleteObject removes the object with the given key. Deleting a key that does
+// not exist is not an error.
+func (s *S3Store) DeleteObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object from S3: %w", err)
+	}
+
+	return nil
+}
+
+// ListObjects returns every object whose key starts with prefix.
+func (s *S3Store) ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in S3: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         uint64(aws.ToInt64(obj.Size)),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
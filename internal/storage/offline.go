@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// mountLockKey identifies the PostgreSQL advisory lock that writable mounts
+// hold shared and offline operations hold exclusively.
+const mountLockKey int64 = 0x717561636b6673 // "quackfs"
+
+// ErrMounted is returned when an offline operation can't run because some
+// process has the files mounted for writing.
+var ErrMounted = errors.New("files are mounted for writing")
+
+// MountLock is a lock on the files of the metadata database, held by a
+// dedicated connection.
+type MountLock struct {
+	conn   *sql.Conn
+	unlock string // query releasing the lock
+}
+
+// LockMounted takes the lock a writable mount holds for as long as it runs.
+// Any number of mounts can hold it together, but it waits for offline
+// operations to finish.
+func (mgr *Manager) LockMounted(ctx context.Context) (*MountLock, error) {
+	conn, err := mgr.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a connection: %w", err)
+	}
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock_shared($1)", mountLockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to take the mount lock: %w", err)
+	}
+
+	return &MountLock{conn: conn, unlock: "SELECT pg_advisory_unlock_shared($1)"}, nil
+}
+
+// LockOffline takes the lock that operations changing the head of a file from
+// outside of the mount must hold, like a restore: the mount would keep writing
+// on top of the head it knows of. It fails with ErrMounted instead of waiting
+// if the files are mounted for writing.
+func (mgr *Manager) LockOffline(ctx context.Context) (*MountLock, error) {
+	conn, err := mgr.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a connection: %w", err)
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", mountLockKey).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to take the offline lock: %w", err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrMounted
+	}
+
+	return &MountLock{conn: conn, unlock: "SELECT pg_advisory_unlock($1)"}, nil
+}
+
+// Release releases the lock. The connection goes back to the pool, so the lock
+// must be released explicitly; PostgreSQL only drops it by itself when the
+// process dies.
+func (l *MountLock) Release(ctx context.Context) error {
+	defer l.conn.Close()
+
+	if _, err := l.conn.ExecContext(ctx, l.unlock, mountLockKey); err != nil {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+
+	return nil
+}
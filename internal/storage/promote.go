@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// PromoteResult describes the outcome of promoting a file onto another.
+type PromoteResult struct {
+	FromLayerID uint64   // oldest layer that was moved
+	Layers      int      // number of layers moved
+	Versions    []string // tags of the versions moved, oldest first
+}
+
+// PromoteConflictError is returned by Promote when the target was changed after
+// the source diverged from it.
+type PromoteConflictError struct {
+	Src      string
+	Dst      string
+	Versions []string    // versions committed to Dst since the copy diverged
+	Overlaps [][2]uint64 // file ranges written to both files since the copy diverged
+}
+
+func (e *PromoteConflictError) Error() string {
+	return fmt.Sprintf("%s has %d versions committed since %s diverged from it, %d ranges were written to both",
+		e.Dst, len(e.Versions), e.Src, len(e.Overlaps))
+}
+
+// Promote makes the history written on src since it was copied from dst the
+// new history of dst. src must be a clone or a branch of dst. The layers of src
+// committed after the copy are re-parented onto dst, so no data is copied, and
+// src is then deleted. It all happens in one transaction: readers either see
+// dst before the promotion or with the whole history of src on top of it.
+//
+// The promotion is refused with a *PromoteConflictError if dst has versions that
+// were committed after the copy, and with an error if either file has writes
+// that were not checkpointed or a version tag of src is already used in dst.
+//
+// Only the writes of this manager are checked: another process mounting either
+// file for writing would neither notice the promotion nor stop writing to src,
+// so callers outside of the mount must hold the offline lock, see LockOffline.
+func (mgr *Manager) Promote(ctx context.Context, src string, dst string) (*PromoteResult, error) {
+	if src == dst {
+		return nil, errors.New("cannot promote a file onto itself")
+	}
+
+	// Layers of checkpoints that are not committed yet would be left behind
+	for _, filename := range []string{src, dst} {
+		if err := mgr.Flush(ctx, filename); err != nil {
+			return nil, fmt.Errorf("failed to commit checkpoints of %s: %w", filename, err)
+		}
+	}
+
+	// Compaction and retention must not rewrite either history while it moves
+	mgr.compactMu.Lock()
+	defer mgr.compactMu.Unlock()
+
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	mgr.log.Debug("Promoting file", "src", src, "dst", dst)
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	srcID, err := mgr.metaStore.GetFileIDByName(ctx, src, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get source file ID", "src", src, "error", err)
+		return nil, fmt.Errorf("failed to get source file ID: %w", err)
+	}
+
+	dstID, err := mgr.metaStore.GetFileIDByName(ctx, dst, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get target file ID", "dst", dst, "error", err)
+		return nil, fmt.Errorf("failed to get target file ID: %w", err)
+	}
+
+	// Writes of other processes are kept out by the offline lock of the caller
+	for name, id := range map[string]uint64{src: srcID, dst: dstID} {
+		if state, ok := mgr.lookupFile(id); ok && state.hasData() {
+			err = fmt.Errorf("%s has writes that were not checkpointed", name)
+			return nil, err
+		}
+	}
+
+	children, err := mgr.metaStore.GetBranches(ctx, srcID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get branches", "src", src, "error", err)
+		return nil, err
+	}
+	if len(children) > 0 {
+		err = fmt.Errorf("%s has %d branches, delete them first", src, len(children))
+		return nil, err
+	}
+
+	srcLayers, err := mgr.metaStore.LoadLayersByFileID(ctx, srcID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "src", src, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	dstLayers, err := mgr.metaStore.LoadLayersWithAncestry(ctx, dstID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "dst", dst, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	moved, dstChanges, err := mgr.divergence(ctx, tx, src, srcID, srcLayers, dst, dstID, dstLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(moved) == 0 {
+		err = fmt.Errorf("%s has no versions committed since it diverged from %s", src, dst)
+		return nil, err
+	}
+
+	if len(dstChanges) > 0 {
+		conflict := &PromoteConflictError{Src: src, Dst: dst}
+		for _, layer := range dstChanges {
+			conflict.Versions = append(conflict.Versions, layer.Tag)
+		}
+
+		var srcWritten, dstWritten []metadata.Chunk
+		if srcWritten, err = mgr.layersChunks(ctx, moved); err != nil {
+			return nil, err
+		}
+		if dstWritten, err = mgr.layersChunks(ctx, dstChanges); err != nil {
+			return nil, err
+		}
+		conflict.Overlaps = metadata.IntersectRanges(metadata.WrittenRanges(srcWritten), metadata.WrittenRanges(dstWritten))
+
+		err = conflict
+		return nil, err
+	}
+
+	tags := make(map[string]struct{})
+	for _, layer := range dstLayers {
+		if layer.FileID == dstID {
+			tags[layer.Tag] = struct{}{}
+		}
+	}
+
+	result := &PromoteResult{FromLayerID: moved[0].ID, Layers: len(moved)}
+	for _, layer := range moved {
+		if _, ok := tags[layer.Tag]; ok {
+			err = fmt.Errorf("version %q of %s already exists in %s: %w", layer.Tag, src, dst, types.ErrAlreadyExists)
+			return nil, err
+		}
+		result.Versions = append(result.Versions, layer.Tag)
+	}
+
+	if err = mgr.metaStore.MoveLayers(ctx, tx, srcID, dstID, result.FromLayerID); err != nil {
+		mgr.log.Error("Failed to move layers", "src", src, "dst", dst, "error", err)
+		return nil, err
+	}
+
+	// What is left of src are the layers it shares with dst
+	if err = mgr.metaStore.DeleteFile(ctx, tx, srcID); err != nil {
+		mgr.log.Error("Failed to delete promoted file", "src", src, "error", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	mgr.forgetFile(srcID)
+
+	mgr.log.Info("File promoted", "src", src, "dst", dst, "layers", result.Layers)
+
+	return result, nil
+}
+
+// divergence splits the histories of src and dst at the point where src was
+// copied from dst. It returns the layers of src committed after that point and
+// the layers of dst committed after that point.
+//
+// A branch records the layer of its parent it was created from, and a clone the
+// layer of its source it was copied up to, together with the layer of the clone
+// holding the copy of it.
+func (mgr *Manager) divergence(ctx context.Context, tx *sql.Tx, src string, srcID uint64, srcLayers []*metadata.Layer,
+	dst string, dstID uint64, dstLayers []*metadata.Layer) ([]*metadata.Layer, []*metadata.Layer, error) {
+	branch, err := mgr.metaStore.GetBranch(ctx, srcID, metadata.WithTx(tx))
+	if err == nil && branch.ParentFileID == dstID {
+		var dstChanges []*metadata.Layer
+		for _, layer := range dstLayers {
+			if layer.ID > branch.BaseLayerID {
+				dstChanges = append(dstChanges, layer)
+			}
+		}
+		return srcLayers, dstChanges, nil
+	}
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		mgr.log.Error("Failed to get branch", "src", src, "error", err)
+		return nil, nil, err
+	}
+
+	clone, err := mgr.metaStore.GetClone(ctx, srcID, metadata.WithTx(tx))
+	if errors.Is(err, types.ErrNotFound) || (err == nil && clone.SourceFileID != dstID) {
+		return nil, nil, fmt.Errorf("%s is neither a clone nor a branch of %s", src, dst)
+	}
+	if err != nil {
+		mgr.log.Error("Failed to get clone", "src", src, "error", err)
+		return nil, nil, err
+	}
+
+	// Compaction keeps the ID of the newest layer of a run, so a layer folding
+	// changes made after the copy is never mistaken for one that was copied
+	var moved, dstChanges []*metadata.Layer
+	for _, layer := range srcLayers {
+		if layer.ID > clone.BaseLayerID {
+			moved = append(moved, layer)
+		}
+	}
+	for _, layer := range dstLayers {
+		if layer.ID > clone.SourceLayerID {
+			dstChanges = append(dstChanges, layer)
+		}
+	}
+
+	return moved, dstChanges, nil
+}
+
+// layersChunks returns the chunks of the given layers, oldest write first.
+func (mgr *Manager) layersChunks(ctx context.Context, layers []*metadata.Layer) ([]metadata.Chunk, error) {
+	var chunks []metadata.Chunk
+	for _, layer := range layers {
+		layerChunks, err := mgr.metaStore.GetLayerChunks(ctx, layer.ID)
+		if err != nil {
+			mgr.log.Error("Failed to load layer chunks", "layerID", layer.ID, "error", err)
+			return nil, fmt.Errorf("failed to load layer chunks: %w", err)
+		}
+		chunks = append(chunks, layerChunks...)
+	}
+	return chunks, nil
+}
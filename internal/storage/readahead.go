@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// ReadAheadPolicy configures how a Reader prefetches the reads that follow a
+// sequential scan. The window is counted in reads of the size the scan is made
+// of: DuckDB reads its file one block at a time, so a window of 8 prefetches
+// the next 8 blocks.
+type ReadAheadPolicy struct {
+	Trigger   int // sequential reads in a row after which read-ahead starts
+	MinWindow int // reads prefetched ahead when read-ahead starts
+	MaxWindow int // the window doubles every time the scan reaches the last prefetched reads, up to MaxWindow
+}
+
+// enabled reports whether the policy prefetches anything.
+func (p ReadAheadPolicy) enabled() bool {
+	return p.MaxWindow > 0
+}
+
+// WithReadAhead enables read-ahead for the Readers of the manager. Prefetched
+// data lands in the cache in front of the object store, and in the cache of
+// the metadata store, so it is only worth it with a cache. A MaxWindow of 0
+// disables read-ahead.
+func WithReadAhead(policy ReadAheadPolicy) Option {
+	return func(mgr *Manager) {
+		policy.Trigger = max(policy.Trigger, 1)
+		policy.MinWindow = max(policy.MinWindow, 1)
+		policy.MaxWindow = max(policy.MaxWindow, 0)
+		if policy.MaxWindow > 0 {
+			policy.MinWindow = min(policy.MinWindow, policy.MaxWindow)
+		}
+		mgr.readAhead = policy
+	}
+}
+
+// Reader reads a file through one open handle. Once the reads of the handle
+// have been sequential for long enough, it prefetches the reads expected to
+// come next in the background, so that the scan finds them in the cache instead
+// of waiting for the object store. Prefetching stops as soon as a read breaks
+// the pattern.
+type Reader struct {
+	mgr      *Manager
+	filename string
+	opts     []readFileOpt
+
+	mu         sync.Mutex
+	next       uint64 // offset right after the last read
+	size       uint64 // size of the last read
+	streak     int    // sequential reads in a row, including the last one
+	window     int    // reads prefetched ahead, 0 while read-ahead is off
+	prefetched uint64 // offset up to which reads have been prefetched
+	marker     uint64 // start of the last prefetched range, reading it prefetches the next one
+	ctx        context.Context
+	cancel     context.CancelFunc // cancels the prefetches in flight
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// NewReader returns a Reader of filename, reading the version selected by opts.
+// It must be closed once the handle is released.
+func (mgr *Manager) NewReader(filename string, opts ...readFileOpt) *Reader {
+	return &Reader{mgr: mgr, filename: filename, opts: opts}
+}
+
+// ReadFile is Manager.ReadFile for the file and version of the reader.
+func (r *Reader) ReadFile(ctx context.Context, offset uint64, size uint64) ([]byte, error) {
+	if r.mgr.readAhead.enabled() {
+		if prefetchCtx, start, end, ok := r.observe(offset, size); ok {
+			go r.prefetch(prefetchCtx, start, end)
+		}
+	}
+	return r.mgr.ReadFile(ctx, r.filename, offset, size, r.opts...)
+}
+
+// Close stops the prefetches in flight and waits for them to return.
+func (r *Reader) Close() {
+	r.mu.Lock()
+	r.closed = true
+	r.stopLocked()
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+// observe records a read and returns the range to prefetch after it, if the
+// scan is about to run out of prefetched reads, with the context to prefetch
+// it in. The caller must run prefetch for that range.
+func (r *Reader) observe(offset uint64, size uint64) (context.Context, uint64, uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || size == 0 {
+		return nil, 0, 0, false
+	}
+
+	if offset != r.next || size != r.size {
+		if r.window > 0 {
+			r.mgr.log.Debug("Read-ahead stopped", "filename", r.filename, "offset", offset, "expected", r.next)
+		}
+		r.stopLocked()
+		r.streak = 0
+	}
+
+	r.streak++
+	r.next = offset + size
+	r.size = size
+
+	policy := r.mgr.readAhead
+	if r.streak < policy.Trigger {
+		return nil, 0, 0, false
+	}
+
+	if r.window == 0 {
+		r.window = policy.MinWindow
+		r.prefetched = r.next
+		r.marker = offset
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+		r.mgr.log.Debug("Read-ahead started", "filename", r.filename, "offset", r.next, "window", r.window)
+	}
+
+	// The scan reaching the last prefetched range shows that prefetching pays
+	// off, so the next range is prefetched while the scan reads that one, with a
+	// larger window
+	if offset < r.marker {
+		return nil, 0, 0, false
+	}
+	start := max(r.prefetched, r.next)
+	end := start + uint64(r.window)*size
+	r.marker, r.prefetched = start, end
+	r.window = min(r.window*2, policy.MaxWindow)
+
+	r.wg.Add(1)
+	return r.ctx, start, end, true
+}
+
+// stopLocked cancels the prefetches in flight and turns read-ahead off. r.mu
+// must be held.
+func (r *Reader) stopLocked() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.ctx, r.cancel = nil, nil
+	r.window = 0
+}
+
+// prefetch fetches the committed data of [start, end) of the file, throwing it
+// away: fetching is enough to fill the cache the next reads come from.
+func (r *Reader) prefetch(ctx context.Context, start, end uint64) {
+	defer r.wg.Done()
+
+	if err := r.mgr.prefetch(ctx, r.filename, [2]uint64{start, end}, r.opts...); err != nil && ctx.Err() == nil {
+		r.mgr.log.Debug("Read-ahead failed", "filename", r.filename, "offset", start, "error", err)
+	}
+}
+
+// prefetch fetches the committed chunks visible in a range of a file, as of the
+// version selected by opts, in a single batch of range requests. The extent map
+// is resolved once for the whole range, and the range stops where the file does.
+// Data written since the last checkpoint is in memory already, the committed
+// bytes it shadows are fetched all the same.
+func (mgr *Manager) prefetch(ctx context.Context, filename string, rng [2]uint64, opts ...readFileOpt) error {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	options := readFileOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	var versionedLayerID uint64
+	if options.hasVersion() {
+		versionedLayerID, err = mgr.resolveVersionedLayer(ctx, nil, fileID, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	chunks, err := mgr.metaStore.GetAllOverlappingChunks(ctx, nil, fileID, rng, nil,
+		metadata.WithVersionedLayerID(versionedLayerID))
+	if err != nil {
+		return fmt.Errorf("failed to get overlapping chunks: %w", err)
+	}
+
+	// The chunks of the extent map don't overlap, so they are all visible
+	_, err = mgr.fetchChunks(ctx, chunks)
+	return err
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/charmbracelet/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadPattern(t *testing.T) {
+	const block = 100
+
+	mgr := &Manager{log: log.New(io.Discard)}
+	WithReadAhead(ReadAheadPolicy{Trigger: 2, MinWindow: 2, MaxWindow: 8})(mgr)
+	r := mgr.NewReader("test.duckdb")
+
+	// read observes a read and returns the range it prefetches, if any
+	read := func(offset, size uint64) [2]uint64 {
+		ctx, start, end, ok := r.observe(offset, size)
+		if !ok {
+			return [2]uint64{}
+		}
+		require.NoError(t, ctx.Err())
+		r.wg.Done() // nothing is actually prefetched
+		return [2]uint64{start, end}
+	}
+
+	assert.Zero(t, read(0, block), "A single read is not a pattern yet")
+	assert.Equal(t, [2]uint64{200, 400}, read(100, block), "The second sequential read should start read-ahead")
+	assert.Equal(t, [2]uint64{400, 800}, read(200, block), "The window should double as the scan reaches the prefetched reads")
+	assert.Zero(t, read(300, block), "The next range is prefetched only once the scan reaches the last one")
+	assert.Equal(t, [2]uint64{800, 1600}, read(400, block))
+	for offset := uint64(500); offset < 800; offset += block {
+		assert.Zero(t, read(offset, block))
+	}
+	assert.Equal(t, [2]uint64{1600, 2400}, read(800, block), "The window should not grow past MaxWindow")
+	assert.Equal(t, 8, r.window)
+
+	// A jump breaks the pattern and cancels the prefetches in flight
+	ctx := r.ctx
+	assert.Zero(t, read(5000, block))
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.Zero(t, r.window)
+	assert.Equal(t, [2]uint64{5200, 5400}, read(5100, block), "Read-ahead should start over with the smallest window")
+
+	// So does a read of another size at the expected offset
+	assert.Zero(t, read(5200, 2*block))
+	assert.Zero(t, r.window)
+
+	r.Close()
+	assert.Zero(t, read(5400, block), "A closed reader should not prefetch")
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/google/uuid"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// Restore makes the given version the new head of a file. Writes that this
+// manager did not checkpoint yet are discarded. History is never rewritten: the
+// version is committed as a new layer on top of the current head, tagged
+// restore-<uuid>, so the restore can itself be inspected or undone. The new tag
+// is returned.
+//
+// The restored layer holds no data: its chunks point at the bytes of the
+// version in the objects of the layers they come from, and holes shadow
+// whatever the head has on top of them. So a restore only writes metadata,
+// whatever the size of the file.
+//
+// Layers can only add bytes to a file, so when the head is larger than the
+// restored version the file keeps its size and the bytes past the end of the
+// version read as zeros.
+//
+// Another process mounting the file for writing would neither see its writes
+// discarded nor notice the restore, so callers outside of the mount must hold
+// the offline lock, see LockOffline.
+func (mgr *Manager) Restore(ctx context.Context, filename string, version string) (string, error) {
+	if version == "" {
+		return "", errors.New("a version to restore is required")
+	}
+
+	tag, state, seq, err := mgr.restore(ctx, filename, version)
+	if err != nil {
+		return "", err
+	}
+
+	if err := mgr.waitFlushed(ctx, state, seq); err != nil {
+		return "", fmt.Errorf("failed to commit restored version: %w", err)
+	}
+
+	mgr.log.Info("File restored", "filename", filename, "version", version, "tag", tag)
+
+	return tag, nil
+}
+
+// restore replaces the writes to a file that were not checkpointed yet by the
+// chunks of a version, and starts committing them. It returns the tag of the new
+// version and the sequence number of its checkpoint.
+func (mgr *Manager) restore(ctx context.Context, filename string, version string) (string, *fileState, uint64, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	mgr.log.Debug("Restoring file", "filename", filename, "version", version)
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return "", nil, 0, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	versionedLayerID, err := mgr.resolveVersionedLayer(ctx, nil, fileID, readFileOpts{version: version})
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("failed to resolve version %q: %w", version, err)
+	}
+
+	chunks, err := mgr.metaStore.GetAllOverlappingChunks(ctx, nil, fileID, [2]uint64{0, math.MaxInt64},
+		nil, metadata.WithVersionedLayerID(versionedLayerID))
+	if err != nil {
+		mgr.log.Error("Failed to get chunks of version", "version", version, "error", err)
+		return "", nil, 0, fmt.Errorf("failed to get chunks of version %q: %w", version, err)
+	}
+
+	// Every byte up to the end of the version is covered, the parts the version
+	// never wrote by holes
+	var restored []metadata.Chunk
+	var versionSize uint64
+	for _, extent := range metadata.Resolve(chunks) {
+		if extent.FileRange[0] > versionSize {
+			restored = append(restored, zeroChunk(versionSize, extent.FileRange[0]))
+		}
+		versionSize = extent.FileRange[1]
+
+		if extent.Chunk.Zero {
+			restored = append(restored, zeroChunk(extent.FileRange[0], extent.FileRange[1]))
+			continue
+		}
+
+		objectKey, err := mgr.chunkObjectKey(ctx, extent.Chunk)
+		if err != nil {
+			mgr.log.Error("Failed to get object key", "layerID", extent.Chunk.LayerID, "error", err)
+			return "", nil, 0, err
+		}
+		if objectKey == "" {
+			return "", nil, 0, fmt.Errorf("layer %d of version %q has no object", extent.Chunk.LayerID, version)
+		}
+
+		restored = append(restored, metadata.Chunk{
+			LayerRange: extent.LayerRange(),
+			FileRange:  extent.FileRange,
+			ObjectKey:  objectKey,
+		})
+	}
+
+	state := mgr.file(fileID)
+	state.checkpointMu.Lock()
+	defer state.checkpointMu.Unlock()
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if err := state.failing(); err != nil {
+		return "", nil, 0, err
+	}
+
+	// Checkpoints that are not committed yet will be part of the head by the time
+	// the restored version is
+	headSize, err := mgr.metaStore.CalcSizeOf(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to calculate size of file", "error", err)
+		return "", nil, 0, fmt.Errorf("failed to calculate size of file: %w", err)
+	}
+	for _, f := range state.flushing {
+		for _, chunk := range f.layer.Chunks {
+			headSize = max(headSize, chunk.FileRange[1])
+		}
+	}
+
+	// A hole past the end of the version shadows every byte written after it
+	size := max(headSize, versionSize)
+	if size == 0 {
+		return "", nil, 0, fmt.Errorf("%s has no committed data, nothing to restore", filename)
+	}
+	if size > versionSize {
+		restored = append(restored, zeroChunk(versionSize, size))
+	}
+
+	discarded := state.active
+	if discarded != nil {
+		mgr.log.Warn("Discarding writes that were not checkpointed", "filename", filename, "bytes", discarded.DataSize())
+		if err := discarded.Release(); err != nil {
+			mgr.log.Warn("Failed to remove spill file of discarded layer", "filename", filename, "error", err)
+		}
+	}
+	state.active = nil
+
+	if mgr.journal != nil {
+		if err := mgr.journal.Discard(fileID); err != nil {
+			mgr.log.Warn("Failed to discard journal", "filename", filename, "error", err)
+		}
+	}
+
+	layer := &metadata.Layer{
+		FileID: fileID,
+		Active: true,
+		Chunks: restored,
+	}
+
+	// The restored version is not journaled: Restore only returns once it is
+	// committed
+	tag := fmt.Sprintf("%s%s", restoreTagPrefix, uuid.New().String())
+	seq := mgr.enqueue(ctx, filename, fileID, state, layer, tag)
+
+	mgr.log.Debug("Restored version frozen", "filename", filename, "version", version, "tag", tag, "size", size, "chunks", len(restored))
+
+	return tag, state, seq, nil
+}
+
+// zeroChunk returns a hole covering [start, end) of a file.
+func zeroChunk(start uint64, end uint64) metadata.Chunk {
+	return metadata.Chunk{FileRange: [2]uint64{start, end}, Zero: true}
+}
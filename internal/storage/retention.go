@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vinimdocarmo/quackfs/db/sqlc"
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// Prefixes of the tags that quackfs generates for the versions it creates.
+// Any other tag was chosen by a user and is never expired.
+const (
+	checkpointTagPrefix = "checkpoint-" // checkpoints triggered by DuckDB through the WAL manager
+	autoTagPrefix       = "auto-"       // checkpoints the manager takes on its own, by policy or on a remote sync
+	restoreTagPrefix    = "restore-"    // versions created by restoring an earlier version
+)
+
+// generatedTagPrefixes are the prefixes that users cannot give to their tags.
+var generatedTagPrefixes = []string{checkpointTagPrefix, autoTagPrefix, restoreTagPrefix}
+
+// isGeneratedTag reports whether a tag was generated rather than chosen by a
+// user.
+func isGeneratedTag(tag string) bool {
+	for _, prefix := range generatedTagPrefixes {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNamedTag reports whether a tag was chosen by a user.
+func isNamedTag(tag string) bool {
+	return tag != "" && !isGeneratedTag(tag)
+}
+
+// RetentionPolicy decides which versions of a file are kept. A version is kept
+// if any rule keeps it; the zero policy keeps every version. The newest version
+// and versions with user-named tags are always kept.
+type RetentionPolicy struct {
+	KeepLast   int           // keep the n newest versions
+	KeepWithin time.Duration // keep versions newer than this
+	KeepHourly int           // keep the newest version of each of the last n hours that have versions
+	KeepDaily  int           // keep the newest version of each of the last n days that have versions
+	KeepWeekly int           // keep the newest version of each of the last n weeks that have versions
+}
+
+// IsZero reports whether the policy has no rules, i.e. keeps everything.
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// String formats the policy the way it is set from the command line.
+func (p RetentionPolicy) String() string {
+	if p.IsZero() {
+		return "keep everything"
+	}
+
+	var rules []string
+	if p.KeepLast > 0 {
+		rules = append(rules, fmt.Sprintf("keep-last=%d", p.KeepLast))
+	}
+	if p.KeepWithin > 0 {
+		rules = append(rules, fmt.Sprintf("keep-within=%s", p.KeepWithin))
+	}
+	if p.KeepHourly > 0 {
+		rules = append(rules, fmt.Sprintf("keep-hourly=%d", p.KeepHourly))
+	}
+	if p.KeepDaily > 0 {
+		rules = append(rules, fmt.Sprintf("keep-daily=%d", p.KeepDaily))
+	}
+	if p.KeepWeekly > 0 {
+		rules = append(rules, fmt.Sprintf("keep-weekly=%d", p.KeepWeekly))
+	}
+
+	return strings.Join(rules, " ")
+}
+
+// RetentionDecision tells whether a version is kept by a policy and why.
+type RetentionDecision struct {
+	Layer  *metadata.Layer
+	Keep   bool
+	Reason string // rule that keeps the version, empty if it expires
+}
+
+// Evaluate applies the policy to the layers of a file, ordered from the oldest
+// to the newest, and returns one decision per layer in the same order.
+func (p RetentionPolicy) Evaluate(layers []*metadata.Layer, now time.Time) []RetentionDecision {
+	decisions := make([]RetentionDecision, len(layers))
+	for i, layer := range layers {
+		decisions[i].Layer = layer
+	}
+
+	keep := func(i int, reason string) {
+		if !decisions[i].Keep {
+			decisions[i].Keep = true
+			decisions[i].Reason = reason
+		}
+	}
+
+	buckets := []struct {
+		n      int
+		reason string
+		key    func(time.Time) string
+	}{
+		{p.KeepHourly, "hourly", func(t time.Time) string { return t.UTC().Format("2006-01-02T15") }},
+		{p.KeepDaily, "daily", func(t time.Time) string { return t.UTC().Format("2006-01-02") }},
+		{p.KeepWeekly, "weekly", func(t time.Time) string {
+			year, week := t.UTC().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+
+	seen := make([]map[string]bool, len(buckets))
+	for b := range buckets {
+		seen[b] = make(map[string]bool)
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		newest := len(layers) - 1 - i
+
+		if newest == 0 {
+			keep(i, "head")
+		}
+		if p.IsZero() {
+			keep(i, "no policy")
+		}
+		if isNamedTag(layer.Tag) {
+			keep(i, "named tag")
+		}
+		if newest < p.KeepLast {
+			keep(i, "last")
+		}
+		if p.KeepWithin > 0 && now.Sub(layer.CreatedAt) < p.KeepWithin {
+			keep(i, "within")
+		}
+
+		for b, bucket := range buckets {
+			key := bucket.key(layer.CreatedAt)
+			if bucket.n > 0 && !seen[b][key] && len(seen[b]) < bucket.n {
+				seen[b][key] = true
+				keep(i, bucket.reason)
+			}
+		}
+	}
+
+	// A kept version that was compacted reads the data of the layer it was folded
+	// into, so that layer has to be kept as well
+	index := make(map[uint64]int, len(layers))
+	for i, layer := range layers {
+		index[layer.ID] = i
+	}
+	for i := range decisions {
+		if !decisions[i].Keep || decisions[i].Layer.CompactedInto == 0 {
+			continue
+		}
+		if j, ok := index[decisions[i].Layer.CompactedInto]; ok {
+			keep(j, "compacted into")
+		}
+	}
+
+	return decisions
+}
+
+// RetentionResult describes the outcome of applying a retention policy.
+type RetentionResult struct {
+	Policy      RetentionPolicy
+	Decisions   []RetentionDecision
+	Expired     int                 // versions dropped (or that would be, on a dry run)
+	Compactions []*CompactionResult // compactions that folded expired data into kept layers
+}
+
+// GetRetentionPolicy returns the retention policy of a file. Files without a
+// policy get the zero policy, which keeps everything.
+func (mgr *Manager) GetRetentionPolicy(ctx context.Context, filename string) (RetentionPolicy, error) {
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return RetentionPolicy{}, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	return mgr.getRetentionPolicy(ctx, fileID)
+}
+
+func (mgr *Manager) getRetentionPolicy(ctx context.Context, fileID uint64) (RetentionPolicy, error) {
+	row, err := mgr.metaStore.GetRetentionPolicy(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			return RetentionPolicy{}, nil
+		}
+		mgr.log.Error("Failed to get retention policy", "fileID", fileID, "error", err)
+		return RetentionPolicy{}, err
+	}
+
+	return RetentionPolicy{
+		KeepLast:   int(row.KeepLast),
+		KeepWithin: time.Duration(row.KeepWithinSeconds) * time.Second,
+		KeepHourly: int(row.KeepHourly),
+		KeepDaily:  int(row.KeepDaily),
+		KeepWeekly: int(row.KeepWeekly),
+	}, nil
+}
+
+// SetRetentionPolicy stores the retention policy of a file. It is only enforced
+// by ApplyRetention.
+func (mgr *Manager) SetRetentionPolicy(ctx context.Context, filename string, policy RetentionPolicy) error {
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	err = mgr.metaStore.SetRetentionPolicy(ctx, sqlc.RetentionPolicy{
+		FileID:            fileID,
+		KeepLast:          int32(policy.KeepLast),
+		KeepWithinSeconds: int64(policy.KeepWithin / time.Second),
+		KeepHourly:        int32(policy.KeepHourly),
+		KeepDaily:         int32(policy.KeepDaily),
+		KeepWeekly:        int32(policy.KeepWeekly),
+	})
+	if err != nil {
+		mgr.log.Error("Failed to set retention policy", "filename", filename, "error", err)
+		return err
+	}
+
+	mgr.log.Info("Retention policy set", "filename", filename, "policy", policy)
+
+	return nil
+}
+
+// ApplyRetention expires the versions of a file that its retention policy does
+// not keep. The data of an expired layer that is still visible in a later
+// version is first folded into the next kept layer by compaction, so every kept
+// version, and thus the head, reads exactly the same bytes as before. The
+// expired layers and their versions are then deleted. Their objects are left to
+// the garbage collector. Versions that branches and clones were created from are
+// kept.
+//
+// On a dry run the decisions are computed and returned but nothing changes.
+func (mgr *Manager) ApplyRetention(ctx context.Context, filename string, dryRun bool) (*RetentionResult, error) {
+	mgr.compactMu.Lock()
+	defer mgr.compactMu.Unlock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	policy, err := mgr.getRetentionPolicy(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get retention policy: %w", err)
+	}
+
+	layers, err := mgr.metaStore.LoadLayersByFileID(ctx, fileID)
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	boundaries, err := mgr.runBoundaries(ctx, fileID, layers)
+	if err != nil {
+		mgr.log.Error("Failed to get run boundaries", "filename", filename, "error", err)
+		return nil, err
+	}
+
+	result := &RetentionResult{
+		Policy:    policy,
+		Decisions: policy.Evaluate(layers, time.Now()),
+	}
+
+	// Branches and clones read or compare this file as of the versions they were
+	// created from, which expired layers must not be folded past
+	for i, d := range result.Decisions {
+		if reason, ok := boundaries[d.Layer.ID]; ok && !d.Keep {
+			result.Decisions[i].Keep = true
+			result.Decisions[i].Reason = reason
+		}
+	}
+
+	var expired []*metadata.Layer
+	for _, d := range result.Decisions {
+		if !d.Keep {
+			expired = append(expired, d.Layer)
+		}
+	}
+	result.Expired = len(expired)
+
+	if dryRun || len(expired) == 0 {
+		return result, nil
+	}
+
+	// Fold every run of expired live layers into the live layer that follows it.
+	// The newest layer is always kept, so such a layer always exists.
+	var run []*metadata.Layer
+	for _, d := range result.Decisions {
+		if d.Layer.CompactedInto != 0 {
+			continue
+		}
+
+		run = append(run, d.Layer)
+		if !d.Keep {
+			continue
+		}
+
+		if len(run) > 1 {
+			compaction, err := mgr.compactLayers(ctx, filename, fileID, run)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fold expired layers: %w", err)
+			}
+			result.Compactions = append(result.Compactions, compaction)
+		}
+		run = nil
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	// Oldest first: a compacted layer always points to a newer layer, which may
+	// itself be expired
+	for _, layer := range expired {
+		if err = mgr.metaStore.DeleteLayer(ctx, tx, layer); err != nil {
+			mgr.log.Error("Failed to delete expired layer", "layerID", layer.ID, "tag", layer.Tag, "error", err)
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	mgr.log.Info("Retention policy applied", "filename", filename, "policy", policy, "expired", result.Expired, "kept", len(layers)-result.Expired)
+
+	return result, nil
+}
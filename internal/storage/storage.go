@@ -3,53 +3,189 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/dustin/go-humanize"
+	"github.com/google/uuid"
 	"github.com/vinimdocarmo/quackfs/db/sqlc"
 	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/journal"
 	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+	objectstore "github.com/vinimdocarmo/quackfs/internal/storage/object"
 )
 
 type objectStore interface {
 	// PutObject uploads data to the object store.
 	PutObject(ctx context.Context, key string, data []byte) error
+	// PutObjectReader uploads the content of body to the object store.
+	PutObjectReader(ctx context.Context, key string, body io.ReadSeeker) error
 	// GetObject returns a slice of data from the given offset up to size bytes.
 	// Range is inclusive of the start and the end (i.e. [start, end])
 	GetObject(ctx context.Context, key string, dataRange [2]uint64) ([]byte, error)
+	// DeleteObject removes an object from the object store.
+	DeleteObject(ctx context.Context, key string) error
+	// ListObjects returns every object whose key starts with prefix.
+	ListObjects(ctx context.Context, prefix string) ([]objectstore.ObjectInfo, error)
 }
 
 type Manager struct {
-	db          *sql.DB
-	log         *log.Logger
-	mu          sync.RWMutex               // Add a mutex to protect memtable
-	memtable    map[uint64]*metadata.Layer // Stores a mapping of file ids to their active layer
-	objectStore objectStore
-	metaStore   *metadata.MetadataStore
+	db             *sql.DB
+	log            *log.Logger
+	mu             sync.RWMutex          // held for reading by operations on a single file, for writing by those that span files, see fileState
+	memtableMu     sync.Mutex            // guards the memtable map, not the layers it holds
+	memtable       map[uint64]*fileState // Stores a mapping of file ids to their layers held in memory
+	compactMu      sync.Mutex            // Serializes compactions
+	objectStore    objectStore
+	metaStore      *metadata.MetadataStore
+	spillDir       string // directory of the spill files of large active layers
+	spillThreshold uint64 // active layers larger than this are moved to a spill file, 0 keeps them in memory
+	journalDir     string
+	journal        *journal.Journal // local copy of the writes in the memtable, nil if disabled
+	durability     Durability       // what Sync guarantees
+
+	fetchGap         uint64          // bytes between two ranges of an object under which a read fetches them together
+	fetchConcurrency int             // range requests a read makes at the same time
+	readAhead        ReadAheadPolicy // how Readers prefetch ahead of sequential scans, disabled while MaxWindow is 0
+}
+
+// Option configures optional behavior of the storage manager
+type Option func(*Manager)
+
+// WithSpill moves the data of an active layer to an append-only file in dir
+// once it grows past threshold bytes, so that memory usage stays bounded no
+// matter how much is written between checkpoints. A threshold of 0 keeps
+// active layers in memory.
+func WithSpill(dir string, threshold uint64) Option {
+	return func(mgr *Manager) {
+		mgr.spillDir = dir
+		mgr.spillThreshold = threshold
+	}
+}
+
+// WithJournal records every write to an active layer in a journal in dir before
+// applying it, so that writes that were not checkpointed survive a crash of the
+// process. The journal of a file is removed once its writes are checkpointed.
+func WithJournal(dir string) Option {
+	return func(mgr *Manager) {
+		mgr.journalDir = dir
+	}
 }
 
 // NewManager creates (or reloads) a StorageManager using the provided metadataStore.
-func NewManager(db *sql.DB, store objectStore, log *log.Logger) *Manager {
+// If a journal is configured, the writes it holds are replayed into the memtable
+// so that reads see them again.
+func NewManager(db *sql.DB, store objectStore, log *log.Logger, opts ...Option) (*Manager, error) {
 	managerLog := log.With()
 	managerLog.SetPrefix("💽 storage")
 
 	sm := &Manager{
 		db:          db,
 		log:         managerLog,
-		memtable:    make(map[uint64]*metadata.Layer),
+		memtable:    make(map[uint64]*fileState),
 		objectStore: store,
 		metaStore:   metadata.NewMetadataStore(db),
+
+		fetchGap:         defaultFetchGap,
+		fetchConcurrency: defaultFetchConcurrency,
+	}
+
+	for _, opt := range opts {
+		opt(sm)
+	}
+
+	if sm.durability == "" {
+		sm.durability = DurabilityNone
+		if sm.journalDir != "" {
+			sm.durability = DurabilityLocal
+		}
+	}
+	if sm.durability == DurabilityLocal && sm.journalDir == "" {
+		return nil, fmt.Errorf("%s durability requires a journal", DurabilityLocal)
+	}
+
+	if sm.journalDir != "" {
+		if err := sm.replayJournal(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	return sm, nil
+}
+
+// replayJournal opens the journal and applies the writes it holds to the
+// memtable. The checkpoints of a file are committed one after the other, and the
+// frozen journal of one is removed before the next one is committed, so a crash
+// can only leave the journal of the newest committed checkpoint behind. Its
+// writes are applied once more, under the writes made after it, which is
+// harmless since they write the bytes it committed at the same offsets. The
+// writes of files that no longer exist, deleted while the manager was down, are
+// skipped and their journals removed.
+func (mgr *Manager) replayJournal(ctx context.Context) error {
+	j, err := journal.Open(mgr.journalDir)
+	if err != nil {
+		mgr.log.Error("Failed to open journal", "dir", mgr.journalDir, "error", err)
+		return err
 	}
 
-	return sm
+	var writes int
+	exists := make(map[uint64]bool)
+	skipped := make(map[uint64]int) // writes skipped by file
+	dropped, err := j.Replay(func(fileID uint64, r journal.Record) error {
+		ok, checked := exists[fileID]
+		if !checked {
+			if ok, err = mgr.metaStore.FileExists(ctx, fileID); err != nil {
+				return err
+			}
+			exists[fileID] = ok
+		}
+		if !ok {
+			skipped[fileID]++
+			return nil
+		}
+
+		writes++
+		switch {
+		case r.Hole > 0:
+			return mgr.punchHole(ctx, mgr.file(fileID), fileID, r.Offset, r.Hole)
+		case r.Extends():
+			return mgr.extend(ctx, mgr.file(fileID), fileID, r.Offset)
+		}
+		return mgr.writeFile(ctx, mgr.file(fileID), fileID, r.Data, r.Offset)
+	})
+	if err != nil {
+		mgr.log.Error("Failed to replay journal", "dir", mgr.journalDir, "error", err)
+		j.Close()
+		return fmt.Errorf("failed to replay journal: %w", err)
+	}
+
+	for fileID, n := range skipped {
+		mgr.log.Warn("Skipped journaled writes of a file that no longer exists", "fileID", fileID, "writes", n)
+		if err := j.Remove(fileID); err != nil {
+			mgr.log.Warn("Failed to remove journal", "fileID", fileID, "error", err)
+		}
+	}
+
+	if dropped > 0 {
+		mgr.log.Warn("Dropped torn writes at the end of the journal", "bytes", dropped)
+	}
+	if writes > 0 {
+		mgr.log.Info("Replayed journal", "files", len(mgr.memtable), "writes", writes)
+	}
+
+	mgr.journal = j
+
+	return nil
 }
 
 // WriteFile writes data to the active layer at the specified offset.
 func (mgr *Manager) WriteFile(ctx context.Context, filename string, data []byte, offset uint64) error {
-	mgr.mu.Lock()         // Lock before accessing activeLayers
-	defer mgr.mu.Unlock() // Ensure unlock when function returns
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
 
 	mgr.log.Debug("Writing data", "filename", filename, "size", len(data), "offset", offset)
 
@@ -60,45 +196,34 @@ func (mgr *Manager) WriteFile(ctx context.Context, filename string, data []byte,
 		return fmt.Errorf("failed to get file ID: %w", err)
 	}
 
-	activeLayer, exists := mgr.memtable[fileID]
-	if !exists {
-		activeLayer = &metadata.Layer{
-			FileID: fileID,
-			Chunks: []metadata.Chunk{},
-			Data:   []byte{},
-			Active: true,
+	state := mgr.file(fileID)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if mgr.journal != nil {
+		if err := mgr.journal.Append(fileID, offset, data); err != nil {
+			mgr.log.Error("Failed to journal write", "filename", filename, "error", err)
+			return err
 		}
-		mgr.memtable[fileID] = activeLayer
 	}
 
-	fileSize, err := mgr.calcSizeOf(ctx, fileID)
+	return mgr.writeFile(ctx, state, fileID, data, offset)
+}
+
+// writeFile applies a write to the active layer of a file. state.mu must be
+// held for writing.
+func (mgr *Manager) writeFile(ctx context.Context, state *fileState, fileID uint64, data []byte, offset uint64) error {
+	activeLayer := state.activeLayer(fileID)
+
+	fileSize, err := mgr.calcSizeOf(ctx, fileID, state)
 	if err != nil {
 		mgr.log.Error("Failed to calculate size of file", "error", err)
 		return fmt.Errorf("failed to calculate size of file: %w", err)
 	}
 
 	if offset > fileSize {
-		// Calculate how many zero bytes to add
-		bytesToAdd := offset - fileSize
-
-		// Create a buffer of zero bytes
-		zeroes := make([]byte, bytesToAdd)
-
-		var layerSize uint64 = 0
-		if len(activeLayer.Chunks) > 0 {
-			layerSize = activeLayer.Chunks[len(activeLayer.Chunks)-1].FileRange[1]
-		}
-
-		layerRange := [2]uint64{layerSize, layerSize + bytesToAdd}
-		fileRange := [2]uint64{fileSize, fileSize + bytesToAdd}
-
-		activeLayer.Data = append(activeLayer.Data, zeroes...)
-		activeLayer.Chunks = append(activeLayer.Chunks, metadata.Chunk{
-			LayerRange: layerRange,
-			FileRange:  fileRange,
-			Flushed:    false, // since we're writing to the active layer, it's not flushed yet
-		})
-		activeLayer.Size = layerRange[1]
+		// The gap up to the write reads as zeros without taking any space
+		appendHole(activeLayer, [2]uint64{fileSize, offset})
 	}
 
 	var layerSize uint64 = 0
@@ -111,7 +236,10 @@ func (mgr *Manager) WriteFile(ctx context.Context, filename string, data []byte,
 	layerRange := [2]uint64{layerSize, layerSize + uint64(len(data))}
 	fileRange := [2]uint64{offset, offset + uint64(len(data))}
 
-	activeLayer.Data = append(activeLayer.Data, data...)
+	if err := activeLayer.AppendData(data); err != nil {
+		mgr.log.Error("Failed to append to active layer", "fileID", fileID, "error", err)
+		return err
+	}
 	activeLayer.Chunks = append(activeLayer.Chunks, metadata.Chunk{
 		LayerRange: layerRange,
 		FileRange:  fileRange,
@@ -119,6 +247,122 @@ func (mgr *Manager) WriteFile(ctx context.Context, filename string, data []byte,
 	})
 	activeLayer.Size = layerRange[1]
 
+	if mgr.spillThreshold > 0 && !activeLayer.Spilled() && activeLayer.DataSize() > mgr.spillThreshold {
+		if err := activeLayer.SpillTo(mgr.spillDir); err != nil {
+			mgr.log.Error("Failed to spill active layer to disk", "fileID", fileID, "error", err)
+			return err
+		}
+		mgr.log.Info("Active layer spilled to disk", "fileID", fileID, "size", humanize.Bytes(activeLayer.DataSize()))
+	}
+
+	return nil
+}
+
+// appendHole adds a chunk to an active layer that makes a range of the file
+// read as zeros.
+func appendHole(layer *metadata.Layer, fileRange [2]uint64) {
+	layerSize := layer.DataSize()
+	layer.Chunks = append(layer.Chunks, metadata.Chunk{
+		LayerRange: [2]uint64{layerSize, layerSize},
+		FileRange:  fileRange,
+		Flushed:    false,
+		Zero:       true,
+	})
+}
+
+// PunchHole deallocates a range of a file, which reads as zeros afterwards.
+// Like fallocate(FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE), it never changes
+// the size of the file: the part of the range past the end of the file is
+// ignored.
+func (mgr *Manager) PunchHole(ctx context.Context, filename string, offset uint64, length uint64) error {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	mgr.log.Debug("Punching hole", "filename", filename, "offset", offset, "length", length)
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state := mgr.file(fileID)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if mgr.journal != nil {
+		if err := mgr.journal.AppendHole(fileID, offset, length); err != nil {
+			mgr.log.Error("Failed to journal hole", "filename", filename, "error", err)
+			return err
+		}
+	}
+
+	return mgr.punchHole(ctx, state, fileID, offset, length)
+}
+
+// punchHole applies a hole to the active layer of a file. state.mu must be held
+// for writing.
+func (mgr *Manager) punchHole(ctx context.Context, state *fileState, fileID uint64, offset uint64, length uint64) error {
+	fileSize, err := mgr.calcSizeOf(ctx, fileID, state)
+	if err != nil {
+		mgr.log.Error("Failed to calculate size of file", "error", err)
+		return fmt.Errorf("failed to calculate size of file: %w", err)
+	}
+
+	end := min(offset+length, fileSize)
+	if offset >= end {
+		return nil
+	}
+
+	appendHole(state.activeLayer(fileID), [2]uint64{offset, end})
+
+	return nil
+}
+
+// Extend extends a file up to size bytes, like fallocate(0) past the end of the
+// file: the new bytes read as zeros without taking any space. A file that is
+// already at least size bytes long is left unchanged.
+func (mgr *Manager) Extend(ctx context.Context, filename string, size uint64) error {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	mgr.log.Debug("Extending file", "filename", filename, "size", size)
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state := mgr.file(fileID)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if mgr.journal != nil {
+		if err := mgr.journal.AppendExtension(fileID, size); err != nil {
+			mgr.log.Error("Failed to journal extension", "filename", filename, "error", err)
+			return err
+		}
+	}
+
+	return mgr.extend(ctx, state, fileID, size)
+}
+
+// extend applies an extension to the active layer of a file. state.mu must be
+// held for writing.
+func (mgr *Manager) extend(ctx context.Context, state *fileState, fileID uint64, size uint64) error {
+	fileSize, err := mgr.calcSizeOf(ctx, fileID, state)
+	if err != nil {
+		mgr.log.Error("Failed to calculate size of file", "error", err)
+		return fmt.Errorf("failed to calculate size of file: %w", err)
+	}
+
+	if size <= fileSize {
+		return nil
+	}
+
+	appendHole(state.activeLayer(fileID), [2]uint64{fileSize, size})
+
 	return nil
 }
 
@@ -126,32 +370,87 @@ func (mgr *Manager) GetActiveLayerSize(ctx context.Context, fileID uint64) uint6
 	mgr.mu.RLock() // Read lock is sufficient for reading
 	defer mgr.mu.RUnlock()
 
-	activeLayer, exists := mgr.memtable[fileID]
+	state, exists := mgr.lookupFile(fileID)
 	if !exists {
 		return 0
 	}
-	return activeLayer.Size
+
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	if state.active == nil {
+		return 0
+	}
+	return state.active.Size
 }
 
 func (mgr *Manager) GetActiveLayerData(ctx context.Context, fileID uint64) []byte {
 	mgr.mu.RLock() // Read lock is sufficient for reading
 	defer mgr.mu.RUnlock()
 
-	l, exists := mgr.memtable[fileID]
+	state, exists := mgr.lookupFile(fileID)
 	if !exists {
 		return nil
 	}
 
-	return l.Data
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	l := state.active
+	if l == nil {
+		return nil
+	}
+
+	data, err := l.ReadData([2]uint64{0, l.DataSize()})
+	if err != nil {
+		mgr.log.Error("Failed to read active layer data", "fileID", fileID, "error", err)
+		return nil
+	}
+
+	return data
+}
+
+// SizeOf returns the size of the file in bytes. If a version is given through
+// WithVersion, the size is calculated as of that version and the active layer
+// is ignored.
+func (mgr *Manager) SizeOf(ctx context.Context, filename string, opts ...readFileOpt) (uint64, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	options := readFileOpts{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return mgr.sizeOf(ctx, filename, options)
 }
 
-func (mgr *Manager) SizeOf(ctx context.Context, filename string) (uint64, error) {
+// sizeOf is SizeOf for callers that already hold mgr.mu.
+func (mgr *Manager) sizeOf(ctx context.Context, filename string, options readFileOpts) (uint64, error) {
 	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
 	if err != nil {
 		return 0, err
 	}
 
-	return mgr.calcSizeOf(ctx, fileID)
+	if !options.hasVersion() {
+		state, ok := mgr.lookupFile(fileID)
+		if !ok {
+			return mgr.calcSizeOf(ctx, fileID, nil)
+		}
+
+		state.mu.RLock()
+		defer state.mu.RUnlock()
+
+		return mgr.calcSizeOf(ctx, fileID, state)
+	}
+
+	versionedLayerID, err := mgr.resolveVersionedLayer(ctx, nil, fileID, options)
+	if err != nil {
+		mgr.log.Error("Version not found or error fetching layer", "version", options.version, "at", options.at, "filename", filename, "error", err)
+		return 0, err
+	}
+
+	return mgr.metaStore.CalcSizeOfVersion(ctx, fileID, versionedLayerID)
 }
 
 // readFileOpt defines functional options for GetDataRange
@@ -160,6 +459,12 @@ type readFileOpt func(*readFileOpts)
 // readFileOpts holds all options for GetDataRange
 type readFileOpts struct {
 	version string
+	at      time.Time
+}
+
+// hasVersion reports whether the options select a past version of the file
+func (opts readFileOpts) hasVersion() bool {
+	return opts.version != "" || !opts.at.IsZero()
 }
 
 // WithVersion specifies a version tag to retrieve data up to
@@ -170,6 +475,45 @@ func WithVersion(v string) readFileOpt {
 	}
 }
 
+// WithTimestamp retrieves data as of the newest version committed at or before t.
+// A zero time is ignored and the current database state is used.
+func WithTimestamp(t time.Time) readFileOpt {
+	return func(opts *readFileOpts) {
+		opts.at = t
+	}
+}
+
+// resolveVersionedLayer returns the ID of the committed layer selected by the
+// version tag or timestamp in opts.
+func (mgr *Manager) resolveVersionedLayer(ctx context.Context, tx *sql.Tx, fileID uint64, opts readFileOpts) (uint64, error) {
+	if opts.version != "" && !opts.at.IsZero() {
+		return 0, fmt.Errorf("cannot read by version tag and timestamp at the same time")
+	}
+
+	var layer *metadata.Layer
+	var err error
+
+	if opts.version != "" {
+		layer, err = mgr.metaStore.GetLayerByVersion(ctx, fileID, opts.version, tx)
+	} else {
+		layer, err = mgr.metaStore.GetLayerByTimestamp(ctx, fileID, opts.at, tx)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The layer was folded into a newer one by compaction, which only holds the
+	// state of the file at the end of the compacted run
+	if layer.CompactedInto != 0 {
+		if opts.version != "" {
+			return 0, fmt.Errorf("%w: %s", ErrVersionCompacted, opts.version)
+		}
+		return 0, fmt.Errorf("%w: version as of %s", ErrVersionCompacted, opts.at.Format(time.RFC3339))
+	}
+
+	return layer.ID, nil
+}
+
 // ReadFile returns a slice of data from the given offset up to size bytes.
 // Optional version tag can be specified to retrieve data up to a specific version.
 func (mgr *Manager) ReadFile(ctx context.Context, filename string, offset uint64, size uint64, opts ...readFileOpt) ([]byte, error) {
@@ -181,7 +525,12 @@ func (mgr *Manager) ReadFile(ctx context.Context, filename string, offset uint64
 		opt(&options)
 	}
 
-	hasVersion := options.version != ""
+	return mgr.readFile(ctx, filename, offset, size, options)
+}
+
+// readFile is ReadFile for callers that already hold mgr.mu.
+func (mgr *Manager) readFile(ctx context.Context, filename string, offset uint64, size uint64, options readFileOpts) ([]byte, error) {
+	hasVersion := options.hasVersion()
 	var versionedLayerId uint64
 
 	if hasVersion {
@@ -189,7 +538,8 @@ func (mgr *Manager) ReadFile(ctx context.Context, filename string, offset uint64
 			"filename", filename,
 			"offset", offset,
 			"size", size,
-			"version", options.version)
+			"version", options.version,
+			"at", options.at)
 	} else {
 		mgr.log.Debug("reading file",
 			"filename", filename,
@@ -197,28 +547,13 @@ func (mgr *Manager) ReadFile(ctx context.Context, filename string, offset uint64
 			"size", size)
 	}
 
-	tx, err := mgr.db.BeginTx(ctx, &sql.TxOptions{
-		ReadOnly: true,
-	})
-	if err != nil {
-		mgr.log.Error("Failed to begin transaction", "error", err)
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
-	defer func() {
-		if p := recover(); p != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
-			}
-			panic(p)
-		} else if err != nil {
-			if rbErr := tx.Rollback(); rbErr != nil {
-				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
-			}
-		}
-	}()
-
-	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename, metadata.WithTx(tx))
+	// The metadata of committed layers is read outside of a transaction so that
+	// it comes from the cache of the metadata store. Committed chunks come with
+	// the keys of their objects, so a compaction committed during the read, by
+	// this process or another one, can't pair them with the object that replaces
+	// theirs, and a checkpoint committed meanwhile only adds a layer whose data is
+	// still read from memory.
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
 	if fileID == 0 {
 		mgr.log.Error("File not found", "filename", filename)
 		return nil, fmt.Errorf("file not found")
@@ -228,90 +563,117 @@ func (mgr *Manager) ReadFile(ctx context.Context, filename string, offset uint64
 		return nil, fmt.Errorf("failed to get file ID: %w", err)
 	}
 
-	// check if there's a layer for this file with the given version tag
+	// check if there's a layer for this file with the given version tag or timestamp
 	if hasVersion {
-		versionedLayer, err := mgr.metaStore.GetLayerByVersion(ctx, fileID, options.version, tx)
+		versionedLayerId, err = mgr.resolveVersionedLayer(ctx, nil, fileID, options)
 		if err != nil {
-			mgr.log.Error("Version tag not found or error fetching layer", "version", options.version, "filename", filename, "error", err)
+			mgr.log.Error("Version not found or error fetching layer", "version", options.version, "at", options.at, "filename", filename, "error", err)
 			return nil, err
 		}
-		versionedLayerId = versionedLayer.ID
 	}
 
-	activeLayer, exists := mgr.memtable[fileID]
-	var activeLayerPtr *metadata.Layer
-	if exists {
-		activeLayerPtr = activeLayer
+	// The layers held in memory must stay until the read is over, a checkpoint
+	// drops them once they are committed
+	var memLayers []*metadata.Layer
+	if !hasVersion {
+		if state, ok := mgr.lookupFile(fileID); ok {
+			state.mu.RLock()
+			defer state.mu.RUnlock()
+			memLayers = state.layers()
+		}
 	}
 
-	chunks, err := mgr.metaStore.GetAllOverlappingChunks(ctx, tx, fileID, [2]uint64{offset, offset + size},
-		activeLayerPtr, metadata.WithVersionedLayerID(versionedLayerId))
+	readRange := [2]uint64{offset, offset + size}
+
+	chunks, err := mgr.metaStore.GetAllOverlappingChunks(ctx, nil, fileID, readRange,
+		nil, metadata.WithVersionedLayerID(versionedLayerId))
 	if err != nil {
 		mgr.log.Error("Failed to get overlapping chunks", "error", err)
 		return nil, err
 	}
 
+	// Layers held in memory are newer than every committed layer, so their chunks
+	// come last
+	sources := chunks
+	layers := make([]*metadata.Layer, len(chunks)) // layer held in memory of each source, nil if it is committed
+	for _, layer := range memLayers {
+		for _, chunk := range layer.Chunks {
+			if metadata.RangesOverlap(chunk.FileRange, readRange) {
+				sources = append(sources, chunk)
+				layers = append(layers, layer)
+			}
+		}
+	}
+
 	var maxEndOffset uint64
-	for _, chunk := range chunks {
+	for _, chunk := range sources {
 		if chunk.FileRange[1] > maxEndOffset {
 			maxEndOffset = chunk.FileRange[1]
 		}
 	}
 
-	buf := make([]byte, maxEndOffset-offset)
+	buf := make([]byte, max(maxEndOffset, offset)-offset)
 
-	for _, chunk := range chunks {
-		var bufferPos uint64
-		var chunkStartPos uint64
-		var dataSize uint64
-		var data []byte
+	// Only the bytes of the read that no newer chunk overwrote are read, holes
+	// need nothing since the buffer starts zeroed
+	var visible []metadata.IndexedExtent
+	var committed []metadata.Chunk
+	for _, e := range metadata.ResolveIndexed(sources) {
+		extent, ok := e.Within(readRange)
+		if !ok || extent.Chunk.Zero {
+			continue
+		}
+		e.Extent = extent
+		visible = append(visible, e)
+
+		// A restored version held in memory only points into committed objects
+		if layers[e.Index] == nil || extent.Chunk.ObjectKey != "" {
+			committed = append(committed, metadata.Chunk{
+				LayerID:    extent.Chunk.LayerID,
+				Flushed:    true,
+				LayerRange: extent.LayerRange(),
+				FileRange:  extent.FileRange,
+				ObjectKey:  extent.Chunk.ObjectKey,
+			})
+		}
+	}
 
-		// The layer for this chunk hasn't been flushed to storage yet. It's in the active layer.
-		if !chunk.Flushed {
-			data = activeLayer.Data[chunk.LayerRange[0]:chunk.LayerRange[1]]
-		} else {
-			data, err = mgr.getChunkData(ctx, chunk)
-			if err != nil {
-				mgr.log.Error("Failed to get chunk data", "error", err)
-				return nil, fmt.Errorf("failed to get chunk data: %w", err)
-			}
+	fetched, err := mgr.fetchChunks(ctx, committed)
+	if err != nil {
+		// A canceled read, like a prefetch that turned out useless, is no error
+		if ctx.Err() == nil {
+			mgr.log.Error("Failed to get chunk data", "error", err)
 		}
+		return nil, fmt.Errorf("failed to get chunk data: %w", err)
+	}
 
-		if chunk.FileRange[0] < offset {
-			// Chunk starts before the requested offset
-			// We only want to copy the portion starting from the requested offset
-			chunkStartPos = offset - chunk.FileRange[0]
-			bufferPos = 0
+	for _, e := range visible {
+		var data []byte
 
-			dataSize = uint64(len(data)) - chunkStartPos
+		// The layer for this chunk hasn't been flushed to storage yet. It's in memory.
+		if layer := layers[e.Index]; layer != nil && e.Chunk.ObjectKey == "" {
+			data, err = layer.ReadData(e.LayerRange())
+			if err != nil {
+				mgr.log.Error("Failed to read active layer data", "error", err)
+				return nil, fmt.Errorf("failed to read active layer data: %w", err)
+			}
 		} else {
-			bufferPos = chunk.FileRange[0] - offset
-			chunkStartPos = 0
-			dataSize = uint64(len(data))
+			data, fetched = fetched[0], fetched[1:]
 		}
 
-		// Calculate the end position in the buffer
-		endPos := bufferPos + dataSize
-
-		if endPos <= uint64(len(buf)) {
-			copy(buf[bufferPos:endPos], data[chunkStartPos:chunkStartPos+dataSize])
-		}
+		copy(buf[e.FileRange[0]-offset:], data)
 	}
 
 	if uint64(len(buf)) > size {
 		buf = buf[:size]
 	}
 
-	if err = tx.Commit(); err != nil {
-		mgr.log.Error("Failed to commit transaction", "error", err)
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
-	}
-
 	if hasVersion {
 		mgr.log.Debug("Returning data range with version",
 			"offset", offset,
 			"size", len(buf),
-			"version", options.version)
+			"version", options.version,
+			"at", options.at)
 	} else {
 		mgr.log.Debug("Returning data range",
 			"offset", offset,
@@ -335,6 +697,124 @@ func (mgr *Manager) InsertFile(ctx context.Context, name string) (uint64, error)
 	return fileID, nil
 }
 
+// CloneFile creates a new file named dst whose history is the history of src up
+// to the given version tag (or up to its latest committed version if the tag is
+// empty). The clone references the same layer objects as src, so no data is
+// copied in the object store. Writes to the clone go into its own layers and
+// never affect src. Data in src's active layer is not part of the clone.
+func (mgr *Manager) CloneFile(ctx context.Context, src string, dst string, version string) (uint64, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	mgr.log.Debug("Cloning file", "src", src, "dst", dst, "version", version)
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	srcID, err := mgr.metaStore.GetFileIDByName(ctx, src, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get source file ID", "src", src, "error", err)
+		return 0, fmt.Errorf("failed to get source file ID: %w", err)
+	}
+
+	// Keeps a compaction from folding the clone point into a newer layer
+	if err = mgr.metaStore.LockFile(ctx, tx, srcID); err != nil {
+		mgr.log.Error("Failed to lock source file", "src", src, "error", err)
+		return 0, err
+	}
+
+	var versionedLayerID uint64
+	if version != "" {
+		versionedLayerID, err = mgr.resolveVersionedLayer(ctx, tx, srcID, readFileOpts{version: version})
+		if err != nil {
+			mgr.log.Error("Version tag not found or error fetching layer", "version", version, "src", src, "error", err)
+			return 0, err
+		}
+	}
+
+	// A branch is cloned with the history it inherits from its ancestors
+	layers, err := mgr.metaStore.LoadLayersWithAncestry(ctx, srcID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "src", src, "error", err)
+		return 0, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	dstID, err := mgr.metaStore.InsertFile(ctx, dst, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to insert clone", "dst", dst, "error", err)
+		return 0, fmt.Errorf("failed to insert clone: %w", err)
+	}
+
+	// The newest layer of src that is copied and its copy, which promotions
+	// tell the history of the clone apart from the one it shares with src by
+	var cloned int
+	var sourceLayerID, baseLayerID uint64
+	for _, layer := range layers {
+		if versionedLayerID != 0 && layer.ID > versionedLayerID {
+			break
+		}
+		sourceLayerID = layer.ID
+
+		// Compacted layers hold no data of their own, it lives in the layer they were folded into
+		if layer.CompactedInto != 0 {
+			continue
+		}
+
+		var versionID, layerID uint64
+
+		versionID, err = mgr.metaStore.InsertVersion(ctx, tx, dstID, layer.Tag)
+		if err != nil {
+			mgr.log.Error("Failed to insert version for clone", "tag", layer.Tag, "error", err)
+			return 0, err
+		}
+
+		layerID, err = mgr.metaStore.InsertLayer(ctx, tx, dstID, versionID, layer.ObjectKey)
+		if err != nil {
+			mgr.log.Error("Failed to insert layer for clone", "objectKey", layer.ObjectKey, "error", err)
+			return 0, err
+		}
+
+		if err = mgr.metaStore.CopyLayerChunks(ctx, tx, layer.ID, layerID); err != nil {
+			mgr.log.Error("Failed to copy layer chunks for clone", "layerID", layer.ID, "error", err)
+			return 0, err
+		}
+
+		baseLayerID = layerID
+		cloned++
+	}
+
+	if err = mgr.metaStore.InsertClone(ctx, tx, dstID, srcID, sourceLayerID, baseLayerID); err != nil {
+		mgr.log.Error("Failed to record clone", "src", src, "dst", dst, "error", err)
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	mgr.metaStore.Invalidate()
+
+	mgr.log.Info("File cloned", "src", src, "dst", dst, "version", version, "layers", cloned)
+
+	return dstID, nil
+}
+
 // calcSizeOf calculates the total byte size of the virtual file from all layers and their chunks, respecting layer creation order and handling overlapping file ranges.
 //
 // File offset →    0    5    10   15   20   25   30   35   40
@@ -347,44 +827,146 @@ func (mgr *Manager) InsertFile(ctx context.Context, name string) (uint64, error)
 //	              							         File size = 44
 //
 // File size is determined by the highest end offset across all chunks
-func (mgr *Manager) calcSizeOf(ctx context.Context, fileID uint64, opts ...metadata.QueryOpt) (uint64, error) {
-	activeLayer, exists := mgr.memtable[fileID]
-	if exists && activeLayer != nil && len(activeLayer.Chunks) > 0 {
-		endOffset := uint64(0)
-		for _, chunk := range activeLayer.Chunks {
-			if chunk.FileRange[1] > endOffset {
-				endOffset = chunk.FileRange[1]
+func (mgr *Manager) calcSizeOf(ctx context.Context, fileID uint64, state *fileState) (uint64, error) {
+	size, err := mgr.metaStore.CalcSizeOf(ctx, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Layers held in memory are not committed yet, state.mu must be held
+	if state != nil {
+		for _, layer := range state.layers() {
+			for _, chunk := range layer.Chunks {
+				size = max(size, chunk.FileRange[1])
 			}
 		}
-		return endOffset, nil
 	}
 
-	highestOffsetCommited, err := mgr.metaStore.CalcSizeOf(ctx, fileID, opts...)
+	return size, nil
+}
+
+// Checkpoint persists the active layer to storage and creates a new version.
+// It returns once the version is committed, but reads and writes of the file
+// don't wait for it, see StartCheckpoint.
+func (mgr *Manager) Checkpoint(ctx context.Context, filename string, version string) error {
+	state, seq, err := mgr.startCheckpoint(ctx, filename, version)
+	if err != nil || seq == 0 {
+		return err
+	}
+
+	return mgr.waitFlushed(ctx, state, seq)
+}
+
+// StartCheckpoint freezes the active layer of a file and returns while it is
+// committed in the background as a new version. The frozen layer is read from
+// memory until then, and a new active layer takes the writes. Checkpoints of a
+// file are committed in the order they were started, see Flush.
+//
+// Without a journal, the frozen writes would be lost in a crash before they are
+// committed, so StartCheckpoint waits for the commit like Checkpoint.
+func (mgr *Manager) StartCheckpoint(ctx context.Context, filename string, version string) error {
+	state, seq, err := mgr.startCheckpoint(ctx, filename, version)
+	if err != nil || seq == 0 || mgr.journal != nil {
+		return err
+	}
+
+	return mgr.waitFlushed(ctx, state, seq)
+}
+
+// startCheckpoint freezes the active layer of a file and returns the sequence
+// number of the checkpoint committing it, or 0 if there is nothing to wait for.
+func (mgr *Manager) startCheckpoint(ctx context.Context, filename string, version string) (*fileState, uint64, error) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
 	if err != nil {
+		if err == types.ErrNotFound {
+			mgr.log.Warn("File not found, nothing to checkpoint", "filename", filename)
+			return nil, 0, nil
+		}
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, 0, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	state := mgr.file(fileID)
+	state.checkpointMu.Lock()
+	defer state.checkpointMu.Unlock()
+
+	seq, err := mgr.freezeActive(ctx, filename, fileID, state, version)
+	if err != nil || seq != 0 {
+		return state, seq, err
+	}
+
+	// The writes were already committed by an automatic checkpoint, its version
+	// takes the tag unless it was generated too
+	if !isGeneratedTag(version) {
+		seq, retagged, err := mgr.retagAutoVersion(ctx, fileID, state, version)
+		if err != nil {
+			return state, 0, fmt.Errorf("failed to tag version: %w", err)
+		}
+		if retagged {
+			mgr.log.Debug("Automatic checkpoint tagged", "filename", filename, "tag", version)
+			return state, seq, nil
+		}
+	}
+
+	mgr.log.Warn("No active layer or data to checkpoint", "filename", filename)
+	return state, 0, nil // No active layer means no changes to checkpoint
+}
+
+// freezeActive queues the active layer of a file to be committed as a new
+// version with the given tag, and returns the sequence number of the checkpoint,
+// or 0 if there was nothing to commit. state.checkpointMu must be held.
+func (mgr *Manager) freezeActive(ctx context.Context, filename string, fileID uint64, state *fileState, version string) (uint64, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if err := state.failing(); err != nil {
 		return 0, err
 	}
 
-	var highestOffsetInActiveLayer uint64
-	if exists && activeLayer != nil {
-		for _, chunk := range activeLayer.Chunks {
-			if chunk.FileRange[1] > highestOffsetInActiveLayer {
-				highestOffsetInActiveLayer = chunk.FileRange[1]
-			}
+	if state.active == nil || !state.active.Changed() {
+		return 0, nil
+	}
+
+	seq := state.queued + 1
+	if mgr.journal != nil {
+		if err := mgr.journal.Freeze(fileID, seq); err != nil {
+			mgr.log.Error("Failed to freeze journal", "filename", filename, "error", err)
+			return 0, err
 		}
 	}
 
-	return max(highestOffsetCommited, highestOffsetInActiveLayer), nil
+	mgr.enqueue(ctx, filename, fileID, state, state.active, version)
+	state.active = nil
+
+	return seq, nil
 }
 
-// Checkpoint persists the active layer to storage and creates a new version
-func (mgr *Manager) Checkpoint(ctx context.Context, filename string, version string) error {
-	mgr.mu.Lock()         // Lock before accessing activeLayers
-	defer mgr.mu.Unlock() // Ensure unlock when function returns
+// uploadLayer uploads the data of a layer to a new object and returns its key.
+// The object is only referenced once commitLayer commits the layer, until then
+// the grace period of the garbage collector protects it.
+func (mgr *Manager) uploadLayer(ctx context.Context, filename string, fileID uint64, data io.ReadSeeker) (string, error) {
+	objectKey := fmt.Sprintf("layers/%s/%d-%s", filename, fileID, uuid.New().String())
+
+	if err := mgr.objectStore.PutObjectReader(ctx, objectKey, data); err != nil {
+		mgr.log.Error("Failed to upload data to object store", "error", err)
+		return "", fmt.Errorf("failed to upload data to object store: %w", err)
+	}
+
+	return objectKey, nil
+}
 
+// commitLayer commits a layer whose data was uploaded to objectKey with its
+// chunks as a new version of a file, and returns the ID of the version. A layer
+// without data, whose chunks are holes or point into the objects of other
+// layers, has no object. mgr.mu must be held.
+func (mgr *Manager) commitLayer(ctx context.Context, fileID uint64, chunks []metadata.Chunk, objectKey string, version string) (uint64, error) {
 	tx, err := mgr.db.BeginTx(ctx, nil)
 	if err != nil {
 		mgr.log.Error("Failed to begin transaction", "error", err)
-		return err
+		return 0, err
 	}
 
 	// Setup deferred rollback in case of error or panic
@@ -402,94 +984,126 @@ func (mgr *Manager) Checkpoint(ctx context.Context, filename string, version str
 		}
 	}()
 
-	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename, metadata.WithTx(tx))
-	if err != nil {
-		if err == types.ErrNotFound {
-			mgr.log.Warn("File not found, nothing to checkpoint", "filename", filename)
-			return nil
-		}
-		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
-		return fmt.Errorf("failed to get file ID: %w", err)
-	}
-
-	activeLayer, exists := mgr.memtable[fileID]
-	if !exists || len(activeLayer.Data) == 0 {
-		mgr.log.Warn("No active layer or data to checkpoint", "filename", filename)
-		return nil // No active layer means no changes to checkpoint
-	}
-
-	versionID, err := mgr.metaStore.InsertVersion(ctx, tx, version)
+	versionID, err := mgr.metaStore.InsertVersion(ctx, tx, fileID, version)
 	if err != nil {
 		mgr.log.Error("Failed to insert new version", "tag", version, "error", err)
-		return fmt.Errorf("failed to insert new version: %w", err)
-	}
-
-	objectKey := fmt.Sprintf("layers/%s/%d-%d", filename, fileID, versionID)
-
-	err = mgr.objectStore.PutObject(ctx, objectKey, activeLayer.Data)
-	if err != nil {
-		mgr.log.Error("Failed to upload data to object store", "error", err)
-		return fmt.Errorf("failed to upload data to object store: %w", err)
+		return 0, fmt.Errorf("failed to insert new version: %w", err)
 	}
 
 	layerID, err := mgr.metaStore.InsertLayer(ctx, tx, fileID, versionID, objectKey)
 	if err != nil {
 		mgr.log.Error("Failed to commit layer with version", "error", err)
-		return fmt.Errorf("failed to commit layer with version: %w", err)
+		return 0, fmt.Errorf("failed to commit layer with version: %w", err)
 	}
 
-	for _, c := range activeLayer.Chunks {
+	for _, c := range chunks {
 		err = mgr.metaStore.InsertChunk(ctx, layerID, c, metadata.WithTx(tx))
 		if err != nil {
 			mgr.log.Error("Failed to commit layer's chunks", "error", err)
-			return fmt.Errorf("failed to commit layer's chunks: %w", err)
+			return 0, fmt.Errorf("failed to commit layer's chunks: %w", err)
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
 		mgr.log.Error("Failed to commit transaction", "error", err)
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
-
-	delete(mgr.memtable, fileID)
+	mgr.metaStore.Invalidate()
 
 	mgr.log.Debug("Checkpoint successful", "layerID", layerID, "objectKey", objectKey)
 
-	return nil
+	return versionID, nil
 }
 
-// GetAllFiles returns a list of all files in the database
-func (mgr *Manager) GetAllFiles(ctx context.Context) ([]sqlc.File, error) {
-	return mgr.metaStore.GetAllFiles(ctx)
-}
+// autoCheckpoint queues the active layer of a file to be committed under a
+// generated tag, on the initiative of the manager rather than of DuckDB, and
+// returns the tag and the sequence number of the checkpoint. If the next
+// checkpoint of the file finds nothing left to commit, that version takes its
+// tag instead, so that a tag chosen for it is not lost. It returns an empty tag
+// if there was nothing to commit. state.checkpointMu must be held.
+func (mgr *Manager) autoCheckpoint(ctx context.Context, filename string, fileID uint64, state *fileState) (string, uint64, error) {
+	tag := fmt.Sprintf("%s%s", autoTagPrefix, uuid.New().String())
+
+	seq, err := mgr.freezeActive(ctx, filename, fileID, state, tag)
+	if err != nil || seq == 0 {
+		return "", 0, err
+	}
+	state.autoTag = tag
 
-// LoadLayersByFileID delegates to the metadata store
-func (mgr *Manager) LoadLayersByFileID(ctx context.Context, fileID uint64, opts ...metadata.QueryOpt) ([]*metadata.Layer, error) {
-	return mgr.metaStore.LoadLayersByFileID(ctx, fileID, opts...)
+	return tag, seq, nil
 }
 
-// getChunkData retrieves chunk data from the object store using range requests
-func (mgr *Manager) getChunkData(ctx context.Context, c metadata.Chunk) ([]byte, error) {
-	objectKey, err := mgr.metaStore.GetObjectKey(ctx, c.LayerID)
+// retagAutoVersion gives tag to the version of the last automatic checkpoint of
+// a file. If that checkpoint is not committed yet, it takes the tag when it is,
+// and its sequence number is returned. It returns false if there is no such
+// version. state.checkpointMu must be held.
+func (mgr *Manager) retagAutoVersion(ctx context.Context, fileID uint64, state *fileState, tag string) (uint64, bool, error) {
+	if state.autoTag == "" || state.autoTag == tag {
+		return 0, false, nil
+	}
+
+	state.mu.Lock()
+	for _, f := range state.flushing {
+		if f.tag == state.autoTag {
+			f.tag, f.err = tag, nil
+			state.autoTag = ""
+			state.mu.Unlock()
+			return f.seq, true, nil
+		}
+	}
+	state.mu.Unlock()
+
+	layer, err := mgr.metaStore.GetLayerByVersion(ctx, fileID, state.autoTag, nil)
+	if errors.Is(err, types.ErrNotFound) {
+		// Dropped by retention since
+		state.autoTag = ""
+		return 0, false, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving object key: %w", err)
+		mgr.log.Error("Failed to get version", "tag", state.autoTag, "error", err)
+		return 0, false, err
 	}
 
-	if objectKey == "" {
-		return []byte{}, nil
+	if err := mgr.tagVersion(ctx, layer.VersionID, tag); err != nil {
+		return 0, false, err
 	}
 
-	layerSize := c.LayerRange[1] - c.LayerRange[0]
-	dataRange := [2]uint64{c.LayerRange[0], c.LayerRange[1] - 1} // layer range is exclusive of the end, but object range is inclusive
-	data, err := mgr.objectStore.GetObject(ctx, objectKey, dataRange)
+	state.autoTag = ""
+
+	return 0, true, nil
+}
+
+// tagVersion replaces the tag of a committed version.
+func (mgr *Manager) tagVersion(ctx context.Context, versionID uint64, tag string) error {
+	tx, err := mgr.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving data from object store: %w", err)
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := mgr.metaStore.UpdateVersionTag(ctx, tx, versionID, tag); err != nil {
+		mgr.log.Error("Failed to tag version", "tag", tag, "error", err)
+		if rbErr := tx.Rollback(); rbErr != nil {
+			mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+		}
+		return err
 	}
 
-	if uint64(len(data)) != layerSize {
-		return nil, fmt.Errorf("received incorrect number of bytes from object store: got %d, expected %d", len(data), layerSize)
+	if err := tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return data, nil
+	return nil
+}
+
+// GetAllFiles returns a list of all files in the database
+func (mgr *Manager) GetAllFiles(ctx context.Context) ([]sqlc.File, error) {
+	return mgr.metaStore.GetAllFiles(ctx)
+}
+
+// LoadLayersByFileID delegates to the metadata store
+func (mgr *Manager) LoadLayersByFileID(ctx context.Context, fileID uint64, opts ...metadata.QueryOpt) ([]*metadata.Layer, error) {
+	return mgr.metaStore.LoadLayersByFileID(ctx, fileID, opts...)
 }
@@ -3,13 +3,23 @@ package storage_test
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vinimdocarmo/quackfs/db/types"
 	"github.com/vinimdocarmo/quackfs/internal/quackfstest"
 	"github.com/vinimdocarmo/quackfs/internal/storage"
+	"github.com/vinimdocarmo/quackfs/internal/storage/journal"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+	"github.com/vinimdocarmo/quackfs/pkg/logger"
 )
 
 func TestWriteReadActiveLayer(t *testing.T) {
@@ -895,6 +905,220 @@ func TestConcurrentCheckpoint(t *testing.T) {
 	assert.Contains(t, []string{"v1", "v2"}, layers[0].Tag, "Layer tag should be either v1 or v2")
 }
 
+func TestCheckpointWhileWriting(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	files := []string{"testfile_checkpoint_writing_a", "testfile_checkpoint_writing_b"}
+	const writes = 50
+
+	for _, filename := range files {
+		_, err := mgr.InsertFile(ctx, filename)
+		require.NoError(t, err, "Failed to insert file")
+	}
+
+	wg := sync.WaitGroup{}
+	for _, filename := range files {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				assert.NoError(t, mgr.WriteFile(ctx, filename, []byte(fmt.Sprintf("%04d", i)), uint64(i*4)))
+			}
+		}()
+
+		// Reads see a prefix of the writes whatever the checkpoints are doing
+		go func() {
+			defer wg.Done()
+			for range writes {
+				data, err := mgr.ReadFile(ctx, filename, 0, writes*4)
+				assert.NoError(t, err)
+				for i := 0; i+4 <= len(data); i += 4 {
+					assert.Equal(t, fmt.Sprintf("%04d", i/4), string(data[i:i+4]))
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := range 5 {
+				assert.NoError(t, mgr.Checkpoint(ctx, filename, fmt.Sprintf("v%d", i)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var expected strings.Builder
+	for i := range writes {
+		fmt.Fprintf(&expected, "%04d", i)
+	}
+
+	for _, filename := range files {
+		require.NoError(t, mgr.Checkpoint(ctx, filename, "final"))
+
+		data, err := mgr.ReadFile(ctx, filename, 0, writes*4, storage.WithVersion("final"))
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), string(data), "Every write should be committed exactly where it was made")
+	}
+}
+
+func TestSizeOfWithVersion(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_size_of_version"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("12345"), 0)
+	require.NoError(t, err, "Failed to write initial content")
+
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err, "Failed to checkpoint with version v1")
+
+	err = mgr.WriteFile(ctx, filename, []byte("6789"), 5)
+	require.NoError(t, err, "Failed to write more content")
+
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err, "Failed to checkpoint with version v2")
+
+	err = mgr.WriteFile(ctx, filename, []byte("active layer"), 9)
+	require.NoError(t, err, "Failed to write to the active layer")
+
+	size, err := mgr.SizeOf(ctx, filename, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), size, "Size at v1 should ignore later layers")
+
+	size, err = mgr.SizeOf(ctx, filename, storage.WithVersion("v2"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), size, "Size at v2 should ignore the active layer")
+
+	size, err = mgr.SizeOf(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), size, "Latest size should include the active layer")
+
+	_, err = mgr.SizeOf(ctx, filename, storage.WithVersion("non_existent_version"))
+	assert.Error(t, err, "Expected error when sizing a non-existent version")
+}
+
+func TestReadFileWithTimestamp(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_read_with_timestamp"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	beforeFirstVersion := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	err = mgr.WriteFile(ctx, filename, []byte("first"), 0)
+	require.NoError(t, err, "Failed to write first content")
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err, "Failed to checkpoint with version v1")
+
+	time.Sleep(50 * time.Millisecond)
+	afterFirstVersion := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	err = mgr.WriteFile(ctx, filename, []byte("second"), 0)
+	require.NoError(t, err, "Failed to write second content")
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err, "Failed to checkpoint with version v2")
+
+	err = mgr.WriteFile(ctx, filename, []byte("latest"), 0)
+	require.NoError(t, err, "Failed to write to the active layer")
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithTimestamp(afterFirstVersion))
+	require.NoError(t, err, "Failed to read content as of the first version")
+	assert.Equal(t, "first", string(data))
+
+	size, err := mgr.SizeOf(ctx, filename, storage.WithTimestamp(afterFirstVersion))
+	require.NoError(t, err, "Failed to get size as of the first version")
+	assert.Equal(t, uint64(len("first")), size)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithTimestamp(time.Now()))
+	require.NoError(t, err, "Failed to read content as of now")
+	assert.Equal(t, "second", string(data), "Reading as of now should ignore the active layer")
+
+	_, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithTimestamp(beforeFirstVersion))
+	assert.ErrorIs(t, err, types.ErrNotFound, "Expected no version before the first checkpoint")
+
+	_, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v1"), storage.WithTimestamp(afterFirstVersion))
+	assert.Error(t, err, "Expected error when both a version tag and a timestamp are given")
+}
+
+func TestCloneFile(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	src := "testfile_clone_src"
+	dst := "testfile_clone_dst"
+	ctx := context.Background()
+
+	srcID, err := mgr.InsertFile(ctx, src)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, src, []byte("aaaaaaaaaa"), 0)
+	require.NoError(t, err, "Failed to write first content")
+	err = mgr.Checkpoint(ctx, src, "v1")
+	require.NoError(t, err, "Failed to checkpoint with version v1")
+
+	err = mgr.WriteFile(ctx, src, []byte("bbbbb"), 5)
+	require.NoError(t, err, "Failed to write second content")
+	err = mgr.Checkpoint(ctx, src, "v2")
+	require.NoError(t, err, "Failed to checkpoint with version v2")
+
+	dstID, err := mgr.CloneFile(ctx, src, dst, "v1")
+	require.NoError(t, err, "Failed to clone file")
+	require.NotEqual(t, srcID, dstID)
+
+	data, err := mgr.ReadFile(ctx, dst, 0, 100)
+	require.NoError(t, err, "Failed to read clone")
+	assert.Equal(t, "aaaaaaaaaa", string(data), "Clone should contain the data as of v1")
+
+	srcLayers, err := mgr.LoadLayersByFileID(ctx, srcID)
+	require.NoError(t, err)
+	dstLayers, err := mgr.LoadLayersByFileID(ctx, dstID)
+	require.NoError(t, err)
+	require.Len(t, dstLayers, 1, "Clone should only contain the layers up to v1")
+	assert.Equal(t, srcLayers[0].ObjectKey, dstLayers[0].ObjectKey, "Clone should share the layer object with the source")
+	assert.Equal(t, "v1", dstLayers[0].Tag)
+
+	// Writes to the clone must not leak into the source
+	err = mgr.WriteFile(ctx, dst, []byte("ccc"), 0)
+	require.NoError(t, err, "Failed to write to clone")
+	err = mgr.Checkpoint(ctx, dst, "clone-v1")
+	require.NoError(t, err, "Failed to checkpoint clone")
+
+	data, err = mgr.ReadFile(ctx, dst, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "cccaaaaaaa", string(data))
+
+	data, err = mgr.ReadFile(ctx, src, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaabbbbb", string(data), "Source should be unaffected by writes to the clone")
+
+	// Cloning the latest version
+	_, err = mgr.CloneFile(ctx, src, "testfile_clone_latest", "")
+	require.NoError(t, err, "Failed to clone latest version")
+	data, err = mgr.ReadFile(ctx, "testfile_clone_latest", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaabbbbb", string(data))
+
+	_, err = mgr.CloneFile(ctx, src, dst, "v1")
+	assert.Error(t, err, "Cloning into an existing file should fail")
+
+	_, err = mgr.CloneFile(ctx, src, "testfile_clone_missing_version", "non_existent_version")
+	assert.Error(t, err, "Cloning a non-existent version should fail")
+}
+
 func getVersionIDByTag(t *testing.T, ctx context.Context, db *sql.DB, tag string) int64 {
 	query := `SELECT id FROM versions WHERE tag = $1;`
 	var versionID int64
@@ -922,3 +1146,1431 @@ func getVersionTagByID(t *testing.T, ctx context.Context, db *sql.DB, id int64)
 
 	return tag
 }
+
+func TestCompact(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_compact"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	writes := []struct {
+		data    string
+		offset  uint64
+		version string
+	}{
+		{"aaaaaaaaaa", 0, "checkpoint-1"},
+		{"bbbbb", 5, "checkpoint-2"},
+		{"cc", 2, "checkpoint-3"},
+		{"dddd", 12, "checkpoint-4"},
+	}
+
+	for _, w := range writes {
+		err = mgr.WriteFile(ctx, filename, []byte(w.data), w.offset)
+		require.NoError(t, err, "Failed to write data for %s", w.version)
+		err = mgr.Checkpoint(ctx, filename, w.version)
+		require.NoError(t, err, "Failed to checkpoint %s", w.version)
+	}
+
+	result, err := mgr.Compact(ctx, filename, "checkpoint-1", "checkpoint-3")
+	require.NoError(t, err, "Failed to compact layers")
+	assert.Equal(t, 3, result.LayersMerged)
+	assert.Equal(t, 1, result.ChunksAfter, "Contiguous extents should be merged into a single chunk")
+	assert.Equal(t, uint64(17), result.BytesBefore)
+	assert.Equal(t, uint64(10), result.BytesAfter)
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 4, "Compacted layers should keep their version rows")
+	assert.Equal(t, layers[2].ID, layers[0].CompactedInto)
+	assert.Equal(t, layers[2].ID, layers[1].CompactedInto)
+	assert.Zero(t, layers[2].CompactedInto)
+	assert.Equal(t, result.ObjectKey, layers[2].ObjectKey)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaccabbbbb\x00\x00dddd", string(data), "Head should be unchanged by compaction")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-3"))
+	require.NoError(t, err)
+	assert.Equal(t, "aaccabbbbb", string(data))
+
+	// The compacted layer only holds the end of the run, not the versions before it
+	_, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-1"))
+	assert.ErrorIs(t, err, storage.ErrVersionCompacted)
+
+	// Compacting the remaining layers folds the compacted layer once more
+	result, err = mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.LayersMerged)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaccabbbbb\x00\x00dddd", string(data))
+
+	result, err = mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.LayersMerged, "A single live layer has nothing to compact")
+}
+
+func TestCompactKeepsVersionsOthersDependOn(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_compact_boundaries"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	for i, tag := range []string{"checkpoint-1", "release-1", "checkpoint-2", "checkpoint-3", "checkpoint-4", "checkpoint-5"} {
+		err = mgr.WriteFile(ctx, filename, []byte{byte('a' + i)}, uint64(i))
+		require.NoError(t, err, "Failed to write data for %s", tag)
+		err = mgr.Checkpoint(ctx, filename, tag)
+		require.NoError(t, err, "Failed to checkpoint %s", tag)
+	}
+
+	_, err = mgr.CloneFile(ctx, filename, "testfile_compact_boundaries_clone", "checkpoint-3")
+	require.NoError(t, err, "Failed to clone file")
+
+	// Without an explicit start the run starts after the newest version that
+	// must keep its content, here the one the clone was created from
+	result, err := mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.LayersMerged)
+
+	_, err = mgr.Compact(ctx, filename, "checkpoint-1", "checkpoint-2")
+	assert.ErrorContains(t, err, "named tag", "Compaction should not fold a named version into a newer layer")
+	_, err = mgr.Compact(ctx, filename, "checkpoint-2", "checkpoint-5")
+	assert.ErrorContains(t, err, "clone point", "Compaction should not fold a clone point into a newer layer")
+
+	result, err = mgr.Compact(ctx, filename, "checkpoint-2", "checkpoint-3")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.LayersMerged)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("release-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "ab", string(data))
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-3"))
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(data))
+
+	_, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-4"))
+	assert.ErrorIs(t, err, storage.ErrVersionCompacted)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(data))
+}
+
+func TestMetadataCacheSeesOtherProcesses(t *testing.T) {
+	start, cleanup := quackfstest.SetupRestartableStorageManager(t)
+	defer cleanup()
+
+	// Two managers on the same database, like a mount and an op command
+	mount, op := start(), start()
+
+	filename := "testfile_cache"
+	ctx := context.Background()
+
+	_, err := mount.InsertFile(ctx, filename)
+	require.NoError(t, err)
+	require.NoError(t, mount.WriteFile(ctx, filename, []byte("aaaaaaaaaa"), 0))
+	require.NoError(t, mount.Checkpoint(ctx, filename, "checkpoint-1"))
+	require.NoError(t, mount.WriteFile(ctx, filename, []byte("bb"), 2))
+	require.NoError(t, mount.Checkpoint(ctx, filename, "checkpoint-2"))
+
+	data, err := mount.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aabbaaaaaa", string(data))
+
+	// The compaction replaces the object of the newest layer
+	_, err = op.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	data, err = mount.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aabbaaaaaa", string(data), "A compaction by another process should not mix up cached chunks and objects")
+
+	require.NoError(t, op.WriteFile(ctx, filename, []byte("cc"), 10))
+	require.NoError(t, op.Checkpoint(ctx, filename, "v3"))
+	// The mount trusts what it read for up to a second
+	assert.Eventually(t, func() bool {
+		data, err = mount.ReadFile(ctx, filename, 0, 100)
+		return err == nil && string(data) == "aabbaaaaaacc"
+	}, 5*time.Second, 50*time.Millisecond, "A layer committed by another process should be visible")
+
+	size, err := mount.SizeOf(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), size)
+}
+
+func TestGarbageCollect(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_gc"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	for i, version := range []string{"checkpoint-1", "checkpoint-2", "checkpoint-3", "checkpoint-4"} {
+		err = mgr.WriteFile(ctx, filename, []byte("0123456789"), uint64(i*5))
+		require.NoError(t, err, "Failed to write data for %s", version)
+		err = mgr.Checkpoint(ctx, filename, version)
+		require.NoError(t, err, "Failed to checkpoint %s", version)
+	}
+
+	// The clone keeps sharing the objects of the first versions after the source
+	// is compacted
+	_, err = mgr.CloneFile(ctx, filename, "testfile_gc_clone", "checkpoint-2")
+	require.NoError(t, err, "Failed to clone file")
+
+	shared, err := mgr.Compact(ctx, filename, "", "checkpoint-2")
+	require.NoError(t, err, "Failed to compact file")
+	require.Len(t, shared.ReleasedKeys, 2)
+
+	compaction, err := mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err, "Failed to compact file")
+	require.Len(t, compaction.ReleasedKeys, 2)
+
+	result, err := mgr.GarbageCollect(ctx, storage.GCOptions{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.NotContains(t, result.Deleted, compaction.ReleasedKeys[0], "Objects within the grace period should be kept")
+
+	result, err = mgr.GarbageCollect(ctx, storage.GCOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Contains(t, result.Deleted, compaction.ReleasedKeys[0])
+	assert.Contains(t, result.Deleted, compaction.ReleasedKeys[1])
+	assert.NotContains(t, result.Deleted, shared.ReleasedKeys[0], "Objects shared with a clone should be kept")
+	assert.NotContains(t, result.Deleted, shared.ReleasedKeys[1], "Objects shared with a clone should be kept")
+	assert.NotContains(t, result.Deleted, shared.ObjectKey)
+	assert.NotContains(t, result.Deleted, compaction.ObjectKey)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-2"))
+	require.NoError(t, err, "Dry run should not delete anything")
+	assert.Equal(t, "012340123456789", string(data))
+
+	result, err = mgr.GarbageCollect(ctx, storage.GCOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, result.Deleted, compaction.ReleasedKeys[0])
+	assert.NotZero(t, result.BytesReclaimed)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "0123401234012340123456789", string(data))
+
+	data, err = mgr.ReadFile(ctx, "testfile_gc_clone", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "012340123456789", string(data))
+}
+
+func TestRetentionPolicyEvaluate(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	var layers []*metadata.Layer
+	for i, age := range []time.Duration{
+		15 * 24 * time.Hour, // 0: two weeks ago
+		3 * 24 * time.Hour,  // 1: three days ago
+		26 * time.Hour,      // 2: yesterday
+		25 * time.Hour,      // 3: yesterday
+		3 * time.Hour,       // 4: today
+		2 * time.Hour,       // 5: today
+		30 * time.Minute,    // 6: today
+		10 * time.Minute,    // 7: today
+	} {
+		layers = append(layers, &metadata.Layer{
+			ID:        uint64(i + 1),
+			Tag:       fmt.Sprintf("checkpoint-%d", i),
+			CreatedAt: now.Add(-age),
+		})
+	}
+	layers[1].Tag = "before-migration"
+	layers[2].Tag = "restore-1234"
+	layers[4].Tag = "auto-1234"
+
+	keptBy := func(decisions []storage.RetentionDecision) []string {
+		var kept []string
+		for _, d := range decisions {
+			if d.Keep {
+				kept = append(kept, fmt.Sprintf("%d:%s", d.Layer.ID-1, d.Reason))
+			}
+		}
+		return kept
+	}
+
+	t.Run("zero policy keeps everything", func(t *testing.T) {
+		decisions := storage.RetentionPolicy{}.Evaluate(layers, now)
+		assert.Len(t, keptBy(decisions), len(layers))
+	})
+
+	t.Run("keep last", func(t *testing.T) {
+		decisions := storage.RetentionPolicy{KeepLast: 2}.Evaluate(layers, now)
+		assert.Equal(t, []string{"1:named tag", "6:last", "7:head"}, keptBy(decisions))
+	})
+
+	t.Run("keep within", func(t *testing.T) {
+		decisions := storage.RetentionPolicy{KeepWithin: 2*time.Hour + time.Minute}.Evaluate(layers, now)
+		assert.Equal(t, []string{"1:named tag", "5:within", "6:within", "7:head"}, keptBy(decisions))
+	})
+
+	t.Run("keep daily and weekly", func(t *testing.T) {
+		decisions := storage.RetentionPolicy{KeepDaily: 2, KeepWeekly: 3}.Evaluate(layers, now)
+		assert.Equal(t, []string{"0:weekly", "1:named tag", "3:daily", "7:head"}, keptBy(decisions))
+	})
+
+	t.Run("keep hourly", func(t *testing.T) {
+		decisions := storage.RetentionPolicy{KeepHourly: 3}.Evaluate(layers, now)
+		assert.Equal(t, []string{"1:named tag", "4:hourly", "5:hourly", "7:head"}, keptBy(decisions))
+	})
+
+	t.Run("layers compacted into are kept", func(t *testing.T) {
+		compacted := []*metadata.Layer{
+			{ID: 1, Tag: "checkpoint-a", CreatedAt: now.Add(-3 * time.Hour), CompactedInto: 2},
+			{ID: 2, Tag: "checkpoint-b", CreatedAt: now.Add(-2 * time.Hour)},
+			{ID: 3, Tag: "checkpoint-c", CreatedAt: now.Add(-time.Hour)},
+		}
+		decisions := storage.RetentionPolicy{KeepWithin: 4 * time.Hour, KeepLast: 1}.Evaluate(compacted[:1], now)
+		assert.True(t, decisions[0].Keep)
+
+		decisions = storage.RetentionPolicy{KeepLast: 1}.Evaluate(compacted, now)
+		assert.Equal(t, []string{"2:head"}, keptBy(decisions))
+
+		compacted[0].Tag = "named"
+		decisions = storage.RetentionPolicy{KeepLast: 1}.Evaluate(compacted, now)
+		assert.Equal(t, []string{"0:named tag", "1:compacted into", "2:head"}, keptBy(decisions))
+	})
+}
+
+func TestApplyRetention(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_retention"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	writes := []struct {
+		data    string
+		offset  uint64
+		version string
+	}{
+		{"aaaaaaaaaa", 0, "checkpoint-1"},
+		{"bbbbb", 5, "checkpoint-2"},
+		{"cc", 2, "release-1"},
+		{"dddd", 12, "checkpoint-3"},
+		{"e", 0, "checkpoint-4"},
+		{"ff", 8, "checkpoint-5"},
+	}
+
+	for _, w := range writes {
+		err = mgr.WriteFile(ctx, filename, []byte(w.data), w.offset)
+		require.NoError(t, err, "Failed to write data for %s", w.version)
+		err = mgr.Checkpoint(ctx, filename, w.version)
+		require.NoError(t, err, "Failed to checkpoint %s", w.version)
+	}
+
+	readVersion := func(version string) string {
+		data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion(version))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	head := readVersion("")
+	release := readVersion("release-1")
+	last := readVersion("checkpoint-4")
+
+	// Without a policy nothing expires
+	result, err := mgr.ApplyRetention(ctx, filename, false)
+	require.NoError(t, err)
+	assert.Zero(t, result.Expired)
+
+	err = mgr.SetRetentionPolicy(ctx, filename, storage.RetentionPolicy{KeepLast: 2})
+	require.NoError(t, err)
+
+	policy, err := mgr.GetRetentionPolicy(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, storage.RetentionPolicy{KeepLast: 2}, policy)
+
+	result, err = mgr.ApplyRetention(ctx, filename, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Expired)
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	assert.Len(t, layers, len(writes), "Dry run should not drop any version")
+
+	result, err = mgr.ApplyRetention(ctx, filename, false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Expired)
+	assert.Len(t, result.Compactions, 2)
+
+	layers, err = mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	var tags []string
+	for _, layer := range layers {
+		tags = append(tags, layer.Tag)
+	}
+	assert.Equal(t, []string{"release-1", "checkpoint-4", "checkpoint-5"}, tags)
+
+	assert.Equal(t, head, readVersion(""), "Head should be byte-identical after retention")
+	assert.Equal(t, release, readVersion("release-1"))
+	assert.Equal(t, last, readVersion("checkpoint-4"))
+
+	_, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-1"))
+	assert.ErrorIs(t, err, types.ErrNotFound, "Expired versions should no longer be readable")
+}
+
+func TestTagVersion(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_tag"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	_, err = mgr.TagVersion(ctx, filename, "empty")
+	assert.ErrorIs(t, err, types.ErrNotFound, "A file without versions cannot be tagged")
+
+	err = mgr.WriteFile(ctx, filename, []byte("first"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "checkpoint-1")
+	require.NoError(t, err)
+
+	layer, err := mgr.TagVersion(ctx, filename, "before-migration")
+	require.NoError(t, err, "Failed to tag version")
+	assert.Equal(t, "before-migration", layer.Tag)
+
+	_, err = mgr.TagVersion(ctx, filename, "again")
+	assert.Error(t, err, "A version named by a user should not be renamed")
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("before-migration"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+
+	exists, err := mgr.HasVersion(ctx, filename, "checkpoint-1")
+	require.NoError(t, err)
+	assert.False(t, exists, "Tagging should replace the generated tag")
+
+	err = mgr.WriteFile(ctx, filename, []byte("second"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "checkpoint-2")
+	require.NoError(t, err)
+
+	_, err = mgr.TagVersion(ctx, filename, "before-migration")
+	assert.ErrorIs(t, err, types.ErrAlreadyExists, "Tags should be unique within a file")
+
+	err = mgr.Checkpoint(ctx, filename, "before-migration")
+	require.NoError(t, err, "Checkpoint without data should be a no-op")
+	err = mgr.WriteFile(ctx, filename, []byte("third"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "before-migration")
+	assert.Error(t, err, "Checkpointing with an existing tag should fail")
+
+	// Other files may reuse the tag
+	_, err = mgr.CloneFile(ctx, filename, "testfile_tag_clone", "")
+	require.NoError(t, err, "Clones should be able to keep the tags of their source")
+	exists, err = mgr.HasVersion(ctx, "testfile_tag_clone", "before-migration")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestValidateTag(t *testing.T) {
+	assert.NoError(t, storage.ValidateTag("before-migration"))
+	assert.NoError(t, storage.ValidateTag("v1.0"))
+	assert.Error(t, storage.ValidateTag(""))
+	assert.Error(t, storage.ValidateTag("checkpoint-1234"))
+	assert.Error(t, storage.ValidateTag("restore-1234"))
+	assert.Error(t, storage.ValidateTag("auto-1234"))
+	assert.Error(t, storage.ValidateTag("db@v1"))
+	assert.Error(t, storage.ValidateTag("a/b"))
+	assert.Error(t, storage.ValidateTag("2026-10-01T12:00:00Z"))
+}
+
+func TestRestore(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_restore"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("good data"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "before-migration")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("bad data that is longer"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "checkpoint-1")
+	require.NoError(t, err)
+
+	// Writes that were never checkpointed are discarded
+	err = mgr.WriteFile(ctx, filename, []byte("uncommitted"), 0)
+	require.NoError(t, err)
+
+	_, err = mgr.Restore(ctx, filename, "missing")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	tag, err := mgr.Restore(ctx, filename, "before-migration")
+	require.NoError(t, err, "Failed to restore file")
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "good data", strings.TrimRight(string(data), "\x00"))
+	assert.Len(t, data, len("bad data that is longer"), "Restoring a smaller version keeps the size of the file")
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 3, "Restore should append a layer")
+	assert.Equal(t, tag, layers[2].Tag)
+	assert.Empty(t, layers[2].ObjectKey, "Restore should not upload any data")
+
+	// Restoring a version that was itself restored reads the same bytes
+	_, err = mgr.Restore(ctx, filename, "checkpoint-1")
+	require.NoError(t, err)
+	_, err = mgr.Restore(ctx, filename, tag)
+	require.NoError(t, err)
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "good data", strings.TrimRight(string(data), "\x00"))
+
+	// History is kept, the bad version is still readable
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("checkpoint-1"))
+	require.NoError(t, err)
+	assert.Equal(t, "bad data that is longer", string(data))
+}
+
+func TestLockOffline(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	mounted, err := mgr.LockMounted(ctx)
+	require.NoError(t, err)
+	other, err := mgr.LockMounted(ctx)
+	require.NoError(t, err, "Mounts should share the lock")
+
+	_, err = mgr.LockOffline(ctx)
+	assert.ErrorIs(t, err, storage.ErrMounted)
+
+	require.NoError(t, mounted.Release(ctx))
+	require.NoError(t, other.Release(ctx))
+
+	offline, err := mgr.LockOffline(ctx)
+	require.NoError(t, err, "The lock should be free once every mount released it")
+	require.NoError(t, offline.Release(ctx))
+}
+
+func TestHistory(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_history"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("aaaaaaaaaa"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("bbbb"), 2)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("cc"), 12)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	history, err := mgr.History(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+
+	assert.Equal(t, "v1", history[0].Tag)
+	assert.Equal(t, 1, history[0].Chunks)
+	assert.Equal(t, uint64(10), history[0].Bytes)
+	assert.Equal(t, uint64(6), history[0].VisibleBytes, "Bytes overwritten by v2 should not be visible")
+	assert.NotEmpty(t, history[0].ObjectKey)
+	assert.False(t, history[0].CreatedAt.IsZero())
+
+	assert.Equal(t, "v2", history[1].Tag)
+	assert.Equal(t, 2, history[1].Chunks)
+	assert.Equal(t, uint64(6), history[1].Bytes)
+	assert.Equal(t, uint64(6), history[1].VisibleBytes)
+	assert.Greater(t, history[1].VersionID, history[0].VersionID)
+}
+
+func TestCheckpointCoalescesWrites(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_coalesce"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	// The same block rewritten over and over, like DuckDB does between checkpoints
+	for i := range 10 {
+		err = mgr.WriteFile(ctx, filename, []byte(strings.Repeat(fmt.Sprint(i), 8)), 0)
+		require.NoError(t, err)
+	}
+	err = mgr.WriteFile(ctx, filename, []byte("xx"), 3)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("tail"), 8)
+	require.NoError(t, err)
+
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	history, err := mgr.History(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, 1, history[0].Chunks, "Overwritten writes should be dropped and the rest merged")
+	assert.Equal(t, uint64(12), history[0].Bytes, "Only the latest bytes should be uploaded")
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, "999xx999tail", string(data))
+}
+
+func TestSparseFile(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_sparse"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("head"), 0)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("tail"), 1<<20)
+	require.NoError(t, err)
+
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	history, err := mgr.History(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint64(8), history[0].Bytes, "The gap should not be uploaded")
+
+	data, err := mgr.ReadFile(ctx, filename, 2, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, "ad"+strings.Repeat("\x00", 1<<20-4)+"ta", string(data))
+
+	// Punching a hole past the end of the file doesn't change its size
+	err = mgr.PunchHole(ctx, filename, 1, 1<<21)
+	require.NoError(t, err)
+
+	size, err := mgr.SizeOf(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<20+4), size)
+
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	history, err = mgr.History(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, uint64(0), history[1].Bytes, "A hole should have no bytes")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 4)
+	require.NoError(t, err)
+	assert.Equal(t, "h\x00\x00\x00", string(data))
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 4, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, "head", string(data), "Committed versions should not change")
+
+	// Extending the file only adds a hole, a shorter extension does nothing
+	err = mgr.Extend(ctx, filename, 1<<21)
+	require.NoError(t, err)
+	err = mgr.Extend(ctx, filename, 10)
+	require.NoError(t, err)
+
+	size, err = mgr.SizeOf(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<21), size)
+
+	err = mgr.Checkpoint(ctx, filename, "v3")
+	require.NoError(t, err)
+
+	history, err = mgr.History(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, uint64(0), history[2].Bytes, "An extension should have no bytes")
+	assert.Equal(t, 1, history[2].Chunks, "An extension should only record a hole")
+
+	data, err = mgr.ReadFile(ctx, filename, 1<<20, 8)
+	require.NoError(t, err)
+	assert.Equal(t, "tail\x00\x00\x00\x00", string(data))
+}
+
+func TestDiff(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_diff"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("aaaaaaaaaaaaaaaaaaaa"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("bbbb"), 4)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("cc"), 8)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("dddd"), 30)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v3")
+	require.NoError(t, err)
+
+	diff, err := mgr.Diff(ctx, filename, "v1", "v2")
+	require.NoError(t, err)
+	assert.Equal(t, [][2]uint64{{4, 10}}, diff.Ranges)
+	assert.Equal(t, uint64(6), diff.Bytes)
+
+	diff, err = mgr.Diff(ctx, filename, "v2", "")
+	require.NoError(t, err)
+	assert.Equal(t, [][2]uint64{{30, 34}}, diff.Ranges, "Empty target should diff against the latest version")
+
+	diff, err = mgr.Diff(ctx, filename, "v3", "v1")
+	require.NoError(t, err)
+	assert.Equal(t, [][2]uint64{{4, 10}, {30, 34}}, diff.Ranges)
+
+	diff, err = mgr.Diff(ctx, filename, "v2", "v2")
+	require.NoError(t, err)
+	assert.Empty(t, diff.Ranges)
+
+	_, err = mgr.Diff(ctx, filename, "missing", "v2")
+	assert.ErrorIs(t, err, types.ErrNotFound)
+}
+
+func TestDiffBlocks(t *testing.T) {
+	diff := &storage.DiffResult{Ranges: [][2]uint64{
+		{100, 200},
+		{storage.DuckDBHeaderSize, storage.DuckDBHeaderSize + 10},
+		{storage.DuckDBHeaderSize + storage.DuckDBBlockSize - 1, storage.DuckDBHeaderSize + 2*storage.DuckDBBlockSize + 1},
+	}}
+
+	header, blocks := diff.Blocks()
+	assert.True(t, header)
+	assert.Equal(t, []uint64{0, 1, 2}, blocks)
+
+	diff = &storage.DiffResult{Ranges: [][2]uint64{{storage.DuckDBHeaderSize + 5*storage.DuckDBBlockSize, storage.DuckDBHeaderSize + 6*storage.DuckDBBlockSize}}}
+	header, blocks = diff.Blocks()
+	assert.False(t, header)
+	assert.Equal(t, []uint64{5}, blocks)
+}
+
+func TestBranchFileName(t *testing.T) {
+	assert.Equal(t, "db@feature-x.duckdb", storage.BranchFileName("db.duckdb", "feature-x"))
+	assert.Equal(t, "db@feature-x@fix.duckdb", storage.BranchFileName("db@feature-x.duckdb", "fix"))
+	assert.Equal(t, "testfile@feature-x", storage.BranchFileName("testfile", "feature-x"))
+
+	assert.NoError(t, storage.ValidateBranchName("feature-x"))
+	assert.Error(t, storage.ValidateBranchName(""))
+	assert.Error(t, storage.ValidateBranchName("a@b"))
+	assert.Error(t, storage.ValidateBranchName("a/b"))
+	assert.Error(t, storage.ValidateBranchName(".hidden"))
+}
+
+func TestBranch(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_branch.duckdb"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("aaaaaaaaaa"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("bbbbb"), 5)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	branch, err := mgr.CreateBranch(ctx, filename, "feature-x", "v1")
+	require.NoError(t, err, "Failed to create branch")
+	assert.Equal(t, "testfile_branch@feature-x.duckdb", branch.FileName)
+
+	data, err := mgr.ReadFile(ctx, branch.FileName, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaaaa", string(data), "Branch should start from v1")
+
+	branchLayers, err := mgr.LoadLayersByFileID(ctx, branch.FileID)
+	require.NoError(t, err)
+	assert.Empty(t, branchLayers, "Creating a branch should not copy layers")
+
+	// The parent and the branch evolve independently
+	err = mgr.WriteFile(ctx, branch.FileName, []byte("cccccccccccc"), 8)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, branch.FileName, "feature-v1")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("dd"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v3")
+	require.NoError(t, err)
+
+	data, err = mgr.ReadFile(ctx, branch.FileName, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaacccccccccccc", string(data))
+
+	size, err := mgr.SizeOf(ctx, branch.FileName)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), size)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "ddaaabbbbb", string(data), "Parent should be unaffected by writes to the branch")
+
+	// Branches of branches read along the whole ancestry
+	sub, err := mgr.CreateBranch(ctx, branch.FileName, "fix", "")
+	require.NoError(t, err, "Failed to create branch of a branch")
+
+	err = mgr.WriteFile(ctx, sub.FileName, []byte("e"), 1)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, sub.FileName, "fix-v1")
+	require.NoError(t, err)
+
+	data, err = mgr.ReadFile(ctx, sub.FileName, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aeaaaaaacccccccccccc", string(data))
+
+	// Compacting the parent must not change what the branch reads
+	_, err = mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	_, err = mgr.Compact(ctx, filename, "v1", "v3")
+	assert.Error(t, err, "Compaction should not fold a branch point into a newer layer")
+
+	data, err = mgr.ReadFile(ctx, branch.FileName, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaacccccccccccc", string(data))
+
+	_, err = mgr.CreateBranch(ctx, filename, "feature-x", "v2")
+	assert.ErrorIs(t, err, types.ErrAlreadyExists)
+
+	branches, err := mgr.ListBranches(ctx, filename)
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	assert.Equal(t, "feature-x", branches[0].Name)
+	assert.Equal(t, "v1", branches[0].BaseTag)
+
+	err = mgr.DeleteBranch(ctx, filename, "feature-x")
+	assert.Error(t, err, "A branch with branches of its own should not be deleted")
+
+	err = mgr.DeleteBranch(ctx, branch.FileName, "fix")
+	require.NoError(t, err)
+	err = mgr.DeleteBranch(ctx, filename, "feature-x")
+	require.NoError(t, err)
+
+	_, err = mgr.SizeOf(ctx, branch.FileName)
+	assert.ErrorIs(t, err, types.ErrNotFound)
+
+	branches, err = mgr.ListBranches(ctx, filename)
+	require.NoError(t, err)
+	assert.Empty(t, branches)
+}
+
+func TestPromote(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_promote.duckdb"
+	scratch := "testfile_promote_scratch.duckdb"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("aaaaaaaaaa"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	_, err = mgr.CloneFile(ctx, filename, scratch, "")
+	require.NoError(t, err)
+
+	_, err = mgr.Promote(ctx, scratch, filename)
+	assert.Error(t, err, "A copy without new versions has nothing to promote")
+
+	err = mgr.WriteFile(ctx, scratch, []byte("bbb"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, scratch, "migration")
+	require.NoError(t, err)
+
+	result, err := mgr.Promote(ctx, scratch, filename)
+	require.NoError(t, err, "Failed to promote clone")
+	assert.Equal(t, 1, result.Layers)
+	assert.Equal(t, []string{"migration"}, result.Versions)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "bbbaaaaaaa", string(data))
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, "aaaaaaaaaa", string(data), "History of the target should be kept")
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+	assert.Equal(t, "migration", layers[1].Tag)
+
+	_, err = mgr.SizeOf(ctx, scratch)
+	assert.ErrorIs(t, err, types.ErrNotFound, "The promoted file should be gone")
+
+	// The target changed after the copy
+	_, err = mgr.CloneFile(ctx, filename, scratch, "")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, scratch, []byte("dddd"), 2)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, scratch, "migration-2")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, filename, []byte("cc"), 5)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	_, err = mgr.Promote(ctx, scratch, filename)
+	var conflict *storage.PromoteConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []string{"v2"}, conflict.Versions)
+	assert.Equal(t, [][2]uint64{{5, 6}}, conflict.Overlaps)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "bbbaaccaaa", string(data), "A refused promotion should not change the target")
+
+	// Branches are promoted onto their parent
+	branch, err := mgr.CreateBranch(ctx, filename, "feature-x", "")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, branch.FileName, []byte("e"), 9)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, branch.FileName, "feature-v1")
+	require.NoError(t, err)
+
+	_, err = mgr.Promote(ctx, branch.FileName, filename)
+	require.NoError(t, err, "Failed to promote branch")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "bbbaaccaae", string(data))
+
+	branches, err := mgr.ListBranches(ctx, filename)
+	require.NoError(t, err)
+	assert.Empty(t, branches)
+}
+
+func TestPromoteCompactedClone(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_promote_compacted.duckdb"
+	scratch := "testfile_promote_compacted_scratch.duckdb"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	for i, tag := range []string{"checkpoint-1", "checkpoint-2"} {
+		err = mgr.WriteFile(ctx, filename, []byte("aaaaa"), uint64(i*5))
+		require.NoError(t, err)
+		err = mgr.Checkpoint(ctx, filename, tag)
+		require.NoError(t, err)
+	}
+
+	_, err = mgr.CloneFile(ctx, filename, scratch, "")
+	require.NoError(t, err)
+
+	err = mgr.WriteFile(ctx, scratch, []byte("bbb"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, scratch, "migration")
+	require.NoError(t, err)
+
+	// Compaction gives both files objects of their own, which doesn't change
+	// what the clone shares with its source
+	_, err = mgr.Compact(ctx, filename, "", "")
+	require.NoError(t, err)
+	_, err = mgr.Compact(ctx, scratch, "", "checkpoint-2")
+	require.NoError(t, err)
+
+	result, err := mgr.Promote(ctx, scratch, filename)
+	require.NoError(t, err, "Failed to promote compacted clone")
+	assert.Equal(t, []string{"migration"}, result.Versions)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "bbbaaaaaaa", string(data))
+}
+
+func TestReaderReadAhead(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t,
+		storage.WithReadAhead(storage.ReadAheadPolicy{Trigger: 2, MinWindow: 2, MaxWindow: 4}))
+	defer cleanup()
+
+	filename := "testfile_readahead"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err)
+	require.NoError(t, mgr.WriteFile(ctx, filename, []byte("aaaaaaaaaaaa"), 0))
+	require.NoError(t, mgr.Checkpoint(ctx, filename, "v1"))
+	require.NoError(t, mgr.WriteFile(ctx, filename, []byte("bbbb"), 20)) // leaves a hole
+	require.NoError(t, mgr.Checkpoint(ctx, filename, "v2"))
+	require.NoError(t, mgr.WriteFile(ctx, filename, []byte("cc"), 4)) // not checkpointed
+
+	// A sequential scan prefetches whole windows, past the end of the file too
+	scan := func(r *storage.Reader) string {
+		defer r.Close()
+		var data []byte
+		for offset := uint64(0); offset < 32; offset += 4 {
+			block, err := r.ReadFile(ctx, offset, 4)
+			require.NoError(t, err)
+			data = append(data, block...)
+		}
+		return string(data)
+	}
+
+	assert.Equal(t, "aaaaccaaaaaa\x00\x00\x00\x00\x00\x00\x00\x00bbbb", scan(mgr.NewReader(filename)))
+	assert.Equal(t, "aaaaaaaaaaaa", scan(mgr.NewReader(filename, storage.WithVersion("v1"))))
+}
+
+func TestSpill(t *testing.T) {
+	spillDir := t.TempDir()
+	mgr, cleanup := quackfstest.SetupStorageManager(t, storage.WithSpill(spillDir, 16))
+	defer cleanup()
+
+	filename := "testfile_spill.duckdb"
+	ctx := context.Background()
+
+	_, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("0123456789"), 0)
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(spillDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Writes under the threshold should stay in memory")
+
+	err = mgr.WriteFile(ctx, filename, []byte("abcdefghij"), 10)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("XY"), 4)
+	require.NoError(t, err)
+
+	entries, err = os.ReadDir(spillDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Writes over the threshold should be spilled")
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "0123XY6789abcdefghij", string(data))
+
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	entries, err = os.ReadDir(spillDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Checkpoint should remove the spill file")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123XY6789abcdefghij", string(data))
+}
+
+func TestJournalRecovery(t *testing.T) {
+	journalDir := t.TempDir()
+	start, cleanup := quackfstest.SetupRestartableStorageManager(t, storage.WithJournal(journalDir))
+	defer cleanup()
+
+	filename := "testfile_journal.duckdb"
+	ctx := context.Background()
+
+	mgr := start()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte(strings.Repeat("a", 64)), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(journalDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Checkpoint should remove the journal")
+
+	// A stream of overlapping writes, one of them past the end of the file, that
+	// is never checkpointed
+	for i := range 50 {
+		offset := uint64(i*13) % 96
+		if i == 40 {
+			offset = 200
+		}
+		err = mgr.WriteFile(ctx, filename, fmt.Appendf(nil, "<%02d>", i), offset)
+		require.NoError(t, err)
+
+		if i == 25 {
+			require.NoError(t, mgr.Sync(ctx, filename))
+		}
+		if i == 30 {
+			require.NoError(t, mgr.PunchHole(ctx, filename, 20, 30))
+		}
+	}
+
+	expected, err := mgr.ReadFile(ctx, filename, 0, 1000)
+	require.NoError(t, err)
+	require.Len(t, expected, 204)
+
+	// The manager is killed halfway through appending a write to the journal
+	entries, err = os.ReadDir(journalDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	f, err := os.OpenFile(filepath.Join(journalDir, entries[0].Name()), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mgr = start()
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data, "Reads after a restart should see the journaled writes")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 1000, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 64), string(data), "Committed versions should not change")
+
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	entries, err = os.ReadDir(journalDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Checkpoint should remove the journal")
+
+	mgr = start()
+
+	assert.Equal(t, uint64(0), mgr.GetActiveLayerSize(ctx, fileID), "Checkpointed writes should not be replayed")
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+}
+
+func TestJournalReplaySkipsDeletedFiles(t *testing.T) {
+	journalDir := t.TempDir()
+	start, cleanup := quackfstest.SetupRestartableStorageManager(t, storage.WithJournal(journalDir))
+	defer cleanup()
+
+	// A file deleted while no manager was running left writes behind
+	j, err := journal.Open(journalDir)
+	require.NoError(t, err)
+	require.NoError(t, j.Append(math.MaxInt64, 0, []byte("orphan")))
+	require.NoError(t, j.Close())
+
+	start()
+
+	entries, err := os.ReadDir(journalDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "The journal of a deleted file should be removed")
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, mode := range []string{"none", "local", "remote"} {
+		d, err := storage.ParseDurability(mode)
+		require.NoError(t, err)
+		assert.Equal(t, mode, string(d))
+	}
+
+	_, err := storage.ParseDurability("fast")
+	assert.Error(t, err)
+
+	_, err = storage.NewManager(nil, nil, logger.New(os.Stderr), storage.WithDurability(storage.DurabilityLocal))
+	assert.Error(t, err, "Local durability without a journal should be refused")
+
+	mgr, err := storage.NewManager(nil, nil, logger.New(os.Stderr))
+	require.NoError(t, err, "A manager without a journal should start")
+	assert.Equal(t, storage.DurabilityNone, mgr.Durability(), "Durability should default to none without a journal")
+}
+
+func TestSyncRemote(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t, storage.WithDurability(storage.DurabilityRemote))
+	defer cleanup()
+
+	filename := "testfile_sync_remote.duckdb"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("hello"), 0)
+	require.NoError(t, err)
+
+	err = mgr.Sync(ctx, filename)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), mgr.GetActiveLayerSize(ctx, fileID), "Sync should commit the active layer")
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	err = mgr.Sync(ctx, filename)
+	require.NoError(t, err, "Sync without writes should do nothing")
+
+	// The checkpoint that follows has nothing left to commit and tags the
+	// version created by the sync
+	err = mgr.Checkpoint(ctx, filename, "named")
+	require.NoError(t, err)
+
+	layers, err = mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	assert.Equal(t, "named", layers[0].Tag)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("named"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestRunAutoCheckpoint(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	small := "testfile_auto_small.duckdb"
+	large := "testfile_auto_large.duckdb"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	smallID, err := mgr.InsertFile(ctx, small)
+	require.NoError(t, err, "Failed to insert file")
+	largeID, err := mgr.InsertFile(ctx, large)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, small, []byte("small"), 0)
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, large, []byte(strings.Repeat("x", 64)), 0)
+	require.NoError(t, err)
+
+	go mgr.RunAutoCheckpoint(ctx, storage.AutoCheckpointPolicy{
+		MaxBytes: 32,
+		MaxAge:   time.Hour,
+		Interval: 10 * time.Millisecond,
+	})
+
+	require.Eventually(t, func() bool {
+		return mgr.GetActiveLayerSize(ctx, largeID) == 0
+	}, 5*time.Second, 10*time.Millisecond, "Active layer over the size limit should be checkpointed")
+
+	assert.Equal(t, uint64(5), mgr.GetActiveLayerSize(ctx, smallID), "Active layer under the limits should be kept")
+
+	// Automatic checkpoints are committed in the background
+	require.NoError(t, mgr.Flush(ctx, large))
+
+	layers, err := mgr.LoadLayersByFileID(ctx, largeID)
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	assert.True(t, strings.HasPrefix(layers[0].Tag, "auto-"), "Automatic checkpoints should not look like DuckDB checkpoints")
+
+	// DuckDB's own checkpoint has nothing left to commit and tags the automatic one
+	err = mgr.Checkpoint(ctx, large, "named")
+	require.NoError(t, err)
+
+	data, err := mgr.ReadFile(ctx, large, 0, 100, storage.WithVersion("named"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", 64), string(data))
+
+	data, err = mgr.ReadFile(ctx, small, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(data))
+}
+
+func TestStartCheckpoint(t *testing.T) {
+	journalDir := t.TempDir()
+	mgr, cleanup := quackfstest.SetupStorageManager(t, storage.WithJournal(journalDir))
+	defer cleanup()
+
+	filename := "testfile_start_checkpoint.duckdb"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("0123456789"), 0)
+	require.NoError(t, err)
+	err = mgr.StartCheckpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), mgr.GetActiveLayerSize(ctx, fileID), "Writes should go to a new active layer right away")
+
+	// Frozen writes are read from memory until they are committed
+	err = mgr.WriteFile(ctx, filename, []byte("ab"), 2)
+	require.NoError(t, err)
+	data, err := mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "01ab456789", string(data))
+
+	err = mgr.StartCheckpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+	err = mgr.WriteFile(ctx, filename, []byte("XYZ"), 10)
+	require.NoError(t, err)
+
+	require.NoError(t, mgr.Flush(ctx, filename))
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+	assert.Equal(t, "v1", layers[0].Tag, "Checkpoints should be committed in the order they were started")
+	assert.Equal(t, "v2", layers[1].Tag)
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v1"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v2"))
+	require.NoError(t, err)
+	assert.Equal(t, "01ab456789", string(data))
+
+	data, err = mgr.ReadFile(ctx, filename, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "01ab456789XYZ", string(data))
+
+	entries, err := os.ReadDir(journalDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Only the writes made since the last checkpoint should stay journaled")
+}
+
+func TestCheckpointWithTakenTag(t *testing.T) {
+	mgr, cleanup := quackfstest.SetupStorageManager(t)
+	defer cleanup()
+
+	filename := "testfile_taken_tag.duckdb"
+	ctx := context.Background()
+
+	fileID, err := mgr.InsertFile(ctx, filename)
+	require.NoError(t, err, "Failed to insert file")
+
+	err = mgr.WriteFile(ctx, filename, []byte("0123456789"), 0)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	require.NoError(t, err)
+
+	// Retrying can't fix a taken tag, the checkpoint fails right away but its
+	// writes are committed under another tag
+	err = mgr.WriteFile(ctx, filename, []byte("ab"), 2)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v1")
+	assert.ErrorIs(t, err, types.ErrAlreadyExists)
+
+	// Later checkpoints don't wait behind it
+	err = mgr.WriteFile(ctx, filename, []byte("XYZ"), 10)
+	require.NoError(t, err)
+	err = mgr.Checkpoint(ctx, filename, "v2")
+	require.NoError(t, err)
+
+	layers, err := mgr.LoadLayersByFileID(ctx, fileID)
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+	assert.Equal(t, "v1", layers[0].Tag)
+	assert.NotEqual(t, "v1", layers[1].Tag)
+	assert.Equal(t, "v2", layers[2].Tag)
+
+	data, err := mgr.ReadFile(ctx, filename, 0, 100, storage.WithVersion("v2"))
+	require.NoError(t, err)
+	assert.Equal(t, "01ab456789XYZ", string(data))
+}
+
+// BenchmarkConcurrentFiles reads and writes several files in parallel while
+// they are being checkpointed, which only contend when they hit the same file.
+func BenchmarkConcurrentFiles(b *testing.B) {
+	mgr, cleanup := quackfstest.SetupStorageManager(b)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const numFiles = 8
+	files := make([]string, numFiles)
+	for i := range files {
+		files[i] = fmt.Sprintf("benchfile_concurrent_%d", i)
+		_, err := mgr.InsertFile(ctx, files[i])
+		require.NoError(b, err, "Failed to insert file")
+		require.NoError(b, mgr.WriteFile(ctx, files[i], make([]byte, 4096), 0))
+	}
+
+	checkpoints := make(chan struct{})
+	defer func() {
+		cancel()
+		<-checkpoints
+	}()
+
+	go func() {
+		defer close(checkpoints)
+		for i := 0; ctx.Err() == nil; i++ {
+			if err := mgr.Checkpoint(ctx, files[i%numFiles], fmt.Sprintf("bench-%d", i)); err != nil && ctx.Err() == nil {
+				b.Errorf("Checkpoint failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	var next sync.Mutex
+	var worker int
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		filename := files[worker%numFiles]
+		worker++
+		next.Unlock()
+
+		data := make([]byte, 512)
+		for i := 0; pb.Next(); i++ {
+			offset := uint64(i%8) * 512
+			if i%2 == 0 {
+				if err := mgr.WriteFile(ctx, filename, data, offset); err != nil {
+					b.Error(err)
+					return
+				}
+			} else {
+				if _, err := mgr.ReadFile(ctx, filename, offset, 512); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	})
+}
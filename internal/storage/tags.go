@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vinimdocarmo/quackfs/db/types"
+	"github.com/vinimdocarmo/quackfs/internal/storage/metadata"
+)
+
+// ValidateTag checks that a user-chosen version tag can be told apart from the
+// tags generated for checkpoints and from timestamps, and can be used in a
+// versioned file name such as db.duckdb@<tag>.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return errors.New("tag cannot be empty")
+	}
+	for _, prefix := range generatedTagPrefixes {
+		if strings.HasPrefix(tag, prefix) {
+			return fmt.Errorf("tag cannot start with %q, it is reserved for generated tags", prefix)
+		}
+	}
+	if strings.ContainsAny(tag, "@/\x00") {
+		return errors.New("tag cannot contain '@', '/' or NUL characters")
+	}
+	if _, err := time.Parse(time.RFC3339, tag); err == nil {
+		return errors.New("tag cannot be an RFC 3339 timestamp")
+	}
+	return nil
+}
+
+// HasVersion reports whether the file has a version with the given tag.
+func (mgr *Manager) HasVersion(ctx context.Context, filename string, tag string) (bool, error) {
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename)
+	if err != nil {
+		return false, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	_, err = mgr.metaStore.GetLayerByVersion(ctx, fileID, tag, nil)
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// TagVersion gives a name to the latest committed version of a file, replacing
+// the tag generated when it was checkpointed. Tags are unique within a file, and
+// a version that was already named by a user is not renamed.
+func (mgr *Manager) TagVersion(ctx context.Context, filename string, tag string) (*metadata.Layer, error) {
+	if err := ValidateTag(tag); err != nil {
+		return nil, err
+	}
+
+	tx, err := mgr.db.BeginTx(ctx, nil)
+	if err != nil {
+		mgr.log.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction after panic", "error", rbErr)
+			}
+			panic(p)
+		} else if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				mgr.log.Error("Failed to rollback transaction", "error", rbErr)
+			}
+		}
+	}()
+
+	fileID, err := mgr.metaStore.GetFileIDByName(ctx, filename, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to get file ID", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to get file ID: %w", err)
+	}
+
+	_, err = mgr.metaStore.GetLayerByVersion(ctx, fileID, tag, tx)
+	if err == nil {
+		err = fmt.Errorf("tag %q: %w", tag, types.ErrAlreadyExists)
+		return nil, err
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		mgr.log.Error("Failed to look up tag", "tag", tag, "error", err)
+		return nil, err
+	}
+
+	layers, err := mgr.metaStore.LoadLayersByFileID(ctx, fileID, metadata.WithTx(tx))
+	if err != nil {
+		mgr.log.Error("Failed to load layers", "filename", filename, "error", err)
+		return nil, fmt.Errorf("failed to load layers: %w", err)
+	}
+
+	if len(layers) == 0 {
+		err = fmt.Errorf("%s has no committed version to tag: %w", filename, types.ErrNotFound)
+		return nil, err
+	}
+
+	latest := layers[len(layers)-1]
+	if !isGeneratedTag(latest.Tag) {
+		err = fmt.Errorf("latest version of %s is already tagged %q", filename, latest.Tag)
+		return nil, err
+	}
+
+	if err = mgr.metaStore.UpdateVersionTag(ctx, tx, latest.VersionID, tag); err != nil {
+		mgr.log.Error("Failed to tag version", "tag", tag, "error", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		mgr.log.Error("Failed to commit transaction", "error", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	mgr.log.Info("Version tagged", "filename", filename, "tag", tag, "previousTag", latest.Tag, "layerID", latest.ID)
+
+	latest.Tag = tag
+
+	return latest, nil
+}
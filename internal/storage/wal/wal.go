@@ -14,9 +14,10 @@ import (
 )
 
 // DBCheckpointer is an interface that defines the methods needed by WALManager
-// to checkpoint a database file
+// to checkpoint a database file. The checkpoint may be committed after
+// StartCheckpoint returns, as long as its writes are safe from a crash by then.
 type DBCheckpointer interface {
-	Checkpoint(ctx context.Context, filename string, version string) error
+	StartCheckpoint(ctx context.Context, filename string, version string) error
 }
 
 // WALManager handles operations for DuckDB WAL (Write-Ahead Log) files.
@@ -26,6 +27,8 @@ type WALManager struct {
 	log     *log.Logger    // Logger for WAL operations
 	mgr     DBCheckpointer // Reference to the storage manager for checkpointing
 	mu      sync.RWMutex   // Mutex to protect concurrent operations
+
+	nextTags map[string]string // Tags to give to the next checkpoint of each database file
 }
 
 func NewWALManager(walPath string, mgr DBCheckpointer, logger *log.Logger) *WALManager {
@@ -33,9 +36,10 @@ func NewWALManager(walPath string, mgr DBCheckpointer, logger *log.Logger) *WALM
 	walLog.SetPrefix("📝 WAL")
 
 	return &WALManager{
-		walPath: walPath,
-		log:     walLog,
-		mgr:     mgr,
+		walPath:  walPath,
+		log:      walLog,
+		mgr:      mgr,
+		nextTags: make(map[string]string),
 	}
 }
 
@@ -228,11 +232,15 @@ func (wm *WALManager) Remove(ctx context.Context, filename string) error {
 
 	dbFilename := wm.GetDBFilename(filename)
 	checkpointID := fmt.Sprintf("checkpoint-%s", uuid.New().String())
+	if tag, ok := wm.nextTags[dbFilename]; ok {
+		checkpointID = tag
+	}
 
-	if err := wm.mgr.Checkpoint(ctx, dbFilename, checkpointID); err != nil {
+	if err := wm.mgr.StartCheckpoint(ctx, dbFilename, checkpointID); err != nil {
 		wm.log.Error("Failed to checkpoint database", "dbFilename", dbFilename, "error", err)
 		return fmt.Errorf("failed to checkpoint database: %w", err)
 	}
+	delete(wm.nextTags, dbFilename)
 
 	if err := os.Remove(wm.GetFilePath(filename)); err != nil {
 		wm.log.Error("Failed to delete WAL file", "filename", filename, "error", err)
@@ -243,6 +251,30 @@ func (wm *WALManager) Remove(ctx context.Context, filename string) error {
 	return nil
 }
 
+// SetNextTag sets the tag given to the next checkpoint of a database file,
+// instead of a generated checkpoint-<uuid> tag. An empty tag clears it.
+func (wm *WALManager) SetNextTag(dbFilename string, tag string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	if tag == "" {
+		delete(wm.nextTags, dbFilename)
+		return
+	}
+
+	wm.nextTags[dbFilename] = tag
+	wm.log.Debug("Next checkpoint tag set", "dbFilename", dbFilename, "tag", tag)
+}
+
+// NextTag returns the tag set for the next checkpoint of a database file, if any.
+func (wm *WALManager) NextTag(dbFilename string) (string, bool) {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+
+	tag, ok := wm.nextTags[dbFilename]
+	return tag, ok
+}
+
 func (wm *WALManager) Sync(filename string) error {
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
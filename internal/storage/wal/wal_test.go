@@ -18,7 +18,7 @@ type mockStorageManager struct {
 	checkpointFn func(ctx context.Context, filename, version string) error
 }
 
-func (m *mockStorageManager) Checkpoint(ctx context.Context, filename string, version string) error {
+func (m *mockStorageManager) StartCheckpoint(ctx context.Context, filename string, version string) error {
 	if m.checkpointFn != nil {
 		return m.checkpointFn(ctx, filename, version)
 	}
@@ -249,6 +249,46 @@ func TestWALManagerRemove(t *testing.T) {
 	})
 }
 
+func TestWALManagerNextTag(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "walmanager_tag_test_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	logger := log.NewWithOptions(os.Stderr, log.Options{Level: log.FatalLevel})
+
+	var versions []string
+	mockSM := &mockStorageManager{
+		checkpointFn: func(ctx context.Context, filename, version string) error {
+			versions = append(versions, version)
+			return nil
+		},
+	}
+
+	wm := NewWALManager(tmpDir, mockSM, logger)
+
+	_, ok := wm.NextTag("test.duckdb")
+	assert.False(t, ok)
+
+	wm.SetNextTag("test.duckdb", "before-migration")
+	tag, ok := wm.NextTag("test.duckdb")
+	assert.True(t, ok)
+	assert.Equal(t, "before-migration", tag)
+
+	for range 2 {
+		require.NoError(t, wm.Create("test.duckdb.wal"))
+		require.NoError(t, wm.Remove(context.Background(), "test.duckdb.wal"))
+	}
+
+	require.Len(t, versions, 2)
+	assert.Equal(t, "before-migration", versions[0], "Next checkpoint should use the tag that was set")
+	assert.Contains(t, versions[1], "checkpoint-", "Tag should only be used once")
+
+	wm.SetNextTag("test.duckdb", "v1")
+	wm.SetNextTag("test.duckdb", "")
+	_, ok = wm.NextTag("test.duckdb")
+	assert.False(t, ok, "Empty tag should clear the next tag")
+}
+
 func TestWALManagerEdgeCases(t *testing.T) {
 	// Create a temporary directory for testing
 	tmpDir, err := os.MkdirTemp("", "walmanager_edge_test_*")